@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/pborman/uuid"
+)
+
+// pollInterval is how often --wait polls the last operation.
+const pollInterval = 2 * time.Second
+
+// serviceOptions select a service and plan by name or ID.
+type serviceOptions struct {
+	Service string `short:"s" long:"service" required:"yes" description:"Service name or ID"`
+	Plan    string `long:"plan" description:"Plan name or ID, optional for services with a single plan"`
+}
+
+// resolve returns the IDs of the selected service and plan, looking up names in the catalog.
+func (o serviceOptions) resolve(ctx context.Context) (string, string, error) {
+	if uuid.Parse(o.Service) != nil && uuid.Parse(o.Plan) != nil {
+		return o.Service, o.Plan, nil
+	}
+	catalog, err := newClient().Catalog(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	for _, service := range catalog.Services {
+		if service.Name != o.Service && service.ID.String() != o.Service {
+			continue
+		}
+		if o.Plan == "" {
+			if len(service.Plans) != 1 {
+				return "", "", fmt.Errorf("service %s has %d plans, select one with --plan", service.Name, len(service.Plans))
+			}
+			return service.ID.String(), service.Plans[0].ID.String(), nil
+		}
+		for _, plan := range service.Plans {
+			if plan.Name == o.Plan || plan.ID.String() == o.Plan {
+				return service.ID.String(), plan.ID.String(), nil
+			}
+		}
+		return "", "", fmt.Errorf("service %s has no plan %s", service.Name, o.Plan)
+	}
+	return "", "", fmt.Errorf("unknown service %s", o.Service)
+}
+
+type parameterOptions struct {
+	Parameters     []string `short:"p" long:"parameter" value-name:"NAME=VALUE" description:"Parameter (repeatable)"`
+	ParametersFile string   `short:"f" long:"parameters-file" description:"JSON file holding an object of parameters, overridden by --parameter"`
+}
+
+func (o parameterOptions) parameters() (map[string]string, error) {
+	parameters := make(map[string]string)
+	if o.ParametersFile != "" {
+		data, err := ioutil.ReadFile(o.ParametersFile)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &parameters); err != nil {
+			return nil, fmt.Errorf("invalid parameters file %s: %v", o.ParametersFile, err)
+		}
+	}
+	for _, parameter := range o.Parameters {
+		parts := strings.SplitN(parameter, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid parameter %q, expected NAME=VALUE", parameter)
+		}
+		parameters[parts[0]] = parts[1]
+	}
+	return parameters, nil
+}
+
+type asyncOptions struct {
+	Async bool `long:"async" description:"Accept asynchronous completion"`
+	Wait  bool `long:"wait" description:"Wait for asynchronous operations to complete"`
+}
+
+// wait polls the last operation of an instance or binding until it completes, if requested. The operations
+// deleting them (deleting is set) also complete once the broker reports the instance or binding as gone.
+func (o asyncOptions) wait(ctx context.Context, instanceID string, bindingID string, operation string, deleting bool) error {
+	if !o.Wait || operation == "" {
+		return nil
+	}
+	for {
+		resp, err := newClient().LastOperation(ctx, instanceID, bindingID, operation)
+		if brokerErr, ok := err.(errors.BrokerError); ok && deleting && brokerErr.Status == http.StatusGone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch resp.State {
+		case broker.LastOperationStateSucceeded:
+			return nil
+		case broker.LastOperationStateFailed:
+			return fmt.Errorf("operation %s failed: %s", operation, resp.Description)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", resp.State, resp.Description)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// platformOptions describe the platform requests originate from.
+type platformOptions struct {
+	Organization string `long:"organization" description:"Organization GUID"`
+	Space        string `long:"space" description:"Space GUID"`
+	Namespace    string `long:"namespace" description:"Kubernetes namespace, sent as the platform context"`
+}
+
+func (o platformOptions) context() *broker.PlatformContext {
+	if o.Namespace == "" {
+		return nil
+	}
+	return &broker.PlatformContext{Platform: "kubernetes", Namespace: o.Namespace}
+}
+
+type catalogCommand struct{}
+
+func (c *catalogCommand) Execute(args []string) error {
+	catalog, err := newClient().Catalog(context.Background())
+	if err != nil {
+		return err
+	}
+	return output(catalog, func(w *tabwriter.Writer) {
+		row(w, "SERVICE", "SERVICE ID", "PLAN", "PLAN ID", "DESCRIPTION")
+		for _, service := range catalog.Services {
+			for _, plan := range service.Plans {
+				row(w, service.Name, service.ID, plan.Name, plan.ID, plan.Description)
+			}
+		}
+	})
+}
+
+type provisionCommand struct {
+	serviceOptions
+	platformOptions
+	parameterOptions
+	asyncOptions
+	Args struct {
+		InstanceID string `positional-arg-name:"instance-id"`
+	} `positional-args:"yes"`
+}
+
+func (c *provisionCommand) Execute(args []string) error {
+	ctx := context.Background()
+	serviceID, planID, err := c.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	parameters, err := c.parameters()
+	if err != nil {
+		return err
+	}
+	instanceID := c.Args.InstanceID
+	if instanceID == "" {
+		instanceID = uuid.New()
+	}
+
+	resp, err := newClient().Provision(ctx, instanceID, &broker.ProvisionRequest{
+		ServiceID:         uuid.Parse(serviceID),
+		PlanID:            uuid.Parse(planID),
+		OrganizationID:    c.Organization,
+		SpaceID:           c.Space,
+		Parameters:        parameters,
+		AcceptsIncomplete: c.Async,
+		Context:           c.context(),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		if err := c.wait(ctx, instanceID, "", resp.Operation, false); err != nil {
+			return err
+		}
+	}
+	return output(map[string]interface{}{"instance_id": instanceID, "status": resp.StatusCode, "response": resp}, func(w *tabwriter.Writer) {
+		row(w, "INSTANCE ID", "STATUS", "OPERATION", "DASHBOARD URL")
+		row(w, instanceID, http.StatusText(resp.StatusCode), resp.Operation, resp.DashboardURL)
+	})
+}
+
+type updateCommand struct {
+	serviceOptions
+	platformOptions
+	parameterOptions
+	asyncOptions
+	Args struct {
+		InstanceID string `positional-arg-name:"instance-id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *updateCommand) Execute(args []string) error {
+	ctx := context.Background()
+	serviceID, planID, err := c.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	parameters, err := c.parameters()
+	if err != nil {
+		return err
+	}
+
+	resp, err := newClient().Update(ctx, c.Args.InstanceID, &broker.UpdateRequest{
+		ServiceID:         uuid.Parse(serviceID),
+		PlanID:            uuid.Parse(planID),
+		Parameters:        parameters,
+		AcceptsIncomplete: c.Async,
+		Context:           c.context(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.wait(ctx, c.Args.InstanceID, "", resp.Operation, false); err != nil {
+		return err
+	}
+	return output(resp, func(w *tabwriter.Writer) {
+		row(w, "INSTANCE ID", "OPERATION")
+		row(w, c.Args.InstanceID, resp.Operation)
+	})
+}
+
+type deprovisionCommand struct {
+	serviceOptions
+	asyncOptions
+	Args struct {
+		InstanceID string `positional-arg-name:"instance-id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *deprovisionCommand) Execute(args []string) error {
+	ctx := context.Background()
+	serviceID, planID, err := c.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := newClient().Deprovision(ctx, c.Args.InstanceID, serviceID, planID, c.Async)
+	if err != nil {
+		return err
+	}
+	if err := c.wait(ctx, c.Args.InstanceID, "", resp.Operation, true); err != nil {
+		return err
+	}
+	return output(resp, func(w *tabwriter.Writer) {
+		row(w, "INSTANCE ID", "OPERATION")
+		row(w, c.Args.InstanceID, resp.Operation)
+	})
+}
+
+type bindCommand struct {
+	serviceOptions
+	platformOptions
+	parameterOptions
+	asyncOptions
+	Args struct {
+		InstanceID string `positional-arg-name:"instance-id" required:"yes"`
+		BindingID  string `positional-arg-name:"binding-id"`
+	} `positional-args:"yes"`
+}
+
+func (c *bindCommand) Execute(args []string) error {
+	ctx := context.Background()
+	serviceID, planID, err := c.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	parameters, err := c.parameters()
+	if err != nil {
+		return err
+	}
+	bindingID := c.Args.BindingID
+	if bindingID == "" {
+		bindingID = uuid.New()
+	}
+
+	client := newClient()
+	resp, err := client.Bind(ctx, c.Args.InstanceID, bindingID, &broker.BindRequest{
+		ServiceID:         uuid.Parse(serviceID),
+		PlanID:            uuid.Parse(planID),
+		Parameters:        parameters,
+		AcceptsIncomplete: c.Async,
+		Context:           c.context(),
+	})
+	if err != nil {
+		return err
+	}
+	credentials := resp.Credentials
+	if resp.StatusCode == http.StatusAccepted && c.Wait {
+		if err := c.wait(ctx, c.Args.InstanceID, bindingID, resp.Operation, false); err != nil {
+			return err
+		}
+		binding, err := client.GetBinding(ctx, c.Args.InstanceID, bindingID)
+		if err != nil {
+			return err
+		}
+		credentials = binding.Credentials
+	}
+
+	return output(map[string]interface{}{"binding_id": bindingID, "status": resp.StatusCode, "operation": resp.Operation, "credentials": credentials}, func(w *tabwriter.Writer) {
+		row(w, "binding_id", bindingID)
+		row(w, "status", http.StatusText(resp.StatusCode))
+		if resp.Operation != "" {
+			row(w, "operation", resp.Operation)
+		}
+		fields(w, credentials)
+	})
+}
+
+type unbindCommand struct {
+	serviceOptions
+	asyncOptions
+	Args struct {
+		InstanceID string `positional-arg-name:"instance-id" required:"yes"`
+		BindingID  string `positional-arg-name:"binding-id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *unbindCommand) Execute(args []string) error {
+	ctx := context.Background()
+	serviceID, planID, err := c.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := newClient().Unbind(ctx, c.Args.InstanceID, c.Args.BindingID, &broker.UnbindRequest{
+		ServiceID:         serviceID,
+		PlanID:            planID,
+		AcceptsIncomplete: c.Async,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		if err := c.wait(ctx, c.Args.InstanceID, c.Args.BindingID, resp.Operation, true); err != nil {
+			return err
+		}
+	}
+	return output(resp, func(w *tabwriter.Writer) {
+		row(w, "BINDING ID", "STATUS", "OPERATION")
+		row(w, c.Args.BindingID, http.StatusText(resp.StatusCode), resp.Operation)
+	})
+}
+
+type lastOperationCommand struct {
+	BindingID string `short:"b" long:"binding" description:"Show the last operation of this binding of the instance"`
+	Operation string `long:"operation" description:"Operation ID returned by the asynchronous request"`
+	Args      struct {
+		InstanceID string `positional-arg-name:"instance-id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *lastOperationCommand) Execute(args []string) error {
+	resp, err := newClient().LastOperation(context.Background(), c.Args.InstanceID, c.BindingID, c.Operation)
+	if err != nil {
+		return err
+	}
+	return output(resp, func(w *tabwriter.Writer) {
+		row(w, "STATE", "DESCRIPTION")
+		row(w, resp.State, resp.Description)
+	})
+}
+
+type adminCommand struct {
+	Method string `short:"X" long:"method" default:"GET" description:"HTTP method"`
+	Args   struct {
+		Path string `positional-arg-name:"path" required:"yes" description:"e.g. instances, bindings, operations, tenancy, cache, backend or reconcile"`
+	} `positional-args:"yes"`
+}
+
+func (c *adminCommand) Execute(args []string) error {
+	path := c.Args.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	var query string
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+
+	var resp interface{}
+	if _, err := newAdminClient().Do(context.Background(), strings.ToUpper(c.Method), path, values, nil, &resp); err != nil {
+		return err
+	}
+	return output(resp, func(w *tabwriter.Writer) {
+		genericTable(w, resp)
+	})
+}
@@ -0,0 +1,164 @@
+// brokerctl is a command-line client of the broker, speaking the Open Service Broker API and querying the
+// admin API.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/brokerclient"
+	"github.com/jessevdk/go-flags"
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+type Options struct {
+	URL        string `long:"url" env:"BROKER_URL" default:"http://localhost:1338" description:"URL of the broker"`
+	AdminURL   string `long:"admin-url" env:"BROKER_ADMIN_URL" default:"http://localhost:1339" description:"URL of the admin API of the broker"`
+	Username   string `long:"username" env:"BROKER_USERNAME" description:"Username for basic authentication"`
+	Password   string `long:"password" env:"BROKER_PASSWORD" description:"Password for basic authentication"`
+	Token      string `long:"token" env:"BROKER_TOKEN" description:"Bearer token"`
+	APIVersion string `long:"api-version" default:"2.11" description:"Open Service Broker API version"`
+	Output     string `short:"o" long:"output" default:"table" choice:"table" choice:"json" description:"Output format"`
+}
+
+var options Options
+
+func main() {
+	parser := flags.NewParser(&options, flags.Default)
+	parser.AddCommand("catalog", "List the services and plans", "", &catalogCommand{})
+	parser.AddCommand("provision", "Provision a service instance", "Provisions a service instance, with a new ID unless one is given.", &provisionCommand{})
+	parser.AddCommand("update", "Update a service instance", "", &updateCommand{})
+	parser.AddCommand("deprovision", "Deprovision a service instance", "", &deprovisionCommand{})
+	parser.AddCommand("bind", "Bind to a service instance", "Creates a binding, with a new ID unless one is given, and shows its credentials.", &bindCommand{})
+	parser.AddCommand("unbind", "Delete a binding", "", &unbindCommand{})
+	parser.AddCommand("last-operation", "Show the last operation of a service instance or binding", "", &lastOperationCommand{})
+	parser.AddCommand("admin", "Query the admin API", "Sends a request to the admin API, e.g. \"brokerctl admin instances\" or \"brokerctl admin --method POST reconcile\".", &adminCommand{})
+
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+}
+
+func newClient() *brokerclient.Client {
+	return brokerclient.New(brokerclient.Config{
+		URL:        options.URL,
+		Username:   options.Username,
+		Password:   options.Password,
+		Token:      options.Token,
+		APIVersion: options.APIVersion,
+	})
+}
+
+func newAdminClient() *brokerclient.Client {
+	return brokerclient.New(brokerclient.Config{
+		URL:      options.AdminURL,
+		Username: options.Username,
+		Password: options.Password,
+		Token:    options.Token,
+	})
+}
+
+// output prints value as JSON, or as a table written by table.
+func output(value interface{}, table func(w *tabwriter.Writer)) error {
+	if options.Output == OutputJSON {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// row writes the tab separated cells of a table row.
+func row(w *tabwriter.Writer, cells ...interface{}) {
+	strs := make([]string, len(cells))
+	for i, cell := range cells {
+		strs[i] = fmt.Sprint(cell)
+	}
+	fmt.Fprintln(w, strings.Join(strs, "\t"))
+}
+
+// fields writes the entries of an object as rows of a two column table, sorted by key.
+func fields(w *tabwriter.Writer, object map[string]interface{}) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		row(w, key, cell(object[key]))
+	}
+}
+
+// cell formats a JSON value for a table, nested values as JSON.
+func cell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// genericTable tabulates any JSON value: arrays of objects with a column per key, objects with a row per key.
+func genericTable(w *tabwriter.Writer, value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		columns := []string{}
+		seen := map[string]bool{}
+		for _, item := range v {
+			if object, ok := item.(map[string]interface{}); ok {
+				for key := range object {
+					if !seen[key] {
+						seen[key] = true
+						columns = append(columns, key)
+					}
+				}
+			}
+		}
+		sort.Strings(columns)
+		if len(columns) == 0 {
+			for _, item := range v {
+				row(w, cell(item))
+			}
+			return
+		}
+		header := make([]interface{}, len(columns))
+		for i, column := range columns {
+			header[i] = strings.ToUpper(column)
+		}
+		row(w, header...)
+		for _, item := range v {
+			object, _ := item.(map[string]interface{})
+			cells := make([]interface{}, len(columns))
+			for i, column := range columns {
+				cells[i] = cell(object[column])
+			}
+			row(w, cells...)
+		}
+	case map[string]interface{}:
+		fields(w, v)
+	default:
+		row(w, cell(v))
+	}
+}
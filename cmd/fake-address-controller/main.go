@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/jessevdk/go-flags"
+)
+
+type Args struct {
+	Listen      string        `short:"l" long:"listen" default:":8080" description:"Address to listen on"`
+	Latency     time.Duration `long:"latency" description:"Delay of every response, e.g. 200ms"`
+	FailureRate float64       `long:"failure-rate" description:"Fraction of requests failing with 500, between 0 and 1"`
+	ReadyAfter  time.Duration `long:"ready-after" description:"How long addresses are not ready after being created, e.g. 30s"`
+	Instances   []string      `short:"i" long:"instance" description:"Name of an instance to create at startup (repeatable)"`
+}
+
+func main() {
+	args := Args{}
+	if _, err := flags.Parse(&args); err != nil {
+		os.Exit(127)
+	}
+
+	server := fakemaas.NewServer(fakemaas.Options{
+		Latency:     args.Latency,
+		FailureRate: args.FailureRate,
+		ReadyAfter:  args.ReadyAfter,
+	})
+	for _, name := range args.Instances {
+		server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: name}})
+	}
+
+	fmt.Printf("Fake address controller listening on %s\n", args.Listen)
+	if err := http.ListenAndServe(args.Listen, server); err != nil {
+		os.Stderr.WriteString("ERROR: " + err.Error() + "\n")
+		os.Exit(1)
+	}
+}
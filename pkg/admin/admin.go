@@ -0,0 +1,252 @@
+// Package admin serves the operator API of the broker. It is meant to listen on a separate port from the
+// Open Service Broker API, which platforms use, and tells what the broker thinks exists: the instances,
+// bindings and operations it tracks, how instances map to infrastructure instances, what the backend cache
+// holds and whether the backend is reachable. It also reconciles the broker's instances with the addresses
+// of the address controller, and serves the metrics published through expvar.
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/op/go-logging"
+)
+
+// probeTimeout bounds the request checking the connectivity of the backend.
+const probeTimeout = 5 * time.Second
+
+type Config struct {
+	// Listen is the address the admin API listens on, e.g. ":1339". The admin API is disabled if empty.
+	Listen string
+	// Username and Password authenticate requests with HTTP basic authentication.
+	Username string
+	Password string
+	// Token authenticates requests with an "Authorization: Bearer <token>" header.
+	Token string
+}
+
+// Sources is what the admin API inspects.
+type Sources struct {
+	Broker     *broker.MaasBroker
+	Reconciler *broker.Reconciler
+	// Backend is probed for connectivity. It should not be cached.
+	Backend     maas.Backend
+	BackendType string
+	// Cache is the cache in front of the backend, nil if caching is disabled.
+	Cache *maas.CachingBackend
+}
+
+type handler struct {
+	log     *logging.Logger
+	router  mux.Router
+	config  Config
+	sources Sources
+}
+
+// placeholderSecrets are the passwords and tokens of example configurations, which must not be used.
+var placeholderSecrets = []string{"changeme"}
+
+// Validate checks that the admin API, if enabled, requires a username and password or a token, neither of
+// which may be a placeholder.
+func (c Config) Validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	return c.validateCredentials()
+}
+
+func (c Config) validateCredentials() error {
+	if (c.Username == "" || c.Password == "") && c.Token == "" {
+		return fmt.Errorf("the admin API requires a username and password or a token")
+	}
+	for _, placeholder := range placeholderSecrets {
+		if c.Password == placeholder || c.Token == placeholder {
+			return fmt.Errorf("the admin API password or token must be changed from %q", placeholder)
+		}
+	}
+	return nil
+}
+
+// NewHandler fails unless the configuration authenticates requests with a username and password or a token.
+func NewHandler(log *logging.Logger, config Config, sources Sources) (http.Handler, error) {
+	if err := config.validateCredentials(); err != nil {
+		return nil, err
+	}
+	h := handler{log: log, config: config, sources: sources}
+
+	h.router.HandleFunc("/instances", h.instances).Methods(http.MethodGet)
+	h.router.HandleFunc("/bindings", h.bindings).Methods(http.MethodGet)
+	h.router.HandleFunc("/operations", h.operations).Methods(http.MethodGet)
+	h.router.HandleFunc("/tenancy", h.tenancy).Methods(http.MethodGet)
+	h.router.HandleFunc("/cache", h.cache).Methods(http.MethodGet)
+	h.router.HandleFunc("/cache", h.invalidateCache).Methods(http.MethodDelete)
+	h.router.HandleFunc("/backend", h.backend).Methods(http.MethodGet)
+	h.router.HandleFunc("/reconcile", h.lastReconciliation).Methods(http.MethodGet)
+	h.router.HandleFunc("/reconcile", h.reconcile).Methods(http.MethodPost)
+	h.router.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+
+	return h, nil
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := reqctx.NewRequestID(r.Header.Get(reqctx.RequestIDHeader))
+	w.Header().Set(reqctx.RequestIDHeader, requestID)
+	r = r.WithContext(reqctx.WithRequestID(r.Context(), requestID))
+
+	log := reqctx.Logger(r.Context(), h.log)
+	log.Infof("%s %s", r.Method, r.RequestURI)
+
+	if !h.authenticated(r) {
+		log.Warningf("Rejecting unauthenticated request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="maas-service-broker admin"`)
+		writeResponse(w, http.StatusUnauthorized, broker.NewErrorResponse("Unauthorized"))
+		return
+	}
+
+	h.router.ServeHTTP(w, r)
+}
+
+func (h handler) authenticated(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok {
+		return h.config.Username != "" && h.config.Password != "" &&
+			equal(username, h.config.Username) && equal(password, h.config.Password)
+	}
+	authorization := r.Header.Get("Authorization")
+	if token := strings.TrimPrefix(authorization, "Bearer "); token != authorization {
+		return h.config.Token != "" && equal(token, h.config.Token)
+	}
+	return false
+}
+
+func equal(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (h handler) instances(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, h.sources.Broker.Instances())
+}
+
+func (h handler) bindings(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, h.sources.Broker.Bindings())
+}
+
+func (h handler) operations(w http.ResponseWriter, r *http.Request) {
+	operations := []broker.Operation{}
+	for _, operation := range h.sources.Broker.Operations() {
+		if r.FormValue("state") == "" || r.FormValue("state") == string(operation.State) {
+			operations = append(operations, operation)
+		}
+	}
+	writeResponse(w, http.StatusOK, operations)
+}
+
+// tenancyResponse maps each infrastructure instance to the service instances provisioned into it.
+type tenancyResponse struct {
+	Policy         string              `json:"policy"`
+	Infrastructure map[string][]string `json:"infrastructure"`
+}
+
+func (h handler) tenancy(w http.ResponseWriter, r *http.Request) {
+	response := tenancyResponse{
+		Policy:         h.sources.Broker.Tenancy().Name(),
+		Infrastructure: make(map[string][]string),
+	}
+	for _, instance := range h.sources.Broker.Instances() {
+		response.Infrastructure[instance.InfraID] = append(response.Infrastructure[instance.InfraID], instance.InstanceID)
+	}
+	writeResponse(w, http.StatusOK, response)
+}
+
+func (h handler) cache(w http.ResponseWriter, r *http.Request) {
+	if h.sources.Cache == nil {
+		writeResponse(w, http.StatusNotFound, broker.NewErrorResponse("The backend is not cached"))
+		return
+	}
+	writeResponse(w, http.StatusOK, h.sources.Cache.State())
+}
+
+func (h handler) invalidateCache(w http.ResponseWriter, r *http.Request) {
+	if h.sources.Cache == nil {
+		writeResponse(w, http.StatusNotFound, broker.NewErrorResponse("The backend is not cached"))
+		return
+	}
+	h.sources.Cache.Invalidate()
+	reqctx.Logger(r.Context(), h.log).Notice("Invalidated the backend cache")
+	writeResponse(w, http.StatusOK, h.sources.Cache.State())
+}
+
+type backendResponse struct {
+	Type      string `json:"type"`
+	Reachable bool   `json:"reachable"`
+	Latency   string `json:"latency"`
+	Instances int    `json:"instances"`
+	Error     string `json:"error,omitempty"`
+}
+
+// backend checks that the backend answers by listing the infrastructure instances.
+func (h handler) backend(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	instances, err := h.sources.Backend.GetInstances(ctx)
+	response := backendResponse{
+		Type:      h.sources.BackendType,
+		Reachable: err == nil,
+		Latency:   time.Since(start).String(),
+		Instances: len(instances),
+	}
+	status := http.StatusOK
+	if err != nil {
+		response.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	writeResponse(w, status, response)
+}
+
+// lastReconciliation returns the report of the last reconciliation.
+func (h handler) lastReconciliation(w http.ResponseWriter, r *http.Request) {
+	report := h.sources.Reconciler.Last()
+	if report == nil {
+		writeResponse(w, http.StatusNotFound, broker.NewErrorResponse("No reconciliation has run yet"))
+		return
+	}
+	writeResponse(w, http.StatusOK, report)
+}
+
+// reconcile runs a reconciliation, which repairs the drift it finds if the repair parameter is true.
+func (h handler) reconcile(w http.ResponseWriter, r *http.Request) {
+	log := reqctx.Logger(r.Context(), h.log)
+	report, err := h.sources.Reconciler.Reconcile(r.Context(), r.FormValue("repair") == "true")
+	if err != nil {
+		log.Warningf("Reconciliation failed: %s", err)
+		writeResponse(w, http.StatusInternalServerError, broker.NewErrorResponse("Reconciliation failed: "+err.Error()))
+		return
+	}
+	writeResponse(w, http.StatusOK, report)
+}
+
+func writeResponse(w http.ResponseWriter, code int, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	i := bytes.Buffer{}
+	json.Indent(&i, b, "", "  ")
+	i.WriteString("\n")
+	_, err = w.Write(i.Bytes())
+	return err
+}
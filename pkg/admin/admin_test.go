@@ -0,0 +1,262 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+const (
+	infraID = "org1"
+	token   = "s3cr3t"
+)
+
+func newAdmin(t *testing.T, config broker.ReconcilerConfig) (http.Handler, *broker.MaasBroker, *fakemaas.Server) {
+	server := fakemaas.NewServer(fakemaas.Options{})
+	server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: infraID}})
+	log := logging.MustGetLogger("test")
+	b, err := broker.NewMaasBroker(broker.MaasBrokerConfig{}, log, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(log, Config{Username: "admin", Password: "password", Token: token}, Sources{
+		Broker:      b,
+		Reconciler:  broker.NewReconciler(b, config, log),
+		Backend:     server,
+		BackendType: "fake",
+		Cache:       maas.NewCachingBackend(server, time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, b, server
+}
+
+// serve sends an authenticated request.
+func serve(h http.Handler, method string, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, status int, obj interface{}) {
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func provision(t *testing.T, b *broker.MaasBroker, name string) uuid.UUID {
+	instanceUUID := uuid.NewRandom()
+	_, err := b.Provision(context.Background(), instanceUUID, &broker.ProvisionRequest{
+		OrganizationID: infraID,
+		ServiceID:      uuid.Parse(broker.QueueServiceUUID),
+		PlanID:         uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid),
+		Parameters:     map[string]string{"name": name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instanceUUID
+}
+
+func reconcile(t *testing.T, h http.Handler, method string, path string) *broker.ReconcileReport {
+	var report broker.ReconcileReport
+	decode(t, serve(h, method, path), http.StatusOK, &report)
+	return &report
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	h, b, server := newAdmin(t, broker.ReconcilerConfig{})
+
+	if rec := serve(h, http.MethodGet, "/reconcile"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 before the first reconciliation, got %d", rec.Code)
+	}
+
+	provision(t, b, "healthy")
+	missing := provision(t, b, "missing")
+	if err := server.DeprovisionAddress(ctx, infraID, missing); err != nil {
+		t.Fatal(err)
+	}
+	orphan := uuid.NewRandom()
+	if err := maas.ProvisionAnycast(ctx, server, infraID, orphan, "orphan", maas.AddressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := reconcile(t, h, http.MethodPost, "/reconcile")
+	if len(report.Missing) != 1 || report.Missing[0].InstanceID != missing.String() || report.Missing[0].Repair != "" {
+		t.Errorf("expected unrepaired missing address, got %v", report.Missing)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].InstanceID != orphan.String() || report.Orphans[0].Address != "orphan" {
+		t.Errorf("expected unrepaired orphan, got %v", report.Orphans)
+	}
+	if last := reconcile(t, h, http.MethodGet, "/reconcile"); !last.Started.Equal(report.Started) {
+		t.Errorf("expected the last report, got %v", last)
+	}
+
+	report = reconcile(t, h, http.MethodPost, "/reconcile?repair=true")
+	if len(report.Missing) != 1 || report.Missing[0].Repair != broker.RepairRecreated {
+		t.Errorf("expected the missing address to be re-created, got %v", report.Missing)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Repair != broker.RepairAdopted {
+		t.Errorf("expected the orphan to be adopted, got %v", report.Orphans)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("unexpected errors %v", report.Errors)
+	}
+
+	report = reconcile(t, h, http.MethodPost, "/reconcile")
+	if len(report.Missing) != 0 || len(report.Orphans) != 0 {
+		t.Errorf("expected no drift after repairing, got %v", report)
+	}
+	if len(server.Addresses(infraID)) != 3 {
+		t.Errorf("expected three addresses, got %v", server.Addresses(infraID))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h, _, _ := newAdmin(t, broker.ReconcilerConfig{})
+	reconcile(t, h, http.MethodPost, "/reconcile")
+
+	var vars map[string]interface{}
+	decode(t, serve(h, http.MethodGet, "/debug/vars"), http.StatusOK, &vars)
+	reconciler, _ := vars["reconciler"].(map[string]interface{})
+	if runs, _ := reconciler["runs"].(float64); runs < 1 {
+		t.Errorf("expected reconciler metrics, got %v", vars["reconciler"])
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	h, _, _ := newAdmin(t, broker.ReconcilerConfig{})
+
+	for _, test := range []struct {
+		name     string
+		username string
+		password string
+		bearer   string
+		status   int
+	}{
+		{name: "anonymous", status: http.StatusUnauthorized},
+		{name: "basic", username: "admin", password: "password", status: http.StatusOK},
+		{name: "wrong password", username: "admin", password: "wrong", status: http.StatusUnauthorized},
+		{name: "token", bearer: token, status: http.StatusOK},
+		{name: "wrong token", bearer: "wrong", status: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/instances", nil)
+		if test.username != "" {
+			r.SetBasicAuth(test.username, test.password)
+		}
+		if test.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+		}
+	}
+
+	if _, err := NewHandler(logging.MustGetLogger("test"), Config{Username: "admin"}, Sources{}); err == nil {
+		t.Error("expected the admin API to require credentials")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{name: "disabled", config: Config{}, valid: true},
+		{name: "disabled with placeholder", config: Config{Username: "admin", Password: "changeme"}, valid: true},
+		{name: "password", config: Config{Listen: ":1339", Username: "admin", Password: "s3cr3t"}, valid: true},
+		{name: "token", config: Config{Listen: ":1339", Token: "s3cr3t"}, valid: true},
+		{name: "no credentials", config: Config{Listen: ":1339"}},
+		{name: "empty password", config: Config{Listen: ":1339", Username: "admin"}},
+		{name: "placeholder password", config: Config{Listen: ":1339", Username: "admin", Password: "changeme"}},
+		{name: "placeholder password with token", config: Config{Listen: ":1339", Username: "admin", Password: "changeme", Token: "s3cr3t"}},
+		{name: "placeholder token", config: Config{Listen: ":1339", Token: "changeme"}},
+	}
+
+	for _, test := range tests {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	ctx := context.Background()
+	h, b, server := newAdmin(t, broker.ReconcilerConfig{})
+	instanceUUID := provision(t, b, "my-queue")
+	bindingUUID := uuid.NewRandom()
+	_, err := b.Bind(ctx, instanceUUID, bindingUUID, &broker.BindRequest{
+		ServiceID:         uuid.Parse(broker.QueueServiceUUID),
+		AcceptsIncomplete: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var instances []broker.InstanceRecord
+	decode(t, serve(h, http.MethodGet, "/instances"), http.StatusOK, &instances)
+	if len(instances) != 1 || instances[0].InstanceID != instanceUUID.String() || instances[0].InfraID != infraID {
+		t.Errorf("unexpected instances %v", instances)
+	}
+
+	var tenancy tenancyResponse
+	decode(t, serve(h, http.MethodGet, "/tenancy"), http.StatusOK, &tenancy)
+	if tenancy.Policy != broker.TenancyOrganization || len(tenancy.Infrastructure[infraID]) != 1 {
+		t.Errorf("unexpected tenancy %v", tenancy)
+	}
+
+	var operations []broker.Operation
+	decode(t, serve(h, http.MethodGet, "/operations"), http.StatusOK, &operations)
+	if len(operations) != 1 || operations[0].Type != broker.OperationBind || operations[0].BindingID != bindingUUID.String() {
+		t.Errorf("unexpected operations %v", operations)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var bindings []map[string]interface{}
+	for len(bindings) == 0 && time.Now().Before(deadline) {
+		decode(t, serve(h, http.MethodGet, "/bindings"), http.StatusOK, &bindings)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(bindings) != 1 || bindings[0]["binding_id"] != bindingUUID.String() {
+		t.Fatalf("unexpected bindings %v", bindings)
+	}
+	if _, found := bindings[0]["credentials"]; found {
+		t.Error("expected the credentials of bindings to be hidden")
+	}
+
+	var cache maas.CacheState
+	decode(t, serve(h, http.MethodGet, "/cache"), http.StatusOK, &cache)
+	if cache.TTL != "1m0s" || cache.Flavors.Expires != nil {
+		t.Errorf("unexpected cache state %v", cache)
+	}
+
+	var backend backendResponse
+	decode(t, serve(h, http.MethodGet, "/backend"), http.StatusOK, &backend)
+	if !backend.Reachable || backend.Instances != 1 || backend.Type != "fake" {
+		t.Errorf("unexpected backend state %v", backend)
+	}
+	server.Fail(fakemaas.Failure{Method: http.MethodGet, PathPrefix: "/v3/instance", Status: http.StatusServiceUnavailable, Count: 1})
+	decode(t, serve(h, http.MethodGet, "/backend"), http.StatusServiceUnavailable, &backend)
+	if backend.Reachable || backend.Error == "" {
+		t.Errorf("expected the backend to be unreachable, got %v", backend)
+	}
+}
@@ -1,21 +1,30 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/EnMasseProject/maas-service-broker/pkg/admin"
 	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
 	"github.com/EnMasseProject/maas-service-broker/pkg/handler"
 	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/redact"
 )
 
 type App struct {
-	broker   *broker.MaasBroker
+	broker   broker.Broker
 	args     Args
 	config   Config
 	log      *Log
-	client   *maas.MaasClient
+	backend  maas.Backend
+	reconciler *broker.Reconciler
+	maasBroker *broker.MaasBroker
+	// cache is the cache in front of the backend, nil if caching is disabled
+	cache *maas.CachingBackend
 }
 
 func CreateApp() App {
@@ -41,44 +50,132 @@ func CreateApp() App {
 		os.Exit(1)
 	}
 
-	addressControllerHost := os.Getenv("ADDRESS_CONTROLLER_SERVICE_HOST")
-	addressControllerPort := os.Getenv("ADDRESS_CONTROLLER_SERVICE_PORT")
-	if addressControllerHost == "" || addressControllerPort == "" {
-		fmt.Println("The following environment variables must point to the address controller: ADDRESS_CONTROLLER_SERVICE_HOST and ADDRESS_CONTROLLER_SERVICE_PORT")
-		os.Exit(1)
-	}
-	app.config.Maas.Url = "http://" + addressControllerHost + ":" + addressControllerPort
-
 	if app.log, err = NewLog(app.config.Log); err != nil {
 		os.Stderr.WriteString("ERROR: Failed to initialize logger\n")
 		os.Stderr.WriteString(err.Error())
 		os.Exit(1)
 	}
 
-	app.log.Debug("Connecting MaasClient")
-	if app.client, err = maas.NewMaasClient(app.config.Maas, app.log.Logger); err != nil {
-		app.log.Error("Failed to initialize MaasClient\n")
+	if app.backend, err = app.newBackend(); err != nil {
+		app.log.Error("Failed to initialize backend\n")
 		app.log.Error(err.Error())
 		os.Exit(1)
 	}
 
 	app.log.Debug("Creating MaaSBroker")
-	if app.broker, err = broker.NewMaasBroker(app.log.Logger, app.client); err != nil {
+	maasBroker, err := broker.NewMaasBroker(app.config.Broker, app.log.Module(ModuleBroker), app.backend)
+	if err != nil {
 		app.log.Error("Failed to create MaaSBroker\n")
 		app.log.Error(err.Error())
 		os.Exit(1)
 	}
+	app.broker = maasBroker
+	app.maasBroker = maasBroker
+	app.reconciler = broker.NewReconciler(maasBroker, app.config.Reconciler, app.log.Module(ModuleBroker))
+
+	auditLog, err := app.log.NewAuditLog(app.config.Log)
+	if err != nil {
+		app.log.Error("Failed to initialize audit log\n")
+		app.log.Error(err.Error())
+		os.Exit(1)
+	}
+	if auditLog != nil {
+		app.broker = broker.NewAuditingBroker(app.broker, auditLog, app.log.Module(ModuleBroker))
+	}
 
 	return app
 }
 
 func (a *App) Start() {
+	go a.handleSignals()
+	go a.reconciler.Run(context.Background())
+	go a.resumeRevocations()
+	if a.config.Admin.Listen != "" {
+		go a.startAdmin()
+	}
+
 	a.log.Notice("MaaS Service Broker Started")
 	a.log.Notice("Listening on http://localhost:1338")
-	err := http.ListenAndServe(":1338", handler.NewHandler(a.log.Logger, a.broker))
+	err := http.ListenAndServe(":1338", handler.NewHandler(a.log.Module(ModuleHandler), a.broker, a.tracer()))
 	if err != nil {
 		a.log.Error("Failed to start HTTP server")
 		a.log.Error(err.Error())
 		os.Exit(1)
 	}
 }
+
+func (a *App) startAdmin() {
+	// the admin API checks the connectivity of the backend itself, not of its cache
+	probe := a.backend
+	if a.cache != nil {
+		probe = a.cache.Backend
+	}
+	backendType := a.config.Backend.Type
+	if backendType == "" {
+		backendType = BackendMaas
+	}
+	h, err := admin.NewHandler(a.log.Module(ModuleAdmin), a.config.Admin, admin.Sources{
+		Broker:      a.maasBroker,
+		Reconciler:  a.reconciler,
+		Backend:     probe,
+		BackendType: backendType,
+		Cache:       a.cache,
+	})
+	if err != nil {
+		a.log.Error("Failed to create admin API")
+		a.log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	a.log.Noticef("Admin API listening on %s", a.config.Admin.Listen)
+	err = http.ListenAndServe(a.config.Admin.Listen, h)
+	if err != nil {
+		a.log.Error("Failed to start admin HTTP server")
+		a.log.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// resumeRevocations completes the revocations of users retired by credential rotations before the broker
+// started. The reconciler revokes the expired ones if this fails.
+func (a *App) resumeRevocations() {
+	if err := a.maasBroker.ResumeRevocations(context.Background()); err != nil {
+		a.log.Errorf("Failed to resume pending revocations: %s", err)
+	}
+}
+
+func (a *App) tracer() *redact.Tracer {
+	return redact.NewTracer(a.config.Log.Trace, a.config.Log.Redact)
+}
+
+// handleSignals re-reads the log levels from the config file whenever the broker receives SIGHUP, and
+// reopens the log files on SIGUSR1.
+func (a *App) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			a.reloadLogLevels()
+		case syscall.SIGUSR1:
+			if err := a.log.Reopen(); err != nil {
+				a.log.Errorf("Failed to reopen log files: %s", err)
+				continue
+			}
+			a.log.Notice("Reopened log files")
+		}
+	}
+}
+
+func (a *App) reloadLogLevels() {
+	config, err := CreateConfig(a.args.ConfigFile)
+	if err != nil {
+		a.log.Errorf("Failed to reload config file: %s", err)
+		return
+	}
+	if err = a.log.SetLevels(config.Log); err != nil {
+		a.log.Errorf("Failed to change log levels: %s", err)
+		return
+	}
+	a.log.Noticef("Reloaded log levels from %s", a.args.ConfigFile)
+}
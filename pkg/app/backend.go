@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/kube"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+)
+
+const (
+	BackendMaas       = "maas"
+	BackendFake       = "fake"
+	BackendKubernetes = "kubernetes"
+)
+
+type BackendConfig struct {
+	// Type selects the backend: the EnMasse address controller ("maas", the default), the address
+	// definitions stored as Kubernetes resources ("kubernetes"), or an in-memory fake ("fake") for
+	// development without EnMasse.
+	Type string
+	// CacheTTL caches flavors and infrastructure instances for the given time, if set.
+	CacheTTL time.Duration
+	// Metrics collects call counts, errors and latencies of the backend as expvar variables, which the admin
+	// API serves on /debug/vars.
+	Metrics bool
+	// FakeInstances are the infrastructure instances the fake backend starts with.
+	FakeInstances []string
+	// Kubernetes configures the kubernetes backend.
+	Kubernetes kube.Config
+}
+
+func (a *App) newBackend() (maas.Backend, error) {
+	var backend maas.Backend
+	var err error
+
+	config := a.config.Backend
+	switch config.Type {
+	case "", BackendMaas:
+		addressControllerHost := os.Getenv("ADDRESS_CONTROLLER_SERVICE_HOST")
+		addressControllerPort := os.Getenv("ADDRESS_CONTROLLER_SERVICE_PORT")
+		if addressControllerHost == "" || addressControllerPort == "" {
+			return nil, fmt.Errorf("The following environment variables must point to the address controller: ADDRESS_CONTROLLER_SERVICE_HOST and ADDRESS_CONTROLLER_SERVICE_PORT")
+		}
+		a.config.Maas.Url = "http://" + addressControllerHost + ":" + addressControllerPort
+
+		a.log.Debug("Connecting MaasClient")
+		if backend, err = maas.NewMaasClient(a.config.Maas, a.log.Module(ModuleMaas), a.tracer()); err != nil {
+			return nil, err
+		}
+	case BackendFake:
+		a.log.Warning("Using the in-memory fake backend; nothing is provisioned")
+		server := fakemaas.NewServer(fakemaas.Options{})
+		for _, name := range config.FakeInstances {
+			server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: name}})
+		}
+		backend = server
+	case BackendKubernetes:
+		a.log.Debug("Connecting to Kubernetes")
+		client, err := kube.NewClient(config.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		kubeBackend, err := kube.NewBackend(client, config.Kubernetes, a.log.Module(ModuleMaas))
+		if err != nil {
+			return nil, err
+		}
+		go a.watchAddresses(kubeBackend)
+		backend = kubeBackend
+	default:
+		return nil, fmt.Errorf("unknown backend type %s", config.Type)
+	}
+
+	if config.CacheTTL > 0 {
+		a.cache = maas.NewCachingBackend(backend, config.CacheTTL)
+		backend = a.cache
+	}
+	if config.Metrics {
+		if a.config.Admin.Listen == "" {
+			a.log.Warning("Backend metrics are collected but not served, as the admin API is disabled")
+		}
+		backend = maas.NewMetricsBackend(backend)
+	}
+	return backend, nil
+}
+
+// watchAddresses logs the changes made to address definitions outside the broker, such as by the address
+// controller or kubectl.
+func (a *App) watchAddresses(backend *kube.Backend) {
+	log := a.log.Module(ModuleMaas)
+	err := backend.WatchAddresses(context.Background(), func(event kube.AddressEvent) {
+		log.Infof("Address %s (%s) in instance %s: %s", event.Address.Metadata.Name, event.Address.Metadata.Uuid, event.InfraID, event.Type)
+	})
+	log.Errorf("Stopped watching address definitions: %s", err)
+}
@@ -4,11 +4,17 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"github.com/EnMasseProject/maas-service-broker/pkg/admin"
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
 	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
 )
 
 type Config struct {
 	Maas   maas.MaasClientConfig
+	Broker broker.MaasBrokerConfig
+	Backend BackendConfig
+	Reconciler broker.ReconcilerConfig
+	Admin admin.Config
 	Log        LogConfig
 	ConfigFile string
 }
@@ -35,14 +41,14 @@ func CreateConfig(configFile string) (Config, error) {
 		return Config{}, err
 	}
 
-	if err = validateConfig(); err != nil {
+	if err = validateConfig(config); err != nil {
 		return Config{}, err
 	}
 
 	return config, nil
 }
 
-func validateConfig() error {
+func validateConfig(config Config) error {
 	// TODO: Config validation!
-	return nil
+	return config.Admin.Validate()
 }
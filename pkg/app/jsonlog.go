@@ -0,0 +1,44 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/op/go-logging"
+)
+
+type jsonRecord struct {
+	Time       string `json:"time"`
+	Level      string `json:"level"`
+	Module     string `json:"module"`
+	RequestID  string `json:"request_id,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Operation  string `json:"operation,omitempty"`
+	Message    string `json:"message"`
+}
+
+// jsonFormatter formats each record as a single line JSON object. The request-scoped fields that
+// reqctx.Log passes as the first argument of a record are emitted as fields of their own rather than
+// as the message prefix.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	record := jsonRecord{
+		Time:    r.Time.Format(time.RFC3339Nano),
+		Level:   r.Level.String(),
+		Module:  r.Module,
+		Message: r.Message(),
+	}
+	if len(r.Args) > 0 {
+		if fields, ok := r.Args[0].(reqctx.Fields); ok {
+			record.RequestID = fields.RequestID
+			record.InstanceID = fields.InstanceID
+			record.Operation = fields.Operation
+			record.Message = strings.TrimPrefix(record.Message, fields.String())
+		}
+	}
+	return json.NewEncoder(w).Encode(record)
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/op/go-logging"
+)
+
+func TestJSONFormatter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	backend := logging.AddModuleLevel(logging.NewBackendFormatter(logging.NewLogBackend(buf, "", 0), jsonFormatter{}))
+	logger := logging.MustGetLogger("jsontest")
+	logger.SetBackend(backend)
+
+	ctx := reqctx.WithOperation(reqctx.WithInstanceID(reqctx.WithRequestID(context.Background(), "req-1"), "instance-1"), "provision")
+	tests := []struct {
+		name     string
+		log      func()
+		expected jsonRecord
+	}{
+		{
+			name:     "plain record",
+			log:      func() { logger.Warningf("Address %s is not ready", "my-queue") },
+			expected: jsonRecord{Level: "WARNING", Module: "jsontest", Message: "Address my-queue is not ready"},
+		},
+		{
+			name: "request-scoped record",
+			log:  func() { reqctx.Logger(ctx, logger).Info("Provisioning %s", "my-queue") },
+			expected: jsonRecord{Level: "INFO", Module: "jsontest", RequestID: "req-1", InstanceID: "instance-1", Operation: "provision",
+				Message: "Provisioning my-queue"},
+		},
+		{
+			name:     "message with quotes and newlines",
+			log:      func() { logger.Error("invalid \"name\"\nsecond line") },
+			expected: jsonRecord{Level: "ERROR", Module: "jsontest", Message: "invalid \"name\"\nsecond line"},
+		},
+	}
+
+	for _, test := range tests {
+		buf.Reset()
+		test.log()
+		line := buf.Bytes()
+		if bytes.Count(line, []byte("\n")) != 1 {
+			t.Errorf("%s: expected a single line, got %q", test.name, line)
+			continue
+		}
+		var record jsonRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Errorf("%s: invalid JSON %q: %v", test.name, line, err)
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record.Time); err != nil {
+			t.Errorf("%s: invalid time %q: %v", test.name, record.Time, err)
+		}
+		record.Time = ""
+		if record != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, record)
+		}
+	}
+}
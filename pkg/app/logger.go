@@ -2,9 +2,14 @@ package app
 
 import (
 	"errors"
+	"fmt"
+	"github.com/EnMasseProject/maas-service-broker/pkg/audit"
+	"github.com/EnMasseProject/maas-service-broker/pkg/logfile"
 	"github.com/op/go-logging"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 type LogConfig struct {
@@ -12,14 +17,40 @@ type LogConfig struct {
 	Stdout  bool
 	Level   string
 	Color   bool
+	// Format is either "text", the default, or "json" for one JSON object per line.
+	Format string
+	// Levels overrides Level for individual modules (app, handler, broker and maas).
+	Levels map[string]string
+	// Trace logs the bodies of the requests and responses handled and sent by the broker at debug level,
+	// with the fields matching the Redact patterns (redact.DefaultFields if unset) masked.
+	Trace  bool
+	Redact []string
+	// AuditFile and AuditStdout select where the audit trail of mutating operations is written.
+	AuditFile   string
+	AuditStdout bool
+	// MaxSize (in megabytes) and MaxAge rotate LogFile and AuditFile. MaxBackups rotated files are kept,
+	// all of them if 0, and compressed with gzip if Compress is set.
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	Compress   bool
 }
 
 type Log struct {
 	*logging.Logger
-	file *os.File
+	backend logging.LeveledBackend
+	files   []*logfile.File
 }
 
-const MODULE = "asb"
+const (
+	ModuleApp     = "app"
+	ModuleHandler = "handler"
+	ModuleBroker  = "broker"
+	ModuleMaas    = "maas"
+	ModuleAdmin   = "admin"
+)
+
+var modules = []string{ModuleApp, ModuleHandler, ModuleBroker, ModuleMaas, ModuleAdmin}
 
 // TODO: Consider no output?
 func NewLog(config LogConfig) (*Log, error) {
@@ -28,48 +59,43 @@ func NewLog(config LogConfig) (*Log, error) {
 	if config.LogFile == "" && !config.Stdout {
 		return nil, errors.New("Cannot have a blank logfile and not log to stdout")
 	}
+	if config.Format != "" && config.Format != "text" && config.Format != "json" {
+		return nil, fmt.Errorf("Unknown log format %q", config.Format)
+	}
 
 	// TODO: More validation? Check file is good?
 	// TODO: Validate level is actually possible?
 
 	log := &Log{}
 
-	logger := logging.MustGetLogger(MODULE)
 	var backends []logging.Backend
 
 	colorFormatter := logging.MustStringFormatter(
-		"%{color}[%{time}] [%{level}] %{message}%{color:reset}",
+		"%{color}[%{time}] [%{level}] [%{module}] %{message}%{color:reset}",
 	)
 
 	standardFormatter := logging.MustStringFormatter(
-		"[%{time}] [%{level}] %{message}",
+		"[%{time}] [%{level}] [%{module}] %{message}",
 	)
 
 	var formattedBackend = func(writer io.Writer, isColored bool) logging.Backend {
 		backend := logging.NewLogBackend(writer, "", 0)
 		formatter := standardFormatter
-		if isColored {
+		if config.Format == "json" {
+			formatter = jsonFormatter{}
+		} else if isColored {
 			formatter = colorFormatter
 		}
 		return logging.NewBackendFormatter(backend, formatter)
 	}
 
 	if config.LogFile != "" {
-		var logFile *os.File
-
-		if _, err = os.Stat(config.LogFile); os.IsNotExist(err) {
-			if logFile, err = os.Create(config.LogFile); err != nil {
-				logFile.Close()
-				return nil, err
-			}
-		} else {
-			if logFile, err = os.OpenFile(config.LogFile, os.O_APPEND|os.O_WRONLY, 0666); err != nil {
-				logFile.Close()
-				return nil, err
-			}
+		var logFile *logfile.File
+
+		if logFile, err = log.openLogFile(config, config.LogFile); err != nil {
+			return nil, err
 		}
 
-		log.file = logFile
 		backends = append(backends, formattedBackend(logFile, false))
 	}
 
@@ -77,14 +103,123 @@ func NewLog(config LogConfig) (*Log, error) {
 		backends = append(backends, formattedBackend(os.Stdout, config.Color))
 	}
 
-	multiBackend := logging.MultiLogger(backends...)
-	logger.SetBackend(multiBackend)
-	logging.SetLevel(levelFromString(config.Level), MODULE)
-	log.Logger = logger
+	log.backend = logging.SetBackend(&syncLeveled{backend: logging.MultiLogger(backends...)})
+	if err = log.SetLevels(config); err != nil {
+		return nil, err
+	}
+	log.Logger = log.Module(ModuleApp)
 
 	return log, nil
 }
 
+// syncLeveled guards the module levels of a leveled backend with a lock. go-logging keeps them in a plain
+// map, which SetLevels would otherwise modify while requests are being logged.
+type syncLeveled struct {
+	mutex   sync.RWMutex
+	backend logging.LeveledBackend
+}
+
+func (b *syncLeveled) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.backend.Log(level, calldepth+1, record)
+}
+
+func (b *syncLeveled) GetLevel(module string) logging.Level {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.backend.GetLevel(module)
+}
+
+func (b *syncLeveled) SetLevel(level logging.Level, module string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.backend.SetLevel(level, module)
+}
+
+func (b *syncLeveled) IsEnabledFor(level logging.Level, module string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.backend.IsEnabledFor(level, module)
+}
+
+// Module returns the logger of one of the broker's modules.
+func (l *Log) Module(module string) *logging.Logger {
+	return logging.MustGetLogger(module)
+}
+
+// SetLevels applies the levels in config to all modules. It may be called again at runtime to change them.
+func (l *Log) SetLevels(config LogConfig) error {
+	for module := range config.Levels {
+		if !isModule(module) {
+			return fmt.Errorf("Unknown log module %q", module)
+		}
+	}
+	for _, module := range modules {
+		level := config.Level
+		if moduleLevel, ok := config.Levels[module]; ok {
+			level = moduleLevel
+		}
+		l.backend.SetLevel(levelFromString(level), module)
+	}
+	return nil
+}
+
+func isModule(module string) bool {
+	for _, m := range modules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAuditLog creates the audit log configured in config, or returns nil if auditing is disabled.
+func (l *Log) NewAuditLog(config LogConfig) (*audit.Log, error) {
+	var writers []io.Writer
+
+	if config.AuditFile != "" {
+		auditFile, err := l.openLogFile(config, config.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, auditFile)
+	}
+
+	if config.AuditStdout {
+		writers = append(writers, os.Stdout)
+	}
+
+	if len(writers) == 0 {
+		return nil, nil
+	}
+	return audit.NewLog(io.MultiWriter(writers...)), nil
+}
+
+func (l *Log) openLogFile(config LogConfig, path string) (*logfile.File, error) {
+	file, err := logfile.Open(path, logfile.Options{
+		MaxSize:    config.MaxSize * 1024 * 1024,
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.files = append(l.files, file)
+	return file, nil
+}
+
+// Reopen reopens the log and audit files, after they were moved away by an external log rotation.
+func (l *Log) Reopen() error {
+	for _, file := range l.files {
+		if err := file.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func levelFromString(str string) logging.Level {
 	var level logging.Level
 
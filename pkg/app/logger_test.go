@@ -0,0 +1,59 @@
+package app
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestSetLevelsWhileLogging(t *testing.T) {
+	log, err := NewLog(LogConfig{LogFile: filepath.Join(t.TempDir(), "broker.log"), Level: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var started, wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, module := range modules {
+		started.Add(1)
+		wg.Add(1)
+		go func(logger *logging.Logger) {
+			defer wg.Done()
+			logger.Info("logging while the levels change")
+			started.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					logger.Info("logging while the levels change")
+				}
+			}
+		}(log.Module(module))
+	}
+
+	started.Wait()
+	for i := 0; i < 100; i++ {
+		level := "debug"
+		if i%2 == 0 {
+			level = "warning"
+		}
+		if err := log.SetLevels(LogConfig{Level: "info", Levels: map[string]string{ModuleBroker: level}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if level := log.backend.GetLevel(ModuleBroker); level != logging.DEBUG {
+		t.Errorf("expected level DEBUG for module %s, got %s", ModuleBroker, level)
+	}
+	if level := log.backend.GetLevel(ModuleHandler); level != logging.INFO {
+		t.Errorf("expected level INFO for module %s, got %s", ModuleHandler, level)
+	}
+	if err := log.SetLevels(LogConfig{Levels: map[string]string{"router": "debug"}}); err == nil {
+		t.Error("expected an error for an unknown module")
+	}
+}
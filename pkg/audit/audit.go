@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	OutcomeSuccess  = "success"
+	OutcomeAccepted = "accepted"
+	OutcomeFailure  = "failure"
+)
+
+// Entry records a mutating operation performed through the broker.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	Platform   string    `json:"platform,omitempty"`
+	Operation  string    `json:"operation"`
+	InstanceID string    `json:"instance_id"`
+	BindingID  string    `json:"binding_id,omitempty"`
+	ServiceID  string    `json:"service_id,omitempty"`
+	PlanID     string    `json:"plan_id,omitempty"`
+	// OperationID links the accepted and the finished entries of an asynchronous operation.
+	OperationID string `json:"operation_id,omitempty"`
+	Outcome     string `json:"outcome"`
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Log writes audit entries as JSON lines.
+type Log struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewLog(writer io.Writer) *Log {
+	return &Log{writer: writer}
+}
+
+func (l *Log) Record(entry Entry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.writer.Write(b)
+	return err
+}
@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/audit"
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+// auditingBroker records every mutating call to the wrapped broker in the audit log. Asynchronous operations
+// are recorded when they are accepted and, if the wrapped broker reports them, again when they finish.
+type auditingBroker struct {
+	Broker
+	audit *audit.Log
+	log   *logging.Logger
+
+	mutex sync.Mutex
+	// accepted are the entries of the operations accepted but not finished yet, by operation ID
+	accepted map[string]audit.Entry
+	// finished are the operations that finished before their acceptance was recorded, by operation ID
+	finished map[string]Operation
+}
+
+// operationObserver is implemented by brokers reporting the asynchronous operations that finish.
+type operationObserver interface {
+	OnOperationFinished(f func(Operation))
+}
+
+func NewAuditingBroker(b Broker, auditLog *audit.Log, log *logging.Logger) Broker {
+	auditing := &auditingBroker{
+		Broker:   b,
+		audit:    auditLog,
+		log:      log,
+		accepted: make(map[string]audit.Entry),
+		finished: make(map[string]Operation),
+	}
+	if observer, ok := b.(operationObserver); ok {
+		observer.OnOperationFinished(auditing.operationFinished)
+	}
+	return auditing
+}
+
+func (b *auditingBroker) Provision(ctx context.Context, instanceUUID uuid.UUID, req *ProvisionRequest) (*ProvisionResponse, error) {
+	resp, err := b.Broker.Provision(ctx, instanceUUID, req)
+	status, operation := 0, ""
+	if resp != nil {
+		status, operation = resp.StatusCode, resp.Operation
+	}
+	b.record(ctx, OperationProvision, instanceUUID, nil, req.ServiceID.String(), req.PlanID.String(), status, operation, err)
+	return resp, err
+}
+
+func (b *auditingBroker) Update(ctx context.Context, instanceUUID uuid.UUID, req *UpdateRequest) (*UpdateResponse, error) {
+	resp, err := b.Broker.Update(ctx, instanceUUID, req)
+	b.record(ctx, OperationUpdate, instanceUUID, nil, req.ServiceID.String(), req.PlanID.String(), 0, "", err)
+	return resp, err
+}
+
+func (b *auditingBroker) Deprovision(ctx context.Context, instanceUUID uuid.UUID, serviceId string, planId string) (*DeprovisionResponse, error) {
+	resp, err := b.Broker.Deprovision(ctx, instanceUUID, serviceId, planId)
+	b.record(ctx, OperationDeprovision, instanceUUID, nil, serviceId, planId, 0, "", err)
+	return resp, err
+}
+
+func (b *auditingBroker) Bind(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *BindRequest) (*BindResponse, error) {
+	resp, err := b.Broker.Bind(ctx, instanceUUID, bindingUUID, req)
+	status, operation := 0, ""
+	if resp != nil {
+		status, operation = resp.StatusCode, resp.Operation
+	}
+	b.record(ctx, OperationBind, instanceUUID, bindingUUID, req.ServiceID.String(), req.PlanID.String(), status, operation, err)
+	return resp, err
+}
+
+func (b *auditingBroker) Unbind(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *UnbindRequest) (*UnbindResponse, error) {
+	resp, err := b.Broker.Unbind(ctx, instanceUUID, bindingUUID, req)
+	status, operation := 0, ""
+	if resp != nil {
+		status, operation = resp.StatusCode, resp.Operation
+	}
+	b.record(ctx, OperationUnbind, instanceUUID, bindingUUID, req.ServiceID, req.PlanID, status, operation, err)
+	return resp, err
+}
+
+func (b *auditingBroker) RotateCredentials(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID) (*BindResponse, error) {
+	resp, err := b.Broker.RotateCredentials(ctx, instanceUUID, bindingUUID)
+	b.record(ctx, OperationRotate, instanceUUID, bindingUUID, "", "", 0, "", err)
+	return resp, err
+}
+
+func (b *auditingBroker) record(ctx context.Context, operation string, instanceUUID uuid.UUID, bindingUUID uuid.UUID, serviceID string, planID string, status int, operationID string, err error) {
+	identity := GetOriginatingIdentity(ctx)
+
+	entry := audit.Entry{
+		Time:       time.Now().UTC(),
+		User:       identity.User(),
+		Operation:  operation,
+		InstanceID: instanceUUID.String(),
+		ServiceID:  serviceID,
+		PlanID:     planID,
+		Outcome:    audit.OutcomeSuccess,
+		Status:     status,
+	}
+	if identity != nil {
+		entry.Platform = identity.Platform
+	}
+	if bindingUUID != nil {
+		entry.BindingID = bindingUUID.String()
+	}
+
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Error = err.Error()
+		entry.Status = http.StatusInternalServerError
+		if brokerError, ok := err.(errors.BrokerError); ok {
+			entry.Status = brokerError.Status
+		}
+	} else if status == http.StatusAccepted {
+		entry.Outcome = audit.OutcomeAccepted
+		entry.OperationID = operationID
+	} else if status == 0 {
+		entry.Status = http.StatusOK
+	}
+
+	b.write(entry)
+	if entry.Outcome == audit.OutcomeAccepted && operationID != "" {
+		b.mutex.Lock()
+		finished, found := b.finished[operationID]
+		if found {
+			delete(b.finished, operationID)
+		} else {
+			b.accepted[operationID] = entry
+		}
+		b.mutex.Unlock()
+		if found {
+			b.write(finishedEntry(entry, finished))
+		}
+	}
+}
+
+// operationFinished records the outcome of an accepted operation.
+func (b *auditingBroker) operationFinished(operation Operation) {
+	b.mutex.Lock()
+	accepted, found := b.accepted[operation.ID]
+	if found {
+		delete(b.accepted, operation.ID)
+	} else {
+		b.finished[operation.ID] = operation
+	}
+	b.mutex.Unlock()
+	if found {
+		b.write(finishedEntry(accepted, operation))
+	}
+}
+
+// finishedEntry derives the entry of a finished operation from the entry recording its acceptance.
+func finishedEntry(accepted audit.Entry, operation Operation) audit.Entry {
+	entry := accepted
+	entry.Time = operation.Finished.UTC()
+	entry.Outcome = audit.OutcomeSuccess
+	entry.Status = http.StatusOK
+	if operation.State == LastOperationStateFailed {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Status = http.StatusInternalServerError
+		entry.Error = operation.Description
+	}
+	return entry
+}
+
+func (b *auditingBroker) write(entry audit.Entry) {
+	if err := b.audit.Record(entry); err != nil {
+		b.log.Errorf("Failed to write audit log entry: %v", err)
+	}
+}
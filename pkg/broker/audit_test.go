@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/audit"
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/pborman/uuid"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of finishing operations.
+type syncBuffer struct {
+	bytes.Buffer
+	done chan struct{}
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	n, err := b.Buffer.Write(p)
+	if strings.Contains(string(p), `"outcome":"`+audit.OutcomeAccepted+`"`) {
+		return n, err
+	}
+	close(b.done)
+	return n, err
+}
+
+func TestAuditFinishedOperations(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		outcome    string
+	}{
+		{name: "succeeded", outcome: audit.OutcomeSuccess},
+		{name: "failed", parameters: map[string]string{"role": "admin"}, outcome: audit.OutcomeFailure},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		b, _ := newTestBroker(t, MaasBrokerConfig{Credentials: CredentialsConfig{BindingUsers: true}})
+		instanceID, bindingID := uuid.NewRandom(), uuid.NewRandom()
+		serviceID, planID := uuid.Parse(QueueServiceUUID), uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid)
+		if _, err := b.Provision(ctx, instanceID, &ProvisionRequest{
+			OrganizationID: testInfraID,
+			ServiceID:      serviceID,
+			PlanID:         planID,
+			Parameters:     map[string]string{"name": "my-queue"},
+		}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		buffer := &syncBuffer{done: make(chan struct{})}
+		auditing := NewAuditingBroker(b, audit.NewLog(buffer), b.log)
+		resp, err := auditing.Bind(ctx, instanceID, bindingID, &BindRequest{
+			ServiceID:         serviceID,
+			PlanID:            planID,
+			Parameters:        test.parameters,
+			AcceptsIncomplete: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		select {
+		case <-buffer.done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: expected the finished operation to be audited", test.name)
+		}
+
+		var entries []audit.Entry
+		decoder := json.NewDecoder(&buffer.Buffer)
+		for decoder.More() {
+			var entry audit.Entry
+			if err := decoder.Decode(&entry); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("%s: expected an accepted and a finished entry, got %v", test.name, entries)
+		}
+		for i, outcome := range []string{audit.OutcomeAccepted, test.outcome} {
+			entry := entries[i]
+			if entry.Outcome != outcome || entry.OperationID != resp.Operation || entry.Operation != OperationBind ||
+				entry.BindingID != bindingID.String() || entry.ServiceID != serviceID.String() {
+				t.Errorf("%s: unexpected entry %d %v", test.name, i, entry)
+			}
+		}
+	}
+}
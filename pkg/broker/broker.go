@@ -1,33 +1,105 @@
 package broker
 
 import (
+	"context"
+	"fmt"
 	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
 	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
-	"github.com/kubernetes-incubator/service-catalog/.glide/cache/src/https-k8s.io-kubernetes/pkg/util/strings"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
 	"github.com/op/go-logging"
 	"github.com/pborman/uuid"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type Broker interface {
-	Catalog() (*CatalogResponse, error)
-	Provision(uuid.UUID, *ProvisionRequest) (*ProvisionResponse, error)
-	Update(uuid.UUID, *UpdateRequest) (*UpdateResponse, error)
-	Deprovision(instanceUUID uuid.UUID, serviceId string, planId string) (*DeprovisionResponse, error)
-	Bind(uuid.UUID, uuid.UUID, *BindRequest) (*BindResponse, error)
-	Unbind(uuid.UUID, uuid.UUID) error
+	Catalog(context.Context) (*CatalogResponse, error)
+	Provision(context.Context, uuid.UUID, *ProvisionRequest) (*ProvisionResponse, error)
+	Update(context.Context, uuid.UUID, *UpdateRequest) (*UpdateResponse, error)
+	Deprovision(ctx context.Context, instanceUUID uuid.UUID, serviceId string, planId string) (*DeprovisionResponse, error)
+	GetInstance(context.Context, uuid.UUID) (*GetInstanceResponse, error)
+	LastOperation(context.Context, uuid.UUID, *LastOperationRequest) (*LastOperationResponse, error)
+	Bind(context.Context, uuid.UUID, uuid.UUID, *BindRequest) (*BindResponse, error)
+	Unbind(context.Context, uuid.UUID, uuid.UUID, *UnbindRequest) (*UnbindResponse, error)
+	GetBinding(context.Context, uuid.UUID, uuid.UUID) (*GetBindingResponse, error)
+	BindingLastOperation(context.Context, uuid.UUID, uuid.UUID, *LastOperationRequest) (*LastOperationResponse, error)
+	RotateCredentials(context.Context, uuid.UUID, uuid.UUID) (*BindResponse, error)
+}
+
+type MaasBrokerConfig struct {
+	// TemplateParameters whitelists the flavor template parameters that may be overridden when provisioning,
+	// mapping each parameter name to the regular expression its value must match.
+	TemplateParameters map[string]string
+	Credentials        CredentialsConfig
+	Dashboard          DashboardConfig
+	Tenancy            TenancyConfig
+	// RotationOverlap is how long the credentials replaced by a rotation remain valid.
+	RotationOverlap time.Duration
+	Readiness       ReadinessConfig
 }
 
 type MaasBroker struct {
-	log    *logging.Logger
-	client *maas.MaasClient
+	log                *logging.Logger
+	backend            maas.Backend
+	locks              *keyedLock
+	templateParameters map[string]*regexp.Regexp
+	credentials        *credentialsBuilder
+	store              *store
+	operations         *operationTracker
+	bindingUsers       bool
+	rotationOverlap    time.Duration
+	readiness          ReadinessConfig
+	dashboard          DashboardConfig
+	tenancy            TenancyPolicy
 }
 
-func NewMaasBroker(log *logging.Logger, client *maas.MaasClient) (*MaasBroker, error) {
+func NewMaasBroker(config MaasBrokerConfig, log *logging.Logger, backend maas.Backend) (*MaasBroker, error) {
 	broker := &MaasBroker{
-		log:    log,
-		client: client,
+		log:                log,
+		backend:            backend,
+		locks:              newKeyedLock(),
+		store:              newStore(),
+		operations:         newOperationTracker(),
+		bindingUsers:       config.Credentials.BindingUsers,
+		rotationOverlap:    config.RotationOverlap,
+		readiness:          config.Readiness,
+		dashboard:          config.Dashboard,
+		templateParameters: make(map[string]*regexp.Regexp),
+	}
+
+	for name, pattern := range config.TemplateParameters {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for template parameter %s: %v", name, err)
+		}
+		broker.templateParameters[name] = regex
 	}
+
+	if broker.rotationOverlap == 0 {
+		broker.rotationOverlap = defaultRotationOverlap
+	}
+	if broker.readiness.Timeout == 0 {
+		broker.readiness.Timeout = defaultReadinessTimeout
+	}
+	if broker.readiness.PollInterval == 0 {
+		broker.readiness.PollInterval = defaultReadinessPollInterval
+	}
+
+	tenancy, err := NewTenancyPolicy(config.Tenancy)
+	if err != nil {
+		return nil, err
+	}
+	broker.tenancy = tenancy
+
+	credentials, err := newCredentialsBuilder(config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	broker.credentials = credentials
+
 	return broker, nil
 }
 
@@ -37,43 +109,63 @@ const (
 	QueueServiceUUID     = "7739ea7d-8de4-4fe8-8297-90f703904589"
 	TopicServiceUUID     = "7739ea7d-8de4-4fe8-8297-90f703904590"
 
+	AnycastServiceName   = "direct-anycast-network"
+	MulticastServiceName = "direct-multicast-network"
+	QueueServiceName     = "queue"
+	TopicServiceName     = "topic"
+
 	AnycastPlanUUID   = "914e9acc-242e-42e3-8995-4ec90d928c2b"
 	MulticastPlanUUID = "6373d6b9-b701-4636-a5ff-dc5b835c9223"
 )
 
-func (b MaasBroker) Catalog() (*CatalogResponse, error) {
-	b.log.Info("MaaSBroker::Catalog")
+const defaultRotationOverlap = 5 * time.Minute
+
+// NamespaceLabel labels addresses with the Kubernetes namespace they were provisioned from.
+const NamespaceLabel = "enmasse.io/originating-namespace"
+
+var groupNamePattern = regexp.MustCompile("^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$")
+
+func (b MaasBroker) Catalog(ctx context.Context) (*CatalogResponse, error) {
+	log := reqctx.Logger(ctx, b.log)
+	log.Info("MaaSBroker::Catalog")
 
 	queueService := Service{
 		ID:          uuid.Parse(QueueServiceUUID),
-		Name:        "queue",
+		Name:        QueueServiceName,
 		Description: "A messaging queue",
 		Bindable:    true,
 		Plans:       []Plan{},
 		Metadata:    make(map[string]interface{}),
+
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
 	}
 
 	topicService := Service{
 		ID:          uuid.Parse(TopicServiceUUID),
-		Name:        "topic",
+		Name:        TopicServiceName,
 		Description: "A messaging topic",
 		Bindable:    true,
 		Plans:       []Plan{},
 		Metadata:    make(map[string]interface{}),
+
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
 	}
 
-	flavors, err := b.client.GetFlavors()
+	flavors, err := b.backend.GetFlavors(ctx)
 	if err != nil {
 		return nil, errors.NewBrokerError(http.StatusInternalServerError, err.Error())
 	}
 
-	b.log.Info("Processing flavors")
+	log.Info("Processing flavors")
 	for _, flavor := range flavors {
-		b.log.Info("Flavor: %s (%s)", flavor.Metadata.Name, flavor.Spec.Description)
+		log.Info("Flavor: %s (%s)", flavor.Metadata.Name, flavor.Spec.Description)
 		plan := Plan{
 			ID:          uuid.Parse(flavor.Metadata.Uuid),
 			Name:        SanitizePlanName(flavor.Metadata.Name),
 			Description: flavor.Spec.Description,
+			Metadata:    b.planMetadata(flavor),
 			Free:        true,
 		}
 		if flavor.Spec.Type == maas.Queue {
@@ -81,13 +173,13 @@ func (b MaasBroker) Catalog() (*CatalogResponse, error) {
 		} else if flavor.Spec.Type == maas.Topic {
 			topicService.Plans = append(topicService.Plans, plan)
 		} else {
-			b.log.Warningf("Unknown flavor type %s", flavor.Spec.Type)
+			log.Warningf("Unknown flavor type %s", flavor.Spec.Type)
 		}
 	}
 
 	anycastService := Service{
 		ID:          uuid.Parse(AnycastServiceUUID),
-		Name:        "direct-anycast-network",
+		Name:        AnycastServiceName,
 		Description: "A brokerless network for direct anycast messaging",
 		Bindable:    true,
 		Plans: []Plan{{
@@ -97,11 +189,14 @@ func (b MaasBroker) Catalog() (*CatalogResponse, error) {
 			Free:        true,
 		}},
 		Metadata: make(map[string]interface{}),
+
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
 	}
 
 	multicastService := Service{
 		ID:          uuid.Parse(MulticastServiceUUID),
-		Name:        "direct-multicast-network",
+		Name:        MulticastServiceName,
 		Description: "A brokerless network for direct multicast messaging",
 		Bindable:    true,
 		Plans: []Plan{{
@@ -111,6 +206,9 @@ func (b MaasBroker) Catalog() (*CatalogResponse, error) {
 			Free:        true,
 		}},
 		Metadata: make(map[string]interface{}),
+
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
 	}
 
 	services := []Service{
@@ -118,8 +216,8 @@ func (b MaasBroker) Catalog() (*CatalogResponse, error) {
 		multicastService,
 	}
 
-	b.log.Info("queueService.Plans: %d", len(queueService.Plans))
-	b.log.Info("topicService.Plans: %d", len(topicService.Plans))
+	log.Info("queueService.Plans: %d", len(queueService.Plans))
+	log.Info("topicService.Plans: %d", len(topicService.Plans))
 
 	if len(queueService.Plans) > 0 {
 		services = append(services, queueService)
@@ -128,26 +226,31 @@ func (b MaasBroker) Catalog() (*CatalogResponse, error) {
 		services = append(services, topicService)
 	}
 
+	for i := range services {
+		services[i].DashboardClient = b.dashboardClient(services[i].Name)
+	}
+
 	return &CatalogResponse{services}, nil
 }
 
-func (b MaasBroker) Provision(instanceUUID uuid.UUID, req *ProvisionRequest) (*ProvisionResponse, error) {
-	b.log.Info("Provisioning: %v", req)
+func (b MaasBroker) Provision(ctx context.Context, instanceUUID uuid.UUID, req *ProvisionRequest) (*ProvisionResponse, error) {
+	log := reqctx.Logger(ctx, b.log)
+	log.Info("Provisioning %s with service %s and plan %s", instanceUUID.String(), req.ServiceID.String(), req.PlanID.String())
+	log.Info("Request context: %s", req.Context)
 
-	if req.OrganizationID == "" {
-		req.OrganizationID = "some-unique-guid"
-		req.SpaceID = "some-unique-guid"
+	unlock, err := b.lockInstance(instanceUUID, req.AcceptsIncomplete)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	// TODO: this is a temporary hack needed because otherwise the resulting address configmap name is too long
-	infraID := strings.ShortenString(req.OrganizationID, 8)
-
-	flavor, err := b.getFlavor(req)
+	infraID, err := b.tenancy.InfraID(req)
 	if err != nil {
 		return nil, err
 	}
+	log.Info("Tenancy policy %s maps instance %s to infrastructure %s", b.tenancy.Name(), instanceUUID.String(), infraID)
 
-	address, err := b.client.GetAddress(infraID, instanceUUID)
+	flavor, err := b.getFlavor(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -157,49 +260,295 @@ func (b MaasBroker) Provision(instanceUUID uuid.UUID, req *ProvisionRequest) (*P
 		return nil, errors.NewBadRequest("Missing parameter: name")
 	}
 
+	group := req.Parameters["group"]
+	if err = validatePlan(req, flavor, group); err != nil {
+		return nil, err
+	}
+
+	templateParameters, err := b.getTemplateParameters(req.Parameters, flavor)
+	if err != nil {
+		return nil, err
+	}
+
+	// The infrastructure is only provisioned for valid requests, so that rejected ones leave nothing behind.
+	if err = b.ensureInfra(ctx, infraID); err != nil {
+		return nil, err
+	}
+
+	address, err := maas.GetAddress(ctx, b.backend, infraID, instanceUUID)
+	if err != nil {
+		return nil, err
+	}
+
 	if address != nil {
 		if req.ServiceID.String() == getServiceID(address) &&
-			flavor.Metadata.Name == address.Spec.Flavor &&
-			name == address.Metadata.Name {
+			getFlavorName(flavor) == address.Spec.Flavor &&
+			name == address.Metadata.Name &&
+			group == address.Spec.Group &&
+			sameParameters(templateParameters, address.Spec.TemplateParameters) {
 
-			return &ProvisionResponse{StatusCode: http.StatusOK, Operation: "successful"}, nil
+			record := b.store.getInstance(instanceUUID.String())
+			if record == nil {
+				record = b.newInstanceRecord(ctx, instanceUUID, infraID, req)
+				b.store.putInstance(record)
+			}
+			return &ProvisionResponse{StatusCode: http.StatusOK, DashboardURL: record.DashboardURL, Operation: "successful"}, nil
 		} else {
 			return nil, errors.NewServiceInstanceAlreadyExists(instanceUUID.String())
 		}
 	}
 
+	options := maas.AddressOptions{
+		Group:              group,
+		TemplateParameters: templateParameters,
+	}
+	if namespace := req.Context.GetNamespace(); namespace != "" {
+		options.Labels = map[string]string{NamespaceLabel: namespace}
+	}
+
 	switch req.ServiceID.String() {
 	case AnycastServiceUUID:
-		err = b.client.ProvisionAnycast(infraID, instanceUUID, name)
+		err = maas.ProvisionAnycast(ctx, b.backend, infraID, instanceUUID, name, options)
 	case MulticastServiceUUID:
-		err = b.client.ProvisionMulticast(infraID, instanceUUID, name)
+		err = maas.ProvisionMulticast(ctx, b.backend, infraID, instanceUUID, name, options)
+	case QueueServiceUUID:
+		if err = b.validateGroup(ctx, infraID, group, flavor); err != nil {
+			return nil, err
+		}
+		err = maas.ProvisionQueue(ctx, b.backend, infraID, instanceUUID, name, flavor, options)
+	case TopicServiceUUID:
+		if err = b.validateGroup(ctx, infraID, group, flavor); err != nil {
+			return nil, err
+		}
+		err = maas.ProvisionTopic(ctx, b.backend, infraID, instanceUUID, name, flavor, options)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := b.newInstanceRecord(ctx, instanceUUID, infraID, req)
+	b.store.putInstance(record)
+
+	if req.AcceptsIncomplete {
+		operation, err := b.operations.start(OperationProvision, instanceUUID.String(), "")
+		if err != nil {
+			return nil, err
+		}
+		go b.awaitReady(reqctx.Detach(ctx), operation, infraID, instanceUUID, getFlavorName(flavor))
+		return &ProvisionResponse{StatusCode: http.StatusAccepted, DashboardURL: record.DashboardURL, Operation: operation.ID}, nil
+	}
+
+	return &ProvisionResponse{StatusCode: http.StatusCreated, DashboardURL: record.DashboardURL, Operation: "successful"}, nil
+}
+
+func (b MaasBroker) newInstanceRecord(ctx context.Context, instanceUUID uuid.UUID, infraID string, req *ProvisionRequest) *InstanceRecord {
+	log := reqctx.Logger(ctx, b.log)
+	instance, err := b.backend.GetInstance(ctx, infraID)
+	if err != nil {
+		log.Warningf("Could not determine dashboard URL of instance %s: %v", instanceUUID.String(), err)
+	}
+
+	return &InstanceRecord{
+		InstanceID:   instanceUUID.String(),
+		InfraID:      infraID,
+		ServiceID:    req.ServiceID.String(),
+		PlanID:       req.PlanID.String(),
+		Parameters:   req.Parameters,
+		DashboardURL: b.dashboardURL(instance, req.Parameters["name"]),
+		Namespace:    req.Context.GetNamespace(),
+	}
+}
+
+// lockInstance serialises operations on a single service instance. Requests fail with a ConcurrencyError
+// while an asynchronous operation on the instance is in progress, and requests accepting asynchronous
+// completion also fail instead of waiting for the lock.
+func (b MaasBroker) lockInstance(instanceUUID uuid.UUID, acceptsIncomplete bool) (func(), error) {
+	if b.operations.inProgress(instanceUUID.String()) {
+		return nil, errors.NewConcurrencyError(instanceUUID.String())
+	}
+	if !acceptsIncomplete {
+		return b.locks.Lock(instanceUUID.String()), nil
+	}
+	unlock, ok := b.locks.TryLock(instanceUUID.String())
+	if !ok {
+		return nil, errors.NewConcurrencyError(instanceUUID.String())
+	}
+	return unlock, nil
+}
+
+// validatePlan checks that the plan and the address group of a provision request suit its service, without
+// consulting the infrastructure instance.
+func validatePlan(req *ProvisionRequest, flavor *maas.Flavor, group string) error {
+	switch req.ServiceID.String() {
+	case AnycastServiceUUID, MulticastServiceUUID:
+		if group != "" {
+			return errors.NewBadRequest("Parameter group is only supported by queues and topics")
+		}
+		return nil
 	case QueueServiceUUID:
 		if flavor == nil || flavor.Spec.Type != maas.Queue {
-			return nil, errors.NewBadRequest("Invalid plan ID " + req.PlanID.String())
+			return errors.NewBadRequest("Invalid plan ID " + req.PlanID.String())
 		}
-		err = b.client.ProvisionQueue(infraID, instanceUUID, name, flavor)
 	case TopicServiceUUID:
 		if flavor == nil || flavor.Spec.Type != maas.Topic {
-			return nil, errors.NewBadRequest("Invalid plan ID " + req.PlanID.String())
+			return errors.NewBadRequest("Invalid plan ID " + req.PlanID.String())
 		}
-		err = b.client.ProvisionTopic(infraID, instanceUUID, name, flavor)
 	default:
-		return nil, errors.NewBadRequest("Unknown service ID " + req.ServiceID.String())
+		return errors.NewBadRequest("Unknown service ID " + req.ServiceID.String())
+	}
+	if group != "" && !groupNamePattern.MatchString(group) {
+		return errors.NewBadRequest("Invalid group name " + group + ": must consist of lower case alphanumeric characters or '-', and be at most 63 characters long")
+	}
+	return nil
+}
+
+// validateGroup checks that an address of the given flavor may join the address group. Addresses in a
+// group share the same broker, so an existing group must have been created with the same flavor. A group
+// that does not exist yet is created by the address controller together with its first address.
+func (b MaasBroker) validateGroup(ctx context.Context, infraID string, group string, flavor *maas.Flavor) error {
+	log := reqctx.Logger(ctx, b.log)
+	if group == "" {
+		return nil
 	}
 
+	addresses, err := b.backend.GetAddresses(ctx, infraID)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	for _, address := range addresses {
+		if address.Spec.Group != group {
+			continue
+		}
+		if address.Spec.Flavor != flavor.Metadata.Name {
+			return errors.NewBadRequest("Address group " + group + " uses flavor " + address.Spec.Flavor + ", which does not match plan " + flavor.Metadata.Name)
+		}
+		log.Info("Joining existing address group %s", group)
+		return nil
+	}
+
+	log.Info("Address group %s does not exist and will be created", group)
+	return nil
+}
+
+// getTemplateParameters returns the flavor template parameters overridden by the provisioning parameters.
+// Only parameters whitelisted in the broker configuration may be overridden, and their values must match
+// the configured pattern.
+func (b MaasBroker) getTemplateParameters(parameters map[string]string, flavor *maas.Flavor) (map[string]string, error) {
+	var overrides map[string]string
+	for key, value := range parameters {
+		if isReservedParameter(key) {
+			continue
+		}
+		pattern, whitelisted := b.templateParameters[key]
+		if !whitelisted {
+			if flavor != nil {
+				if _, found := flavor.Spec.TemplateParameters[key]; found {
+					return nil, errors.NewBadRequest("Template parameter " + key + " cannot be overridden")
+				}
+			}
+			continue
+		}
+		if flavor == nil {
+			return nil, errors.NewBadRequest("Template parameter " + key + " is only supported by queues and topics")
+		}
+		if !pattern.MatchString(value) {
+			return nil, errors.NewBadRequest("Invalid value for template parameter " + key + ": " + value)
+		}
+		if overrides == nil {
+			overrides = make(map[string]string)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// planMetadata exposes the flavor's template and its parameters to service catalog UIs.
+func (b MaasBroker) planMetadata(flavor maas.Flavor) map[string]interface{} {
+	names := make([]string, 0, len(flavor.Spec.TemplateParameters))
+	for name := range flavor.Spec.TemplateParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bullets := []string{}
+	overridable := []string{}
+	for _, name := range names {
+		bullets = append(bullets, name+": "+flavor.Spec.TemplateParameters[name])
+		if _, whitelisted := b.templateParameters[name]; whitelisted {
+			overridable = append(overridable, name)
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"displayName":           flavor.Metadata.Name,
+		"bullets":               bullets,
+		"overridableParameters": overridable,
+	}
+	if flavor.Spec.TemplateName != "" {
+		metadata["templateName"] = flavor.Spec.TemplateName
+	}
+	if len(flavor.Spec.TemplateParameters) > 0 {
+		metadata["templateParameters"] = flavor.Spec.TemplateParameters
+	}
+	return metadata
+}
+
+func isReservedParameter(key string) bool {
+	return key == "name" || key == "group"
+}
+
+// ensureInfra provisions the infrastructure instance chosen by the tenancy policy, unless it exists.
+func (b MaasBroker) ensureInfra(ctx context.Context, infraID string) error {
+	instance, err := b.backend.GetInstance(ctx, infraID)
+	if err != nil || instance != nil {
+		return err
+	}
+	reqctx.Logger(ctx, b.log).Noticef("Infrastructure instance %s does not exist, provisioning it", infraID)
+	return b.backend.ProvisionMaaSInfra(ctx, infraID)
+}
+
+func sameParameters(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
 	}
+	for key, value := range a {
+		if other, found := b[key]; !found || other != value {
+			return false
+		}
+	}
+	return true
+}
 
-	return &ProvisionResponse{StatusCode: http.StatusCreated, Operation: "successful"}, nil
+func getFlavorName(flavor *maas.Flavor) string {
+	if flavor == nil {
+		return ""
+	}
+	return flavor.Metadata.Name
 }
 
-func (b MaasBroker) getFlavor(req *ProvisionRequest) (*maas.Flavor, error) {
+func (b MaasBroker) getFlavor(ctx context.Context, req *ProvisionRequest) (*maas.Flavor, error) {
 	switch req.ServiceID.String() {
 	case AnycastServiceUUID, MulticastServiceUUID:
 		return nil, nil
 	default:
-		return b.client.GetFlavor(req.PlanID)
+		return maas.GetFlavor(ctx, b.backend, req.PlanID)
+	}
+}
+
+func getServiceName(serviceID string) string {
+	switch serviceID {
+	case AnycastServiceUUID:
+		return AnycastServiceName
+	case MulticastServiceUUID:
+		return MulticastServiceName
+	case QueueServiceUUID:
+		return QueueServiceName
+	case TopicServiceUUID:
+		return TopicServiceName
+	default:
+		return ""
 	}
 }
 
@@ -219,55 +568,477 @@ func getServiceID(address *maas.Address) string {
 	}
 }
 
-func (b MaasBroker) Deprovision(instanceUUID uuid.UUID, serviceId string, planId string) (*DeprovisionResponse, error) {
-	b.log.Info("Deprovisioning %s", instanceUUID.String())
+func (b MaasBroker) Deprovision(ctx context.Context, instanceUUID uuid.UUID, serviceId string, planId string) (*DeprovisionResponse, error) {
+	log := reqctx.Logger(ctx, b.log)
+	log.Info("Deprovisioning %s", instanceUUID.String())
 
-	instance, address, err := b.client.FindAddress(instanceUUID)
+	unlock, err := b.lockInstance(instanceUUID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	instance, address, err := maas.FindAddress(ctx, b.backend, instanceUUID)
 	if err != nil {
 		return nil, err
 	}
 
 	if address == nil {
+		// The address was deleted behind the broker's back: forget the instance too, or the reconciler
+		// would re-create it.
+		b.forgetInstance(instanceUUID.String())
 		return nil, errors.NewServiceInstanceGone(instanceUUID.String())
 	}
 
-	err = b.client.DeprovisionAddress(instance.Metadata.Name, instanceUUID)
+	err = b.backend.DeprovisionAddress(ctx, instance.Metadata.Name, instanceUUID)
 	if err != nil {
 		return nil, errors.NewBrokerError(http.StatusInternalServerError, err.Error())
 	}
 
+	b.forgetInstance(instanceUUID.String())
+
 	return &DeprovisionResponse{Operation: "successful"}, nil
 }
 
-func (b MaasBroker) Bind(instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *BindRequest) (*BindResponse, error) {
+// OnOperationFinished registers f to be called with every asynchronous operation that finishes.
+func (b MaasBroker) OnOperationFinished(f func(Operation)) {
+	b.operations.observe(f)
+}
+
+// forgetInstance deletes the record and the operations of a deprovisioned instance.
+func (b MaasBroker) forgetInstance(instanceID string) {
+	b.store.deleteInstance(instanceID)
+	b.operations.forget(instanceID)
+}
+
+// GetInstance returns the instance as it was provisioned. Instances the broker has not tracked since its
+// start are reconstructed from their address. Instances are not found until their asynchronous provisioning
+// succeeds, and fail with a ConcurrencyError while being updated.
+func (b MaasBroker) GetInstance(ctx context.Context, instanceUUID uuid.UUID) (*GetInstanceResponse, error) {
+	if operation := b.operations.get(instanceUUID.String(), ""); operation != nil && operation.State == LastOperationStateInProgress {
+		switch operation.Type {
+		case OperationProvision:
+			return nil, errors.NewServiceInstanceNotFound(instanceUUID.String())
+		case OperationUpdate:
+			return nil, errors.NewConcurrencyError(instanceUUID.String())
+		}
+	}
+
+	record := b.store.getInstance(instanceUUID.String())
+	if record == nil {
+		instance, address, err := maas.FindAddress(ctx, b.backend, instanceUUID)
+		if err != nil {
+			return nil, err
+		}
+
+		if address == nil {
+			return nil, errors.NewServiceInstanceNotFound(instanceUUID.String())
+		}
+
+		record, err = b.instanceRecordFromAddress(ctx, instance, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &GetInstanceResponse{
+		ServiceID:    record.ServiceID,
+		PlanID:       record.PlanID,
+		DashboardURL: record.DashboardURL,
+		Parameters:   record.Parameters,
+	}, nil
+}
+
+func (b MaasBroker) instanceRecordFromAddress(ctx context.Context, instance *maas.Instance, address *maas.Address) (*InstanceRecord, error) {
+	record := &InstanceRecord{
+		InstanceID:   address.Metadata.Uuid,
+		InfraID:      instance.Metadata.Name,
+		ServiceID:    getServiceID(address),
+		Parameters:   map[string]string{"name": address.Metadata.Name},
+		DashboardURL: b.dashboardURL(instance, address.Metadata.Name),
+		Namespace:    address.Metadata.Labels[NamespaceLabel],
+	}
+
+	if address.Spec.Group != "" {
+		record.Parameters["group"] = address.Spec.Group
+	}
+	for key, value := range address.Spec.TemplateParameters {
+		record.Parameters[key] = value
+	}
+
+	switch record.ServiceID {
+	case AnycastServiceUUID:
+		record.PlanID = AnycastPlanUUID
+	case MulticastServiceUUID:
+		record.PlanID = MulticastPlanUUID
+	default:
+		flavors, err := b.backend.GetFlavors(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, flavor := range flavors {
+			if flavor.Metadata.Name == address.Spec.Flavor {
+				record.PlanID = flavor.Metadata.Uuid
+			}
+		}
+	}
+
+	return record, nil
+}
+
+func (b MaasBroker) Bind(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *BindRequest) (*BindResponse, error) {
+	log := reqctx.Logger(ctx, b.log)
+	unlock, err := b.lockInstance(instanceUUID, req.AcceptsIncomplete)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	instance, address, err := maas.FindAddress(ctx, b.backend, instanceUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if address == nil {
+		return nil, errors.NewServiceInstanceNotFound(instanceUUID.String())
+	}
+
+	log.Info("Request context: %s", req.Context)
+	if err = authorize(instanceUUID, address, req.Context); err != nil {
+		return nil, err
+	}
+
+	if binding := b.store.getBinding(bindingUUID.String()); binding != nil {
+		if binding.InstanceID == instanceUUID.String() &&
+			binding.ServiceID == req.ServiceID.String() &&
+			binding.PlanID == req.PlanID.String() &&
+			sameParameters(binding.Parameters, req.Parameters) {
+
+			return &BindResponse{StatusCode: http.StatusOK, Credentials: binding.Credentials}, nil
+		} else {
+			return nil, errors.NewServiceBindingAlreadyExists(bindingUUID.String())
+		}
+	}
+
+	if req.AcceptsIncomplete {
+		operation, err := b.operations.start(OperationBind, instanceUUID.String(), bindingUUID.String())
+		if err != nil {
+			return nil, err
+		}
+		detached := reqctx.Detach(ctx)
+		go func() {
+			unlock := b.locks.Lock(instanceUUID.String())
+			defer unlock()
+			_, err := b.createBinding(detached, instanceUUID, bindingUUID, req, instance, address)
+			b.operations.finish(operation, err)
+		}()
+		return &BindResponse{StatusCode: http.StatusAccepted, Operation: operation.ID}, nil
+	}
+
+	credentials, err := b.createBinding(ctx, instanceUUID, bindingUUID, req, instance, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BindResponse{StatusCode: http.StatusCreated, Credentials: credentials}, nil
+}
+
+func (b MaasBroker) createBinding(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *BindRequest, instance *maas.Instance, address *maas.Address) (map[string]interface{}, error) {
+	role := req.Parameters["role"]
+	var user *maas.User
+	var err error
+	if b.bindingUsers {
+		if role == "" {
+			role = RoleSendReceive
+		}
+		if user, err = newBindingUser(bindingUUID.String(), role, address, req.Parameters); err != nil {
+			return nil, err
+		}
+	} else if role != "" {
+		return nil, errors.NewBadRequest("Parameter role is not supported: bindings share the credentials of the infrastructure instance")
+	}
 
-	instance, _, err := b.client.FindAddress(instanceUUID)
+	credentials, err := b.credentials.render(req.Parameters["format"], instance, address, role, user)
 	if err != nil {
 		return nil, err
 	}
 
-	// if binding instance exists, and the parameters are the same return: 200.
-	// if binding instance exists, and the parameters are different return: 409.
-	//
-	// return 201 when we're done.
-	//
-	// once we create the binding instance, we call apb.Bind
+	infraID := instance.Metadata.Name
+	record := &BindingRecord{
+		BindingID:   bindingUUID.String(),
+		InstanceID:  instanceUUID.String(),
+		InfraID:     infraID,
+		ServiceID:   req.ServiceID.String(),
+		PlanID:      req.PlanID.String(),
+		Parameters:  req.Parameters,
+		Credentials: credentials,
+	}
+	if user != nil {
+		if err = b.backend.CreateUser(ctx, infraID, *user); err != nil {
+			return nil, err
+		}
+		record.Username = user.Metadata.Name
+	}
+	b.store.putBinding(record)
+
+	return credentials, nil
+}
+
+func (b MaasBroker) Unbind(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *UnbindRequest) (*UnbindResponse, error) {
+	unlock, err := b.lockInstance(instanceUUID, req.AcceptsIncomplete)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	binding, err := b.findBinding(ctx, instanceUUID, bindingUUID)
+	if err != nil {
+		return nil, err
+	}
+	if binding == nil {
+		return nil, errors.NewServiceBindingGone(bindingUUID.String())
+	}
+
+	if req.AcceptsIncomplete {
+		operation, err := b.operations.start(OperationUnbind, instanceUUID.String(), bindingUUID.String())
+		if err != nil {
+			return nil, err
+		}
+		detached := reqctx.Detach(ctx)
+		go func() {
+			unlock := b.locks.Lock(instanceUUID.String())
+			defer unlock()
+			b.operations.finish(operation, b.deleteBinding(detached, binding))
+		}()
+		return &UnbindResponse{StatusCode: http.StatusAccepted, Operation: operation.ID}, nil
+	}
 
-	credentials := make(map[string]interface{})
-	credentials["messagingHost"] = instance.Spec.MessagingHost
-	credentials["mqttHost"] = instance.Spec.MQTTHost
-	credentials["consoleHost"] = instance.Spec.ConsoleHost
-	credentials["namespace"] = instance.Spec.Namespace
+	if err := b.deleteBinding(ctx, binding); err != nil {
+		return nil, err
+	}
 
-	// need to change to return the appropriate section depending on what Bind
-	// returns.
-	return &BindResponse{Credentials: credentials}, nil
+	return &UnbindResponse{StatusCode: http.StatusOK}, nil
 }
 
-func (b MaasBroker) Unbind(instanceUUID uuid.UUID, bindingUUID uuid.UUID) error {
+func (b MaasBroker) deleteBinding(ctx context.Context, binding *BindingRecord) error {
+	usernames := append([]string{binding.Username}, binding.RetiredUsernames...)
+	for _, username := range usernames {
+		if username == "" {
+			continue
+		}
+		if err := b.backend.DeleteUser(ctx, binding.InfraID, username); err != nil {
+			return err
+		}
+	}
+
+	b.store.deleteBinding(binding.BindingID)
 	return nil
 }
 
-func (b MaasBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest) (*UpdateResponse, error) {
+// LastOperation reports the state of the last asynchronous operation of an instance. Instances without
+// asynchronous operations report the readiness of their address as long as it exists.
+func (b MaasBroker) LastOperation(ctx context.Context, instanceUUID uuid.UUID, req *LastOperationRequest) (*LastOperationResponse, error) {
+	operation := b.operations.get(instanceUUID.String(), "")
+	if operation != nil && (req.Operation == "" || req.Operation == operation.ID) {
+		return &LastOperationResponse{State: operation.State, Description: operation.Description}, nil
+	}
+
+	var address *maas.Address
+	var err error
+	if record := b.store.getInstance(instanceUUID.String()); record != nil {
+		address, err = maas.GetAddress(ctx, b.backend, record.InfraID, instanceUUID)
+	} else {
+		_, address, err = maas.FindAddress(ctx, b.backend, instanceUUID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		return nil, errors.NewServiceInstanceGone(instanceUUID.String())
+	}
+	if !address.IsReady() {
+		return &LastOperationResponse{State: LastOperationStateInProgress, Description: describeStatus(address)}, nil
+	}
+
+	return &LastOperationResponse{State: LastOperationStateSucceeded}, nil
+}
+
+// BindingLastOperation reports the state of the last asynchronous operation of a binding.
+func (b MaasBroker) BindingLastOperation(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *LastOperationRequest) (*LastOperationResponse, error) {
+	operation := b.operations.get(instanceUUID.String(), bindingUUID.String())
+	if operation != nil && operation.InstanceID == instanceUUID.String() && (req.Operation == "" || req.Operation == operation.ID) {
+		return &LastOperationResponse{State: operation.State, Description: operation.Description}, nil
+	}
+
+	if b.store.getBinding(bindingUUID.String()) == nil {
+		return nil, errors.NewServiceBindingGone(bindingUUID.String())
+	}
+
+	return &LastOperationResponse{State: LastOperationStateSucceeded}, nil
+}
+
+// findBinding returns the record of a binding, or nil if the binding does not exist. Bindings the broker has
+// not tracked since its start are reconstructed from their users when bindings have their own.
+func (b MaasBroker) findBinding(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID) (*BindingRecord, error) {
+	if binding := b.store.getBinding(bindingUUID.String()); binding != nil {
+		if binding.InstanceID != instanceUUID.String() {
+			return nil, nil
+		}
+		return binding, nil
+	}
+	if !b.bindingUsers {
+		return nil, nil
+	}
+
+	instance, address, err := maas.FindAddress(ctx, b.backend, instanceUUID)
+	if err != nil || address == nil {
+		return nil, err
+	}
+	users, err := b.backend.GetUsers(ctx, instance.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
+	binding, user := bindingFromUsers(instanceUUID.String(), bindingUUID.String(), users)
+	if binding == nil {
+		return nil, nil
+	}
+
+	record := b.store.getInstance(instanceUUID.String())
+	if record == nil {
+		if record, err = b.instanceRecordFromAddress(ctx, instance, address); err != nil {
+			return nil, err
+		}
+	}
+	role := binding.Parameters["role"]
+	if role == "" {
+		role = RoleSendReceive
+	}
+	binding.InfraID = instance.Metadata.Name
+	binding.ServiceID = record.ServiceID
+	binding.PlanID = record.PlanID
+	if binding.Credentials, err = b.credentials.render(binding.Parameters["format"], instance, address, role, user); err != nil {
+		return nil, err
+	}
+
+	reqctx.Logger(ctx, b.log).Infof("Reconstructed binding %s from user %s", bindingUUID.String(), user.Metadata.Name)
+	b.store.putBinding(binding)
+	return binding, nil
+}
+
+// GetBinding returns the credentials and parameters of a binding. Bindings the broker has not tracked since its
+// start are reconstructed from their users, so with shared credentials they are only known until it restarts.
+// Bindings are not found until their asynchronous binding succeeds.
+func (b MaasBroker) GetBinding(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID) (*GetBindingResponse, error) {
+	if operation := b.operations.get(instanceUUID.String(), bindingUUID.String()); operation != nil &&
+		operation.State == LastOperationStateInProgress && operation.Type == OperationBind {
+		return nil, errors.NewServiceBindingNotFound(bindingUUID.String())
+	}
+
+	binding, err := b.findBinding(ctx, instanceUUID, bindingUUID)
+	if err != nil {
+		return nil, err
+	}
+	if binding == nil {
+		return nil, errors.NewServiceBindingNotFound(bindingUUID.String())
+	}
+
+	return &GetBindingResponse{
+		Credentials: binding.Credentials,
+		Parameters:  binding.Parameters,
+	}, nil
+}
+
+// RotateCredentials replaces the user of a binding with a new one. The replaced user remains valid for the
+// configured overlap window, giving applications time to pick up the new credentials, and is then deleted.
+// The new user is labelled with the pending revocation, which ResumeRevocations completes after a restart.
+func (b MaasBroker) RotateCredentials(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID) (*BindResponse, error) {
+	log := reqctx.Logger(ctx, b.log)
+	log.Info("Rotating credentials of binding %s", bindingUUID.String())
+
+	if !b.bindingUsers {
+		return nil, errors.NewBadRequest("Credential rotation requires per-binding users, which are disabled")
+	}
+
+	unlock, err := b.lockInstance(instanceUUID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	binding := b.store.getBinding(bindingUUID.String())
+	if binding == nil || binding.InstanceID != instanceUUID.String() {
+		return nil, errors.NewServiceBindingNotFound(bindingUUID.String())
+	}
+
+	instance, address, err := maas.FindAddress(ctx, b.backend, instanceUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if address == nil {
+		return nil, errors.NewServiceInstanceNotFound(instanceUUID.String())
+	}
+
+	role := binding.Parameters["role"]
+	if role == "" {
+		role = RoleSendReceive
+	}
+
+	generation := binding.Generation + 1
+	user, err := newBindingUser(bindingUUID.String(), role, address, binding.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	retired := binding.Username
+	revokeAfter := time.Now().Add(b.rotationOverlap)
+	user.Metadata.Name = fmt.Sprintf("%s-%d", user.Metadata.Name, generation)
+	user.Metadata.Labels[RevokesLabel] = retired
+	user.Metadata.Labels[RevokeAfterLabel] = strconv.FormatInt(revokeAfter.Unix(), 10)
+
+	credentials, err := b.credentials.render(binding.Parameters["format"], instance, address, role, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.backend.CreateUser(ctx, binding.InfraID, *user); err != nil {
+		return nil, err
+	}
+
+	rotated := *binding
+	rotated.Username = user.Metadata.Name
+	rotated.Credentials = credentials
+	rotated.Generation = generation
+	rotated.RetiredUsernames = append(append([]string{}, binding.RetiredUsernames...), retired)
+	b.store.putBinding(&rotated)
+
+	log.Info("User %s of binding %s will be revoked in %s", retired, bindingUUID.String(), b.rotationOverlap)
+	detached := reqctx.Detach(ctx)
+	pending := revocation{
+		infraID:    binding.InfraID,
+		instanceID: instanceUUID.String(),
+		bindingID:  bindingUUID.String(),
+		username:   retired,
+		after:      revokeAfter,
+	}
+	time.AfterFunc(b.rotationOverlap, func() {
+		b.revokeUser(detached, pending)
+	})
+
+	return &BindResponse{StatusCode: http.StatusOK, Credentials: credentials}, nil
+}
+
+func (b MaasBroker) Update(ctx context.Context, instanceUUID uuid.UUID, req *UpdateRequest) (*UpdateResponse, error) {
+	log := reqctx.Logger(ctx, b.log)
+	log.Info("Updating %s (request context: %s)", instanceUUID.String(), req.Context)
 	return nil, notImplemented
 }
+
+// authorize rejects requests originating from another namespace than the one the instance was provisioned from.
+func authorize(instanceUUID uuid.UUID, address *maas.Address, platform *PlatformContext) error {
+	owner := address.Metadata.Labels[NamespaceLabel]
+	namespace := platform.GetNamespace()
+	if owner == "" || namespace == "" || owner == namespace {
+		return nil
+	}
+	return errors.NewForbidden("Service instance " + instanceUUID.String() + " belongs to another namespace")
+}
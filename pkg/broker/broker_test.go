@@ -0,0 +1,379 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+func TestDeprovision(t *testing.T) {
+	tests := []struct {
+		name          string
+		deleteAddress bool
+		status        int
+	}{
+		{name: "existing address", status: http.StatusOK},
+		{name: "address deleted behind the broker's back", deleteAddress: true, status: http.StatusGone},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		b, _ := newTestBroker(t, MaasBrokerConfig{})
+		instanceID := uuid.NewRandom()
+		planID := fakemaas.DefaultFlavors()[0].Metadata.Uuid
+		if _, err := b.Provision(ctx, instanceID, &ProvisionRequest{
+			OrganizationID: testInfraID,
+			ServiceID:      uuid.Parse(QueueServiceUUID),
+			PlanID:         uuid.Parse(planID),
+			Parameters:     map[string]string{"name": "my-queue"},
+		}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.deleteAddress {
+			if err := b.backend.DeprovisionAddress(ctx, testInfraID, instanceID); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		_, err := b.Deprovision(ctx, instanceID, QueueServiceUUID, planID)
+		if test.status == http.StatusOK && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if brokerError, ok := err.(errors.BrokerError); test.status != http.StatusOK && (!ok || brokerError.Status != test.status) {
+			t.Errorf("%s: expected status %d, got %v", test.name, test.status, err)
+		}
+		if b.store.getInstance(instanceID.String()) != nil {
+			t.Errorf("%s: expected the instance record to be deleted", test.name)
+		}
+		if operation := b.operations.get(instanceID.String(), ""); operation != nil {
+			t.Errorf("%s: expected the operations of the instance to be deleted, got %v", test.name, operation)
+		}
+		report, err := NewReconciler(b, ReconcilerConfig{}, b.log).Reconcile(ctx, false)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(report.Missing) != 0 {
+			t.Errorf("%s: expected no missing address, got %v", test.name, report.Missing)
+		}
+	}
+}
+
+func TestGetBindingAfterRestart(t *testing.T) {
+	tests := []struct {
+		name         string
+		bindingUsers bool
+		parameters   map[string]string
+		rotate       bool
+		found        bool
+	}{
+		{name: "binding user", bindingUsers: true, found: true},
+		{name: "binding user with parameters", bindingUsers: true, parameters: map[string]string{"role": RoleSend}, found: true},
+		{name: "rotated binding user", bindingUsers: true, rotate: true, found: true},
+		{name: "shared credentials", found: false},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		config := MaasBrokerConfig{Credentials: CredentialsConfig{BindingUsers: test.bindingUsers}}
+		b, server := newTestBroker(t, config)
+		instanceID, bindingID := uuid.NewRandom(), uuid.NewRandom()
+		serviceID, planID := uuid.Parse(QueueServiceUUID), uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid)
+		if _, err := b.Provision(ctx, instanceID, &ProvisionRequest{
+			OrganizationID: testInfraID,
+			ServiceID:      serviceID,
+			PlanID:         planID,
+			Parameters:     map[string]string{"name": "my-queue"},
+		}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		bind, err := b.Bind(ctx, instanceID, bindingID, &BindRequest{ServiceID: serviceID, PlanID: planID, Parameters: test.parameters})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		credentials := bind.Credentials
+		if test.rotate {
+			rotate, err := b.RotateCredentials(ctx, instanceID, bindingID)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			credentials = rotate.Credentials
+		}
+
+		restarted, err := NewMaasBroker(config, b.log, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binding, err := restarted.GetBinding(ctx, instanceID, bindingID)
+		if !test.found {
+			if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusNotFound {
+				t.Errorf("%s: expected status 404, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if binding.Credentials["username"] != credentials["username"] || binding.Credentials["password"] != credentials["password"] {
+			t.Errorf("%s: expected credentials %v, got %v", test.name, credentials, binding.Credentials)
+		}
+		if len(binding.Parameters) != len(test.parameters) || binding.Parameters["role"] != test.parameters["role"] {
+			t.Errorf("%s: expected parameters %v, got %v", test.name, test.parameters, binding.Parameters)
+		}
+
+		if _, err := restarted.Unbind(ctx, instanceID, bindingID, &UnbindRequest{}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if users := server.Users(testInfraID); len(users) != 0 {
+			t.Errorf("%s: expected unbinding to delete every user of the binding, got %v", test.name, users)
+		}
+	}
+}
+
+func TestValidateGroup(t *testing.T) {
+	queue := fakemaas.DefaultFlavors()[0]
+	tests := []struct {
+		name    string
+		group   string
+		flavor  string
+		failure bool
+		status  int
+	}{
+		{name: "no group"},
+		{name: "new group", group: "group2"},
+		{name: "existing group with the same flavor", group: "group1", flavor: queue.Metadata.Name},
+		{name: "existing group with another flavor", group: "group1", flavor: "small-persisted-queue", status: http.StatusBadRequest},
+		{name: "existing group with an unknown flavor", group: "group1", flavor: "retired-queue", status: http.StatusBadRequest},
+		{name: "backend failure", group: "group1", failure: true, status: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		server := fakemaas.NewServer(fakemaas.Options{
+			Flavors: append(fakemaas.DefaultFlavors(), fakemaas.NewFlavor("retired-queue", maas.Queue, "No longer offered")),
+		})
+		server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: testInfraID}})
+		b, err := NewMaasBroker(MaasBrokerConfig{}, logging.MustGetLogger("test"), server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.flavor != "" {
+			options := maas.AddressOptions{Group: "group1"}
+			if err := server.ProvisionAddress(ctx, testInfraID, uuid.NewRandom(), "existing", false, false, test.flavor, options); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if test.failure {
+			server.Fail(fakemaas.Failure{Method: http.MethodGet, PathPrefix: "/v3/instance/" + testInfraID + "/address", Status: http.StatusInternalServerError, Count: 1})
+		}
+
+		err = b.validateGroup(ctx, testInfraID, test.group, &queue)
+		switch test.status {
+		case 0:
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		case http.StatusBadRequest:
+			if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != test.status {
+				t.Errorf("%s: expected status %d, got %v", test.name, test.status, err)
+			}
+		default:
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+		}
+	}
+}
+
+func TestValidatePlan(t *testing.T) {
+	queue, topic := fakemaas.DefaultFlavors()[0], fakemaas.DefaultFlavors()[3]
+	tests := []struct {
+		name    string
+		service string
+		flavor  *maas.Flavor
+		group   string
+		valid   bool
+	}{
+		{name: "queue", service: QueueServiceUUID, flavor: &queue, valid: true},
+		{name: "queue in a group", service: QueueServiceUUID, flavor: &queue, group: "group1", valid: true},
+		{name: "queue with a topic plan", service: QueueServiceUUID, flavor: &topic},
+		{name: "queue with an unknown plan", service: QueueServiceUUID},
+		{name: "topic in a group", service: TopicServiceUUID, flavor: &topic, group: "group1", valid: true},
+		{name: "topic with a queue plan", service: TopicServiceUUID, flavor: &queue},
+		{name: "anycast", service: AnycastServiceUUID, valid: true},
+		{name: "anycast in a group", service: AnycastServiceUUID, group: "group1"},
+		{name: "multicast in a group", service: MulticastServiceUUID, group: "group1"},
+		{name: "invalid group name", service: QueueServiceUUID, flavor: &queue, group: "Group_1"},
+		{name: "group name too long", service: QueueServiceUUID, flavor: &queue, group: strings.Repeat("g", 64)},
+		{name: "unknown service", service: uuid.New()},
+	}
+
+	for _, test := range tests {
+		err := validatePlan(&ProvisionRequest{ServiceID: uuid.Parse(test.service), PlanID: uuid.NewRandom()}, test.flavor, test.group)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		} else if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %v", test.name, err)
+		}
+	}
+}
+
+func TestProvisionGroupWithUnknownPlan(t *testing.T) {
+	b, _ := newTestBroker(t, MaasBrokerConfig{})
+	_, err := b.Provision(context.Background(), uuid.NewRandom(), &ProvisionRequest{
+		OrganizationID: testInfraID,
+		ServiceID:      uuid.Parse(QueueServiceUUID),
+		PlanID:         uuid.NewRandom(),
+		Parameters:     map[string]string{"name": "my-queue", "group": "group1"},
+	})
+	if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", err)
+	}
+}
+
+func TestGetTemplateParameters(t *testing.T) {
+	flavor := fakemaas.NewFlavor("small-persisted-queue", maas.Queue, "Small queue with persistence")
+	flavor.Spec.TemplateParameters = map[string]string{"STORAGE_CAPACITY": "1Gi", "MEMORY": "256Mi"}
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		anycast    bool
+		overrides  map[string]string
+		valid      bool
+	}{
+		{name: "no parameters", valid: true},
+		{name: "reserved parameters", parameters: map[string]string{"name": "my-queue", "group": "group1"}, valid: true},
+		{name: "whitelisted parameter", parameters: map[string]string{"STORAGE_CAPACITY": "5Gi"}, overrides: map[string]string{"STORAGE_CAPACITY": "5Gi"}, valid: true},
+		{name: "invalid value", parameters: map[string]string{"STORAGE_CAPACITY": "5 gigabytes"}},
+		{name: "parameter not whitelisted", parameters: map[string]string{"MEMORY": "1Gi"}},
+		{name: "unknown parameter", parameters: map[string]string{"color": "blue"}, valid: true},
+		{name: "whitelisted parameter without flavor", parameters: map[string]string{"STORAGE_CAPACITY": "5Gi"}, anycast: true},
+	}
+
+	b, _ := newTestBroker(t, MaasBrokerConfig{TemplateParameters: map[string]string{"STORAGE_CAPACITY": "^[0-9]+[MG]i$"}})
+	for _, test := range tests {
+		var testFlavor *maas.Flavor
+		if !test.anycast {
+			testFlavor = &flavor
+		}
+		overrides, err := b.getTemplateParameters(test.parameters, testFlavor)
+		if !test.valid {
+			if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !sameParameters(overrides, test.overrides) {
+			t.Errorf("%s: expected overrides %v, got %v", test.name, test.overrides, overrides)
+		}
+	}
+}
+
+func TestPlanMetadata(t *testing.T) {
+	b, _ := newTestBroker(t, MaasBrokerConfig{TemplateParameters: map[string]string{"STORAGE_CAPACITY": ".*"}})
+	flavor := fakemaas.NewFlavor("small-persisted-queue", maas.Queue, "Small queue with persistence")
+	flavor.Spec.TemplateName = "queue-persisted"
+	flavor.Spec.TemplateParameters = map[string]string{"STORAGE_CAPACITY": "1Gi", "MEMORY": "256Mi"}
+
+	metadata := b.planMetadata(flavor)
+	if metadata["displayName"] != "small-persisted-queue" || metadata["templateName"] != "queue-persisted" {
+		t.Errorf("expected the flavor name and template, got %v", metadata)
+	}
+	if bullets := metadata["bullets"].([]string); len(bullets) != 2 || bullets[0] != "MEMORY: 256Mi" || bullets[1] != "STORAGE_CAPACITY: 1Gi" {
+		t.Errorf("expected sorted template parameters as bullets, got %v", bullets)
+	}
+	if overridable := metadata["overridableParameters"].([]string); len(overridable) != 1 || overridable[0] != "STORAGE_CAPACITY" {
+		t.Errorf("expected only the whitelisted parameter to be overridable, got %v", overridable)
+	}
+
+	metadata = b.planMetadata(fakemaas.NewFlavor("vanilla-queue", maas.Queue, "Simple in memory queue"))
+	if _, found := metadata["templateName"]; found {
+		t.Errorf("expected no template name, got %v", metadata)
+	}
+	if _, found := metadata["templateParameters"]; found {
+		t.Errorf("expected no template parameters, got %v", metadata)
+	}
+}
+
+func TestGetDuringOperation(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		binding   bool
+		status    int
+	}{
+		{name: "instance being provisioned", operation: OperationProvision, status: http.StatusNotFound},
+		{name: "instance being updated", operation: OperationUpdate, status: http.StatusUnprocessableEntity},
+		{name: "instance being bound", operation: OperationBind, status: http.StatusOK},
+		{name: "binding being created", operation: OperationBind, binding: true, status: http.StatusNotFound},
+		{name: "binding being deleted", operation: OperationUnbind, binding: true, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		b, _ := newTestBroker(t, MaasBrokerConfig{})
+		instanceID, bindingID := uuid.NewRandom(), uuid.NewRandom()
+		serviceID, planID := uuid.Parse(QueueServiceUUID), uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid)
+		if _, err := b.Provision(ctx, instanceID, &ProvisionRequest{
+			OrganizationID: testInfraID,
+			ServiceID:      serviceID,
+			PlanID:         planID,
+			Parameters:     map[string]string{"name": "my-queue"},
+		}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if _, err := b.Bind(ctx, instanceID, bindingID, &BindRequest{ServiceID: serviceID, PlanID: planID}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		operationBindingID := ""
+		switch {
+		case test.binding:
+			operationBindingID = bindingID.String()
+		case test.operation == OperationBind:
+			// another binding of the instance
+			operationBindingID = uuid.New()
+		}
+		operation, err := b.operations.start(test.operation, instanceID.String(), operationBindingID)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.binding {
+			_, err = b.GetBinding(ctx, instanceID, bindingID)
+		} else {
+			_, err = b.GetInstance(ctx, instanceID)
+		}
+		if test.status == http.StatusOK && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if brokerError, ok := err.(errors.BrokerError); test.status != http.StatusOK && (!ok || brokerError.Status != test.status) {
+			t.Errorf("%s: expected status %d, got %v", test.name, test.status, err)
+		}
+
+		b.operations.finish(operation, nil)
+		if test.binding {
+			_, err = b.GetBinding(ctx, instanceID, bindingID)
+		} else {
+			_, err = b.GetInstance(ctx, instanceID)
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v once the operation finished", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+)
+
+type CredentialsConfig struct {
+	AmqpPort  int
+	AmqpsPort int
+	MqttPort  int
+	MqttsPort int
+	// CACertFile is a PEM file returned as the CA certificate of instances for which the address
+	// controller does not report one.
+	CACertFile string
+	// Templates defines named credential formats. Each format maps the keys of the returned credentials
+	// to a text/template rendered with the instance, the address and the default credentials.
+	Templates map[string]map[string]string
+	// Formats selects the format used for bindings of a service (by service name) that do not request
+	// one through the "format" bind parameter.
+	Formats map[string]string
+	// BindingUsers creates a messaging user per binding, restricted by the "role" bind parameter to the
+	// bound address. It requires an address controller serving /v3/instance/{id}/user. Otherwise bindings
+	// only return the connection details of the infrastructure instance, whose credentials are shared.
+	BindingUsers bool
+}
+
+// credentialsData is the data credential templates are rendered with.
+type credentialsData struct {
+	Instance    maas.Instance
+	Address     maas.Address
+	Credentials map[string]interface{}
+}
+
+const (
+	defaultAmqpPort  = 5672
+	defaultAmqpsPort = 5671
+	defaultMqttPort  = 1883
+	defaultMqttsPort = 8883
+)
+
+const (
+	RoleSend        = "send"
+	RoleReceive     = "receive"
+	RoleSendReceive = "send+receive"
+	RoleManage      = "manage"
+)
+
+// roleOperations maps the roles a binding can request to the operations they authorise on the bound address.
+var roleOperations = map[string][]string{
+	RoleSend:        {"send"},
+	RoleReceive:     {"recv"},
+	RoleSendReceive: {"send", "recv"},
+	RoleManage:      {"send", "recv", "manage"},
+}
+
+// credentialsBuilder derives the connection details handed out to applications from a MaaS
+// instance and the address provisioned in it.
+type credentialsBuilder struct {
+	amqpPort  int
+	amqpsPort int
+	mqttPort  int
+	mqttsPort int
+	caCert    string
+	templates map[string]map[string]*template.Template
+	formats   map[string]string
+}
+
+func newCredentialsBuilder(config CredentialsConfig) (*credentialsBuilder, error) {
+	builder := &credentialsBuilder{
+		amqpPort:  portOrDefault(config.AmqpPort, defaultAmqpPort),
+		amqpsPort: portOrDefault(config.AmqpsPort, defaultAmqpsPort),
+		mqttPort:  portOrDefault(config.MqttPort, defaultMqttPort),
+		mqttsPort: portOrDefault(config.MqttsPort, defaultMqttsPort),
+		templates: make(map[string]map[string]*template.Template),
+		formats:   config.Formats,
+	}
+
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate: %v", err)
+		}
+		builder.caCert = string(pem)
+	}
+
+	for format, keys := range config.Templates {
+		builder.templates[format] = make(map[string]*template.Template)
+		for key, text := range keys {
+			tmpl, err := template.New(format + "/" + key).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid credentials template %s/%s: %v", format, key, err)
+			}
+			builder.templates[format][key] = tmpl
+		}
+	}
+
+	for service, format := range config.Formats {
+		if _, found := builder.templates[format]; !found {
+			return nil, fmt.Errorf("unknown credentials format %s for service %s", format, service)
+		}
+	}
+
+	return builder, nil
+}
+
+// render returns the credentials in the requested format, including the user of the binding unless it is
+// nil. Without a requested format, the format configured for the address' service is used, falling back to
+// the default credentials.
+func (c *credentialsBuilder) render(format string, instance *maas.Instance, address *maas.Address, role string, user *maas.User) (map[string]interface{}, error) {
+	credentials := c.build(instance, address, role, user)
+
+	if format == "" {
+		format = c.formats[getServiceName(getServiceID(address))]
+		if format == "" {
+			return credentials, nil
+		}
+	}
+
+	templates, found := c.templates[format]
+	if !found {
+		return nil, errors.NewBadRequest("Unknown credentials format " + format)
+	}
+
+	data := credentialsData{
+		Instance:    *instance,
+		Address:     *address,
+		Credentials: credentials,
+	}
+
+	rendered := make(map[string]interface{})
+	for key, tmpl := range templates {
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, data); err != nil {
+			return nil, fmt.Errorf("could not render credentials template %s/%s: %v", format, key, err)
+		}
+		rendered[key] = buf.String()
+	}
+	return rendered, nil
+}
+
+func (c *credentialsBuilder) build(instance *maas.Instance, address *maas.Address, role string, user *maas.User) map[string]interface{} {
+	credentials := make(map[string]interface{})
+	credentials["messagingHost"] = instance.Spec.MessagingHost
+	credentials["mqttHost"] = instance.Spec.MQTTHost
+	credentials["consoleHost"] = instance.Spec.ConsoleHost
+	credentials["namespace"] = instance.Spec.Namespace
+
+	credentials["addressName"] = address.Metadata.Name
+	credentials["addressType"] = getAddressType(address)
+
+	if user != nil {
+		credentials["username"] = user.Metadata.Name
+		credentials["password"] = user.Spec.Password
+		credentials["role"] = role
+	}
+
+	if instance.Spec.MessagingHost != "" {
+		credentials["amqpPort"] = c.amqpPort
+		credentials["amqpsPort"] = c.amqpsPort
+		credentials["amqpUri"] = fmt.Sprintf("amqp://%s:%d/%s", instance.Spec.MessagingHost, c.amqpPort, address.Metadata.Name)
+		credentials["amqpsUri"] = fmt.Sprintf("amqps://%s:%d/%s", instance.Spec.MessagingHost, c.amqpsPort, address.Metadata.Name)
+	}
+	if instance.Spec.MQTTHost != "" {
+		credentials["mqttPort"] = c.mqttPort
+		credentials["mqttsPort"] = c.mqttsPort
+		credentials["mqttUri"] = fmt.Sprintf("mqtt://%s:%d", instance.Spec.MQTTHost, c.mqttPort)
+		credentials["mqttsUri"] = fmt.Sprintf("mqtts://%s:%d", instance.Spec.MQTTHost, c.mqttsPort)
+	}
+	// Shared credentials (no role) grant console access, while binding users only do with the manage role.
+	if instance.Spec.ConsoleHost != "" && (role == "" || role == RoleManage) {
+		credentials["consoleUri"] = "https://" + instance.Spec.ConsoleHost + "/"
+	}
+
+	if instance.Spec.CACert != "" {
+		credentials["caCert"] = instance.Spec.CACert
+	} else if c.caCert != "" {
+		credentials["caCert"] = c.caCert
+	}
+
+	return credentials
+}
+
+// ParameterLabelPrefix prefixes the labels recording the bind parameters on the users of bindings.
+const ParameterLabelPrefix = "enmasse.io/parameter-"
+
+// newBindingUser creates a messaging user restricted to the operations of role on the bound address. The user
+// is labelled with its instance and the bind parameters, from which bindingFromUsers reconstructs the binding.
+func newBindingUser(bindingID string, role string, address *maas.Address, parameters map[string]string) (*maas.User, error) {
+	operations, found := roleOperations[role]
+	if !found {
+		return nil, errors.NewBadRequest("Invalid role " + role + ": must be one of send, receive, send+receive or manage")
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{UserInstanceLabel: address.Metadata.Uuid}
+	for key, value := range parameters {
+		labels[ParameterLabelPrefix+key] = value
+	}
+	return &maas.User{
+		Metadata: maas.Metadata{
+			Name:   "binding-" + bindingID,
+			Uuid:   bindingID,
+			Labels: labels,
+		},
+		Spec: maas.UserSpec{
+			Password: password,
+			Authorization: []maas.Authorization{{
+				Addresses:  []string{address.Metadata.Name},
+				Operations: operations,
+			}},
+		},
+	}, nil
+}
+
+// bindingFromUsers reconstructs a binding from the users of its instance, returning nil if it has none. The
+// current user is the one no other user of the binding revokes.
+func bindingFromUsers(instanceID string, bindingID string, users []maas.User) (*BindingRecord, *maas.User) {
+	var owned []maas.User
+	retired := make(map[string]bool)
+	for _, user := range users {
+		if user.Metadata.Uuid == bindingID && user.Metadata.Labels[UserInstanceLabel] == instanceID {
+			owned = append(owned, user)
+			if revokes := user.Metadata.Labels[RevokesLabel]; revokes != "" {
+				retired[revokes] = true
+			}
+		}
+	}
+
+	binding := &BindingRecord{
+		BindingID:        bindingID,
+		InstanceID:       instanceID,
+		Parameters:       make(map[string]string),
+		RetiredUsernames: []string{},
+	}
+	var current *maas.User
+	for i, user := range owned {
+		if retired[user.Metadata.Name] {
+			binding.RetiredUsernames = append(binding.RetiredUsernames, user.Metadata.Name)
+			continue
+		}
+		current = &owned[i]
+	}
+	if current == nil {
+		return nil, nil
+	}
+
+	binding.Username = current.Metadata.Name
+	fmt.Sscanf(strings.TrimPrefix(current.Metadata.Name, "binding-"+bindingID), "-%d", &binding.Generation)
+	for key, value := range current.Metadata.Labels {
+		if strings.HasPrefix(key, ParameterLabelPrefix) {
+			binding.Parameters[strings.TrimPrefix(key, ParameterLabelPrefix)] = value
+		}
+	}
+	return binding, current
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate password: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getAddressType(address *maas.Address) string {
+	switch getServiceID(address) {
+	case QueueServiceUUID:
+		return "queue"
+	case TopicServiceUUID:
+		return "topic"
+	case MulticastServiceUUID:
+		return "multicast"
+	default:
+		return "anycast"
+	}
+}
+
+func portOrDefault(port int, defaultPort int) int {
+	if port == 0 {
+		return defaultPort
+	}
+	return port
+}
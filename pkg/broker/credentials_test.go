@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+)
+
+func TestBuildCredentials(t *testing.T) {
+	dir := t.TempDir()
+	caCertFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caCertFile, []byte("configured CA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		config   CredentialsConfig
+		spec     maas.InstanceSpec
+		role     string
+		expected map[string]interface{}
+		absent   []string
+	}{
+		{
+			name: "default ports",
+			spec: maas.InstanceSpec{MessagingHost: "messaging.example.com", MQTTHost: "mqtt.example.com"},
+			expected: map[string]interface{}{
+				"amqpPort":  defaultAmqpPort,
+				"amqpsPort": defaultAmqpsPort,
+				"amqpUri":   "amqp://messaging.example.com:5672/my-queue",
+				"amqpsUri":  "amqps://messaging.example.com:5671/my-queue",
+				"mqttPort":  defaultMqttPort,
+				"mqttsPort": defaultMqttsPort,
+				"mqttUri":   "mqtt://mqtt.example.com:1883",
+				"mqttsUri":  "mqtts://mqtt.example.com:8883",
+			},
+		},
+		{
+			name:   "configured ports",
+			config: CredentialsConfig{AmqpPort: 15672, AmqpsPort: 15671, MqttPort: 11883, MqttsPort: 18883},
+			spec:   maas.InstanceSpec{MessagingHost: "messaging.example.com", MQTTHost: "mqtt.example.com"},
+			expected: map[string]interface{}{
+				"amqpUri":  "amqp://messaging.example.com:15672/my-queue",
+				"amqpsUri": "amqps://messaging.example.com:15671/my-queue",
+				"mqttUri":  "mqtt://mqtt.example.com:11883",
+				"mqttsUri": "mqtts://mqtt.example.com:18883",
+			},
+		},
+		{
+			name:   "no hosts",
+			absent: []string{"amqpPort", "amqpUri", "amqpsUri", "mqttPort", "mqttUri", "mqttsUri", "consoleUri", "caCert"},
+		},
+		{
+			name:     "console with shared credentials",
+			spec:     maas.InstanceSpec{ConsoleHost: "console.example.com"},
+			expected: map[string]interface{}{"consoleHost": "console.example.com", "consoleUri": "https://console.example.com/"},
+		},
+		{
+			name:     "console of a manage binding",
+			spec:     maas.InstanceSpec{ConsoleHost: "console.example.com"},
+			role:     RoleManage,
+			expected: map[string]interface{}{"consoleHost": "console.example.com", "consoleUri": "https://console.example.com/"},
+		},
+		{
+			name:     "console of a send binding",
+			spec:     maas.InstanceSpec{ConsoleHost: "console.example.com"},
+			role:     RoleSend,
+			expected: map[string]interface{}{"consoleHost": "console.example.com"},
+			absent:   []string{"consoleUri"},
+		},
+		{
+			name:     "console of a receive binding",
+			spec:     maas.InstanceSpec{ConsoleHost: "console.example.com"},
+			role:     RoleReceive,
+			expected: map[string]interface{}{"consoleHost": "console.example.com"},
+			absent:   []string{"consoleUri"},
+		},
+		{
+			name:     "console of a send+receive binding",
+			spec:     maas.InstanceSpec{ConsoleHost: "console.example.com"},
+			role:     RoleSendReceive,
+			expected: map[string]interface{}{"consoleHost": "console.example.com"},
+			absent:   []string{"consoleUri"},
+		},
+		{
+			name:     "instance CA certificate",
+			config:   CredentialsConfig{CACertFile: caCertFile},
+			spec:     maas.InstanceSpec{CACert: "instance CA"},
+			expected: map[string]interface{}{"caCert": "instance CA"},
+		},
+		{
+			name:     "configured CA certificate",
+			config:   CredentialsConfig{CACertFile: caCertFile},
+			expected: map[string]interface{}{"caCert": "configured CA"},
+		},
+	}
+
+	address := &maas.Address{Metadata: maas.Metadata{Name: "my-queue"}, Spec: maas.AddressSpec{StoreAndForward: true}}
+	for _, test := range tests {
+		builder, err := newCredentialsBuilder(test.config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		credentials := builder.build(&maas.Instance{Spec: test.spec}, address, test.role, nil)
+		if credentials["addressName"] != "my-queue" || credentials["addressType"] != "queue" {
+			t.Errorf("%s: expected the address in the credentials, got %v", test.name, credentials)
+		}
+		for key, value := range test.expected {
+			if credentials[key] != value {
+				t.Errorf("%s: expected %s %v, got %v", test.name, key, value, credentials[key])
+			}
+		}
+		for _, key := range test.absent {
+			if value, found := credentials[key]; found {
+				t.Errorf("%s: expected no %s, got %v", test.name, key, value)
+			}
+		}
+	}
+}
+
+func TestRenderCredentials(t *testing.T) {
+	config := CredentialsConfig{
+		Templates: map[string]map[string]string{
+			"spring": {
+				"spring.rabbitmq.host":    "{{.Instance.Spec.MessagingHost}}",
+				"spring.rabbitmq.address": "{{.Address.Metadata.Name}}",
+				"spring.rabbitmq.port":    "{{.Credentials.amqpPort}}",
+			},
+			"paho": {
+				"uri": "{{.Credentials.mqttUri}}",
+			},
+		},
+		Formats: map[string]string{QueueServiceName: "spring"},
+	}
+	tests := []struct {
+		name     string
+		format   string
+		address  maas.AddressSpec
+		expected map[string]interface{}
+		status   int
+		failure  bool
+	}{
+		{
+			name:     "format of the service",
+			address:  maas.AddressSpec{StoreAndForward: true},
+			expected: map[string]interface{}{"spring.rabbitmq.host": "messaging.example.com", "spring.rabbitmq.address": "my-address", "spring.rabbitmq.port": "5672"},
+		},
+		{
+			name:     "no format for the service",
+			expected: map[string]interface{}{"addressName": "my-address", "amqpUri": "amqp://messaging.example.com:5672/my-address"},
+		},
+		{
+			name:     "requested format",
+			format:   "spring",
+			expected: map[string]interface{}{"spring.rabbitmq.address": "my-address"},
+		},
+		{name: "unknown format", format: "jndi", failure: true, status: http.StatusBadRequest},
+		{name: "missing key", format: "paho", failure: true},
+	}
+
+	builder, err := newCredentialsBuilder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := &maas.Instance{Spec: maas.InstanceSpec{MessagingHost: "messaging.example.com"}}
+	for _, test := range tests {
+		address := &maas.Address{Metadata: maas.Metadata{Name: "my-address"}, Spec: test.address}
+		credentials, err := builder.render(test.format, instance, address, "", nil)
+		if test.failure {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, credentials)
+			} else if brokerError, ok := err.(errors.BrokerError); test.status != 0 && (!ok || brokerError.Status != test.status) {
+				t.Errorf("%s: expected status %d, got %v", test.name, test.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		for key, value := range test.expected {
+			if credentials[key] != value {
+				t.Errorf("%s: expected %s %v, got %v", test.name, key, value, credentials[key])
+			}
+		}
+	}
+}
+
+func TestNewCredentialsBuilder(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CredentialsConfig
+		valid  bool
+	}{
+		{name: "no templates", valid: true},
+		{name: "valid template", config: CredentialsConfig{Templates: map[string]map[string]string{"paho": {"uri": "{{.Credentials.mqttUri}}"}}}, valid: true},
+		{name: "invalid template", config: CredentialsConfig{Templates: map[string]map[string]string{"paho": {"uri": "{{.Credentials.mqttUri"}}}},
+		{name: "unknown format of a service", config: CredentialsConfig{Formats: map[string]string{QueueServiceName: "spring"}}},
+		{name: "missing CA certificate", config: CredentialsConfig{CACertFile: "/nonexistent/ca.crt"}},
+	}
+
+	for _, test := range tests {
+		_, err := newCredentialsBuilder(test.config)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+)
+
+type DashboardConfig struct {
+	// Path is appended to the console host of an instance to build its dashboard URL. The {address}
+	// placeholder is replaced by the name of the provisioned address.
+	Path string
+	// Clients are the OAuth clients published in the catalog for dashboard SSO, keyed by service name.
+	Clients map[string]DashboardClient
+}
+
+const defaultDashboardPath = "/#/addresses?filter={address}"
+
+// dashboardURL points to the EnMasse console of the instance, filtered to the given address.
+func (b MaasBroker) dashboardURL(instance *maas.Instance, addressName string) string {
+	if instance == nil || instance.Spec.ConsoleHost == "" {
+		return ""
+	}
+	path := b.dashboard.Path
+	if path == "" {
+		path = defaultDashboardPath
+	}
+	return "https://" + instance.Spec.ConsoleHost + strings.Replace(path, "{address}", url.QueryEscape(addressName), -1)
+}
+
+func (b MaasBroker) dashboardClient(serviceName string) *DashboardClient {
+	client, found := b.dashboard.Clients[serviceName]
+	if !found {
+		return nil
+	}
+	return &client
+}
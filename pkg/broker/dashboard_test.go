@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+)
+
+func TestDashboardURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		instance *maas.Instance
+		address  string
+		url      string
+	}{
+		{name: "default path", instance: &maas.Instance{Spec: maas.InstanceSpec{ConsoleHost: "console.example.com"}}, address: "my-queue", url: "https://console.example.com/#/addresses?filter=my-queue"},
+		{name: "configured path", path: "/console/{address}/overview", instance: &maas.Instance{Spec: maas.InstanceSpec{ConsoleHost: "console.example.com"}}, address: "my-queue", url: "https://console.example.com/console/my-queue/overview"},
+		{name: "path without placeholder", path: "/", instance: &maas.Instance{Spec: maas.InstanceSpec{ConsoleHost: "console.example.com"}}, address: "my-queue", url: "https://console.example.com/"},
+		{name: "escaped address name", instance: &maas.Instance{Spec: maas.InstanceSpec{ConsoleHost: "console.example.com"}}, address: "orders/eu west&new", url: "https://console.example.com/#/addresses?filter=orders%2Feu+west%26new"},
+		{name: "no console host", instance: &maas.Instance{}, address: "my-queue"},
+		{name: "unknown instance", address: "my-queue"},
+	}
+
+	for _, test := range tests {
+		b := MaasBroker{dashboard: DashboardConfig{Path: test.path}}
+		if url := b.dashboardURL(test.instance, test.address); url != test.url {
+			t.Errorf("%s: expected dashboard URL %q, got %q", test.name, test.url, url)
+		}
+	}
+}
+
+func TestDashboardClient(t *testing.T) {
+	b := MaasBroker{dashboard: DashboardConfig{Clients: map[string]DashboardClient{
+		QueueServiceName: {ID: "queue-console", Secret: "secret", RedirectURI: "https://console.example.com/oauth"},
+	}}}
+	if client := b.dashboardClient(QueueServiceName); client == nil || client.ID != "queue-console" {
+		t.Errorf("expected the client of the queue service, got %v", client)
+	}
+	if client := b.dashboardClient(TopicServiceName); client != nil {
+		t.Errorf("expected no client for the topic service, got %v", client)
+	}
+}
@@ -0,0 +1,36 @@
+package broker
+
+import (
+	"context"
+)
+
+// OriginatingIdentity identifies the platform user on whose behalf the broker is called.
+type OriginatingIdentity struct {
+	Platform string
+	Value    map[string]interface{}
+}
+
+// User returns the name of the user on its platform: the username on Kubernetes, the user ID on Cloud Foundry.
+func (i *OriginatingIdentity) User() string {
+	if i == nil {
+		return ""
+	}
+	for _, key := range []string{"username", "user_id"} {
+		if user, ok := i.Value[key].(string); ok {
+			return user
+		}
+	}
+	return ""
+}
+
+type identityKey struct{}
+
+func WithOriginatingIdentity(ctx context.Context, identity *OriginatingIdentity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// GetOriginatingIdentity returns the identity carried by ctx, or nil if the request did not include one.
+func GetOriginatingIdentity(ctx context.Context) *OriginatingIdentity {
+	identity, _ := ctx.Value(identityKey{}).(*OriginatingIdentity)
+	return identity
+}
@@ -0,0 +1,32 @@
+package broker
+
+// The methods below expose what the broker keeps track of to the admin API.
+
+// Instances returns the instances tracked by the broker, sorted by ID.
+func (b MaasBroker) Instances() []InstanceRecord {
+	instances := []InstanceRecord{}
+	for _, instance := range b.store.listInstances() {
+		instances = append(instances, *instance)
+	}
+	return instances
+}
+
+// Bindings returns the bindings tracked by the broker, sorted by ID. Their credentials are not serialised.
+func (b MaasBroker) Bindings() []BindingRecord {
+	bindings := []BindingRecord{}
+	for _, binding := range b.store.listBindings() {
+		bindings = append(bindings, *binding)
+	}
+	return bindings
+}
+
+// Operations returns the last asynchronous operation of every instance and binding, the most recently
+// started first.
+func (b MaasBroker) Operations() []Operation {
+	return b.operations.list()
+}
+
+// Tenancy returns the policy mapping service instances to infrastructure instances.
+func (b MaasBroker) Tenancy() TenancyPolicy {
+	return b.tenancy
+}
@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"sync"
+)
+
+// keyedLock serialises operations sharing the same key (e.g. a service instance UUID),
+// while operations on different keys proceed in parallel.
+type keyedLock struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+func newKeyedLock() *keyedLock {
+	return &keyedLock{
+		locks: make(map[string]*keyLock),
+	}
+}
+
+// Lock blocks until no other operation holds the lock for key and returns the function releasing it.
+func (l *keyedLock) Lock(key string) func() {
+	k := l.ref(key)
+	k.sem <- struct{}{}
+	return func() {
+		<-k.sem
+		l.unref(key, k)
+	}
+}
+
+// TryLock acquires the lock for key only if it is free. The returned bool is false if another operation holds it.
+func (l *keyedLock) TryLock(key string) (func(), bool) {
+	k := l.ref(key)
+	select {
+	case k.sem <- struct{}{}:
+		return func() {
+			<-k.sem
+			l.unref(key, k)
+		}, true
+	default:
+		l.unref(key, k)
+		return nil, false
+	}
+}
+
+func (l *keyedLock) ref(key string) *keyLock {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	k, found := l.locks[key]
+	if !found {
+		k = &keyLock{sem: make(chan struct{}, 1)}
+		l.locks[key] = k
+	}
+	k.refs++
+	return k
+}
+
+func (l *keyedLock) unref(key string, k *keyLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	k.refs--
+	if k.refs == 0 {
+		delete(l.locks, key)
+	}
+}
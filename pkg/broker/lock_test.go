@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTryLock(t *testing.T) {
+	tests := []struct {
+		name     string
+		held     string
+		key      string
+		acquired bool
+	}{
+		{name: "free key", key: "a", acquired: true},
+		{name: "held key", held: "a", key: "a", acquired: false},
+		{name: "other key held", held: "b", key: "a", acquired: true},
+	}
+
+	for _, test := range tests {
+		l := newKeyedLock()
+		if test.held != "" {
+			defer l.Lock(test.held)()
+		}
+		unlock, ok := l.TryLock(test.key)
+		if ok != test.acquired {
+			t.Errorf("%s: expected TryLock to return %t, got %t", test.name, test.acquired, ok)
+		}
+		if ok {
+			unlock()
+		}
+	}
+}
+
+func TestLockReleasesKeys(t *testing.T) {
+	l := newKeyedLock()
+	unlock := l.Lock("a")
+	if _, ok := l.TryLock("a"); ok {
+		t.Fatal("expected the lock to be held")
+	}
+	unlock()
+
+	unlock, ok := l.TryLock("a")
+	if !ok {
+		t.Fatal("expected the lock to be free after unlocking")
+	}
+	unlock()
+	if len(l.locks) != 0 {
+		t.Errorf("expected unused keys to be forgotten, got %v", l.locks)
+	}
+}
+
+func TestLockSerialises(t *testing.T) {
+	l := newKeyedLock()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	holders, maxHolders := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := l.Lock("a")
+			defer unlock()
+
+			mutex.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mutex.Unlock()
+			time.Sleep(time.Millisecond)
+			mutex.Lock()
+			holders--
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders != 1 {
+		t.Errorf("expected one holder at a time, got %d", maxHolders)
+	}
+	if len(l.locks) != 0 {
+		t.Errorf("expected unused keys to be forgotten, got %v", l.locks)
+	}
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/pborman/uuid"
+)
+
+const (
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+	OperationBind        = "bind"
+	OperationUnbind      = "unbind"
+	OperationRotate      = "rotate"
+)
+
+// Operation is an asynchronous operation on a service instance or binding.
+type Operation struct {
+	ID          string             `json:"id"`
+	Type        string             `json:"type"`
+	InstanceID  string             `json:"instance_id"`
+	BindingID   string             `json:"binding_id,omitempty"`
+	State       LastOperationState `json:"state"`
+	Description string             `json:"description,omitempty"`
+	Started     time.Time          `json:"started"`
+	Finished    time.Time          `json:"finished,omitempty"`
+}
+
+// operationTracker remembers the last asynchronous operation of every instance and binding.
+type operationTracker struct {
+	mutex      sync.Mutex
+	operations map[string]*Operation
+	// observers are called with every finished operation
+	observers []func(Operation)
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{
+		operations: make(map[string]*Operation),
+	}
+}
+
+// start records a new operation in progress. Only one operation may be in progress per service instance,
+// including the operations on its bindings.
+func (t *operationTracker) start(operationType string, instanceID string, bindingID string) (*Operation, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.inProgressLocked(instanceID) {
+		return nil, errors.NewConcurrencyError(instanceID)
+	}
+
+	operation := &Operation{
+		ID:         uuid.New(),
+		Type:       operationType,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		State:      LastOperationStateInProgress,
+		Started:    time.Now(),
+	}
+	t.operations[operationKey(instanceID, bindingID)] = operation
+	return operation, nil
+}
+
+// update describes the progress of an operation.
+func (t *operationTracker) update(operation *Operation, description string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	operation.Description = description
+}
+
+// observe registers f to be called with every operation that finishes.
+func (t *operationTracker) observe(f func(Operation)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.observers = append(t.observers, f)
+}
+
+func (t *operationTracker) finish(operation *Operation, err error) {
+	t.mutex.Lock()
+	operation.Finished = time.Now()
+	if err != nil {
+		operation.State = LastOperationStateFailed
+		operation.Description = err.Error()
+	} else {
+		operation.State = LastOperationStateSucceeded
+		operation.Description = ""
+	}
+	finished := *operation
+	observers := t.observers
+	t.mutex.Unlock()
+
+	for _, observer := range observers {
+		observer(finished)
+	}
+}
+
+// get returns a copy of the last operation of an instance (with an empty bindingID) or binding.
+func (t *operationTracker) get(instanceID string, bindingID string) *Operation {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	operation, found := t.operations[operationKey(instanceID, bindingID)]
+	if !found {
+		return nil
+	}
+	copied := *operation
+	return &copied
+}
+
+// list returns copies of the operations, the most recently started first.
+func (t *operationTracker) list() []Operation {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	operations := make([]Operation, 0, len(t.operations))
+	for _, operation := range t.operations {
+		operations = append(operations, *operation)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].Started.After(operations[j].Started) })
+	return operations
+}
+
+// forget deletes the operations of an instance and its bindings.
+func (t *operationTracker) forget(instanceID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, operation := range t.operations {
+		if operation.InstanceID == instanceID {
+			delete(t.operations, key)
+		}
+	}
+}
+
+func (t *operationTracker) inProgress(instanceID string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.inProgressLocked(instanceID)
+}
+
+func (t *operationTracker) inProgressLocked(instanceID string) bool {
+	for _, operation := range t.operations {
+		if operation.InstanceID == instanceID && operation.State == LastOperationStateInProgress {
+			return true
+		}
+	}
+	return false
+}
+
+func operationKey(instanceID string, bindingID string) string {
+	if bindingID == "" {
+		return "instance/" + instanceID
+	}
+	return "binding/" + bindingID
+}
@@ -0,0 +1,97 @@
+package broker
+
+import (
+	goerrors "errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+)
+
+func TestOperationConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  []string
+		finished []string
+		instance string
+		binding  string
+		conflict bool
+	}{
+		{name: "no operation", instance: "i1"},
+		{name: "instance operation in progress", running: []string{"i1/"}, instance: "i1", conflict: true},
+		{name: "binding operation in progress", running: []string{"i1/b1"}, instance: "i1", binding: "b2", conflict: true},
+		{name: "instance operation blocks bindings", running: []string{"i1/"}, instance: "i1", binding: "b1", conflict: true},
+		{name: "other instance", running: []string{"i2/b1"}, instance: "i1", binding: "b2"},
+		{name: "finished operation", finished: []string{"i1/", "i1/b1"}, instance: "i1", binding: "b1"},
+	}
+
+	for _, test := range tests {
+		tracker := newOperationTracker()
+		for _, key := range test.running {
+			instanceID, bindingID := splitKey(key)
+			if _, err := tracker.start(OperationBind, instanceID, bindingID); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		for _, key := range test.finished {
+			instanceID, bindingID := splitKey(key)
+			operation, err := tracker.start(OperationBind, instanceID, bindingID)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			tracker.finish(operation, nil)
+		}
+
+		if inProgress := tracker.inProgress(test.instance); inProgress != test.conflict {
+			t.Errorf("%s: expected inProgress to return %t, got %t", test.name, test.conflict, inProgress)
+		}
+		_, err := tracker.start(OperationUnbind, test.instance, test.binding)
+		if test.conflict {
+			if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected a concurrency error, got %v", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestOperationStates(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		state       LastOperationState
+		description string
+	}{
+		{name: "succeeded", state: LastOperationStateSucceeded},
+		{name: "failed", err: goerrors.New("no capacity"), state: LastOperationStateFailed, description: "no capacity"},
+	}
+
+	for _, test := range tests {
+		tracker := newOperationTracker()
+		operation, err := tracker.start(OperationProvision, "i1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracker.update(operation, "waiting")
+		if got := tracker.get("i1", ""); got.State != LastOperationStateInProgress || got.Description != "waiting" {
+			t.Errorf("%s: expected the operation to be in progress, got %v", test.name, got)
+		}
+
+		tracker.finish(operation, test.err)
+		got := tracker.get("i1", "")
+		if got.ID != operation.ID || got.State != test.state || got.Description != test.description || got.Finished.IsZero() {
+			t.Errorf("%s: unexpected operation %v", test.name, got)
+		}
+		if tracker.get("i1", "b1") != nil {
+			t.Errorf("%s: expected no binding operation", test.name)
+		}
+	}
+}
+
+// splitKey splits "instance/binding" test keys.
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1]
+}
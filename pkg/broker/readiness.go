@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/pborman/uuid"
+)
+
+const (
+	defaultReadinessTimeout      = 5 * time.Minute
+	defaultReadinessPollInterval = 2 * time.Second
+)
+
+// ReadinessConfig controls how long asynchronous provisioning waits for the routers and brokers of an
+// address to become ready.
+type ReadinessConfig struct {
+	// Timeout is how long an address may take to become ready before provisioning fails.
+	Timeout time.Duration
+	// FlavorTimeouts overrides Timeout for the addresses of the given flavors, e.g. persisted queues
+	// that take longer to deploy.
+	FlavorTimeouts map[string]time.Duration
+	// PollInterval is how often the address controller is asked for the status of an address.
+	PollInterval time.Duration
+}
+
+func (c ReadinessConfig) timeout(flavor string) time.Duration {
+	if timeout, found := c.FlavorTimeouts[flavor]; found {
+		return timeout
+	}
+	return c.Timeout
+}
+
+// awaitReady polls the status of a newly provisioned address until it is ready, finishing the provisioning
+// operation, which fails if the address is deleted or does not become ready within the flavor's timeout.
+// While the address is not ready, the messages of the address controller describe the operation.
+func (b MaasBroker) awaitReady(ctx context.Context, operation *Operation, infraID string, instanceUUID uuid.UUID, flavor string) {
+	log := reqctx.Logger(ctx, b.log)
+	timeout := b.readiness.timeout(flavor)
+	deadline := time.Now().Add(timeout)
+	var address *maas.Address
+	for {
+		found, err := maas.GetAddress(ctx, b.backend, infraID, instanceUUID)
+		if err != nil {
+			log.Warningf("Could not determine the status of address %s: %v", instanceUUID.String(), err)
+		} else if found == nil {
+			b.operations.finish(operation, fmt.Errorf("Address was deleted before becoming ready"))
+			return
+		} else if found.IsReady() {
+			log.Infof("Address %s is ready", found.Metadata.Name)
+			b.operations.finish(operation, nil)
+			return
+		} else {
+			address = found
+			b.operations.update(operation, describeStatus(address))
+		}
+
+		if time.Now().After(deadline) {
+			description := "Address not ready"
+			if address != nil {
+				description = describeStatus(address)
+			}
+			log.Warningf("Address %s not ready after %s: %s", instanceUUID.String(), timeout, description)
+			b.operations.finish(operation, fmt.Errorf("%s after %s", description, timeout))
+			return
+		}
+		time.Sleep(b.readiness.PollInterval)
+	}
+}
+
+// describeStatus summarises why an address is not ready.
+func describeStatus(address *maas.Address) string {
+	if address.Status == nil || len(address.Status.Messages) == 0 {
+		return "Address " + address.Metadata.Name + " is not ready"
+	}
+	return "Address " + address.Metadata.Name + " is not ready: " + strings.Join(address.Status.Messages, "; ")
+}
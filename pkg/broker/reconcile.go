@@ -0,0 +1,291 @@
+package broker
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+// reconcilerMetrics publishes the number of reconciliations (runs) and of those that failed (failures),
+// the orphaned and missing addresses found by the last one (orphans, missing), and the number of repairs.
+var reconcilerMetrics = expvar.NewMap("reconciler")
+
+const (
+	RepairAdopted   = "adopted"
+	RepairRecreated = "recreated"
+)
+
+type ReconcilerConfig struct {
+	// Interval is the time between periodic reconciliations, which are disabled if zero.
+	Interval time.Duration
+	// Repair makes periodic reconciliations repair the drift they find: missing addresses are re-created,
+	// and orphaned addresses are adopted as instances of the broker. Orphans are never deleted: the broker
+	// only remembers the instances provisioned or adopted since it started, so a restarted broker sees every
+	// existing address as an orphan until it has been adopted.
+	Repair bool
+}
+
+// Drift is an address the broker and the address controller disagree on.
+type Drift struct {
+	InstanceID string `json:"instance_id"`
+	InfraID    string `json:"infra_id"`
+	Address    string `json:"address"`
+	// Repair is how the drift was repaired, or why repairing it failed.
+	Repair string `json:"repair,omitempty"`
+}
+
+// ReconcileReport is the outcome of a reconciliation.
+type ReconcileReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Repair   bool      `json:"repair"`
+	// Orphans are addresses whose UUID is not an instance of the broker.
+	Orphans []Drift `json:"orphans"`
+	// Missing are instances of the broker whose address does not exist.
+	Missing []Drift `json:"missing"`
+	// Errors are the infrastructure instances whose addresses could not be listed, and failed repairs.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Reconciler compares the instances tracked by the broker with the addresses of the address controller.
+type Reconciler struct {
+	broker *MaasBroker
+	config ReconcilerConfig
+	log    *logging.Logger
+
+	// running serialises reconciliations
+	running sync.Mutex
+	// warned are the drifts found by the last reconciliation, which are only warned about once. Guarded by running.
+	warned map[string]bool
+	mutex  sync.Mutex
+	last   *ReconcileReport
+}
+
+func NewReconciler(broker *MaasBroker, config ReconcilerConfig, log *logging.Logger) *Reconciler {
+	return &Reconciler{broker: broker, config: config, log: log, warned: make(map[string]bool)}
+}
+
+// Run reconciles periodically until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.config.Interval <= 0 {
+		return
+	}
+	r.log.Noticef("Reconciling instances and addresses every %s (repair: %t)", r.config.Interval, r.config.Repair)
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reconcile(ctx, r.config.Repair)
+		}
+	}
+}
+
+// Last returns the report of the last reconciliation, or nil if there has been none.
+func (r *Reconciler) Last() *ReconcileReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.last
+}
+
+// Reconcile reports the orphaned and missing addresses, repairing them if repair is set. Instances with an
+// operation in progress are skipped. It also revokes the users retired by credential rotations whose overlap
+// window has ended.
+func (r *Reconciler) Reconcile(ctx context.Context, repair bool) (*ReconcileReport, error) {
+	r.running.Lock()
+	defer r.running.Unlock()
+
+	ctx = reqctx.WithOperation(ctx, "reconcile")
+	log := reqctx.Logger(ctx, r.log)
+	b := r.broker
+	report := &ReconcileReport{Started: time.Now(), Repair: repair, Orphans: []Drift{}, Missing: []Drift{}}
+	reconcilerMetrics.Add("runs", 1)
+
+	instances, err := b.backend.GetInstances(ctx)
+	if err != nil {
+		reconcilerMetrics.Add("failures", 1)
+		log.Errorf("Reconciliation failed: %v", err)
+		return nil, err
+	}
+
+	type located struct {
+		instance maas.Instance
+		address  maas.Address
+	}
+	addresses := make(map[string]located)
+	listed := make(map[string]bool)
+	for _, instance := range instances {
+		infraID := instance.Metadata.Name
+		instanceAddresses, err := b.backend.GetAddresses(ctx, infraID)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("could not list the addresses of instance %s: %v", infraID, err))
+			continue
+		}
+		listed[infraID] = true
+		for _, address := range instanceAddresses {
+			addresses[address.Metadata.Uuid] = located{instance: instance, address: address}
+		}
+	}
+
+	warned := make(map[string]bool)
+	records := b.store.listInstances()
+	known := make(map[string]bool)
+	for _, record := range records {
+		known[record.InstanceID] = true
+		if _, found := addresses[record.InstanceID]; found || !listed[record.InfraID] || b.operations.inProgress(record.InstanceID) {
+			continue
+		}
+		drift := Drift{InstanceID: record.InstanceID, InfraID: record.InfraID, Address: record.Parameters["name"]}
+		r.warn(log, warned, "missing/"+drift.InstanceID, "Address %s of instance %s is missing from infrastructure instance %s", drift.Address, drift.InstanceID, drift.InfraID)
+		if repair {
+			drift.Repair = r.recreate(ctx, record)
+		}
+		report.Missing = append(report.Missing, drift)
+	}
+
+	for instanceID, location := range addresses {
+		if known[instanceID] || b.operations.inProgress(instanceID) {
+			continue
+		}
+		drift := Drift{InstanceID: instanceID, InfraID: location.instance.Metadata.Name, Address: location.address.Metadata.Name}
+		r.warn(log, warned, "orphan/"+drift.InstanceID, "Address %s in infrastructure instance %s is orphaned: %s is not an instance of the broker", drift.Address, drift.InfraID, drift.InstanceID)
+		if repair {
+			drift.Repair = r.repairOrphan(ctx, &location.instance, &location.address)
+		}
+		report.Orphans = append(report.Orphans, drift)
+	}
+	sort.Slice(report.Orphans, func(i, j int) bool { return report.Orphans[i].InstanceID < report.Orphans[j].InstanceID })
+
+	for _, drift := range append(append([]Drift{}, report.Missing...), report.Orphans...) {
+		switch drift.Repair {
+		case "":
+		case RepairAdopted, RepairRecreated:
+			reconcilerMetrics.Add("repaired", 1)
+		default:
+			report.Errors = append(report.Errors, "could not repair "+drift.InstanceID+": "+drift.Repair)
+		}
+	}
+
+	// revocations scheduled by a broker that was restarted are completed at startup, but may have failed
+	report.Errors = append(report.Errors, b.revokeExpiredUsers(ctx)...)
+
+	r.warned = warned
+	report.Finished = time.Now()
+	setMetric("orphans", len(report.Orphans))
+	setMetric("missing", len(report.Missing))
+	log.Infof("Reconciled %d instances with %d addresses: %d orphaned, %d missing", len(records), len(addresses), len(report.Orphans), len(report.Missing))
+	r.mutex.Lock()
+	r.last = report
+	r.mutex.Unlock()
+	return report, nil
+}
+
+// warn logs a drift as a warning when a reconciliation first finds it, and at debug level while it persists,
+// so that the orphans a restarted broker finds do not fill its log at every interval. The drift is recorded
+// in warned, which replaces the drifts warned about once the reconciliation finishes.
+func (r *Reconciler) warn(log reqctx.Log, warned map[string]bool, key string, format string, args ...interface{}) {
+	warned[key] = true
+	if r.warned[key] {
+		log.Debugf(format, args...)
+	} else {
+		log.Warningf(format, args...)
+	}
+}
+
+// recreate provisions the missing address of an instance again, unless it has been deprovisioned or
+// re-created meanwhile.
+func (r *Reconciler) recreate(ctx context.Context, record *InstanceRecord) string {
+	b := r.broker
+	unlock, ok := b.locks.TryLock(record.InstanceID)
+	if !ok {
+		return "instance is busy"
+	}
+	defer unlock()
+
+	instanceUUID := uuid.Parse(record.InstanceID)
+	if b.store.getInstance(record.InstanceID) == nil {
+		return "instance was deprovisioned"
+	}
+	if address, err := maas.GetAddress(ctx, b.backend, record.InfraID, instanceUUID); err != nil {
+		return err.Error()
+	} else if address != nil {
+		return "address was re-created"
+	}
+
+	if err := b.provisionAddress(ctx, record); err != nil {
+		return err.Error()
+	}
+	reqctx.Logger(ctx, r.log).Noticef("Re-created address %s of instance %s", record.Parameters["name"], record.InstanceID)
+	return RepairRecreated
+}
+
+// repairOrphan adopts an orphaned address, unless the broker has provisioned it meanwhile.
+func (r *Reconciler) repairOrphan(ctx context.Context, instance *maas.Instance, address *maas.Address) string {
+	b := r.broker
+	log := reqctx.Logger(ctx, r.log)
+	unlock, ok := b.locks.TryLock(address.Metadata.Uuid)
+	if !ok {
+		return "instance is busy"
+	}
+	defer unlock()
+
+	if b.store.getInstance(address.Metadata.Uuid) != nil {
+		return "instance was provisioned"
+	}
+
+	record, err := b.instanceRecordFromAddress(ctx, instance, address)
+	if err != nil {
+		return err.Error()
+	}
+	b.store.putInstance(record)
+	log.Noticef("Adopted orphaned address %s of infrastructure instance %s", address.Metadata.Name, instance.Metadata.Name)
+	return RepairAdopted
+}
+
+// provisionAddress creates the address of an instance record as it was provisioned.
+func (b MaasBroker) provisionAddress(ctx context.Context, record *InstanceRecord) error {
+	instanceUUID := uuid.Parse(record.InstanceID)
+	name := record.Parameters["name"]
+	options := maas.AddressOptions{Group: record.Parameters["group"]}
+	if record.Namespace != "" {
+		options.Labels = map[string]string{NamespaceLabel: record.Namespace}
+	}
+
+	switch record.ServiceID {
+	case AnycastServiceUUID:
+		return maas.ProvisionAnycast(ctx, b.backend, record.InfraID, instanceUUID, name, options)
+	case MulticastServiceUUID:
+		return maas.ProvisionMulticast(ctx, b.backend, record.InfraID, instanceUUID, name, options)
+	}
+
+	flavor, err := maas.GetFlavor(ctx, b.backend, uuid.Parse(record.PlanID))
+	if err != nil {
+		return err
+	}
+	if flavor == nil {
+		return fmt.Errorf("plan %s no longer exists", record.PlanID)
+	}
+	if options.TemplateParameters, err = b.getTemplateParameters(record.Parameters, flavor); err != nil {
+		return err
+	}
+	if record.ServiceID == TopicServiceUUID {
+		return maas.ProvisionTopic(ctx, b.backend, record.InfraID, instanceUUID, name, flavor, options)
+	}
+	return maas.ProvisionQueue(ctx, b.backend, record.InfraID, instanceUUID, name, flavor, options)
+}
+
+func setMetric(name string, value int) {
+	metric := new(expvar.Int)
+	metric.Set(int64(value))
+	reconcilerMetrics.Set(name, metric)
+}
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+func provisionQueue(t *testing.T, b *MaasBroker, instanceID uuid.UUID, name string) {
+	if _, err := b.Provision(context.Background(), instanceID, &ProvisionRequest{
+		OrganizationID: testInfraID,
+		ServiceID:      uuid.Parse(QueueServiceUUID),
+		PlanID:         uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid),
+		Parameters:     map[string]string{"name": name},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup prepares the drift, returning the broker to reconcile with
+		setup     func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker
+		missing   int
+		orphans   int
+		errors    int
+		repair    string
+		addresses int
+	}{
+		{
+			name: "in sync",
+			setup: func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker {
+				provisionQueue(t, b, uuid.NewRandom(), "queue1")
+				return b
+			},
+			addresses: 1,
+		},
+		{
+			name: "missing address",
+			setup: func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker {
+				instanceID := uuid.NewRandom()
+				provisionQueue(t, b, instanceID, "queue1")
+				server.DeprovisionAddress(context.Background(), testInfraID, instanceID)
+				return b
+			},
+			missing:   1,
+			repair:    RepairRecreated,
+			addresses: 1,
+		},
+		{
+			name: "orphaned address",
+			setup: func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker {
+				maas.ProvisionAnycast(context.Background(), server, testInfraID, uuid.NewRandom(), "orphan", maas.AddressOptions{})
+				return b
+			},
+			orphans:   1,
+			repair:    RepairAdopted,
+			addresses: 1,
+		},
+		{
+			name: "restarted broker",
+			setup: func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker {
+				provisionQueue(t, b, uuid.NewRandom(), "queue1")
+				restarted, err := NewMaasBroker(MaasBrokerConfig{}, b.log, server)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return restarted
+			},
+			orphans:   1,
+			repair:    RepairAdopted,
+			addresses: 1,
+		},
+		{
+			name: "operation in progress",
+			setup: func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker {
+				instanceID := uuid.NewRandom()
+				maas.ProvisionAnycast(context.Background(), server, testInfraID, instanceID, "provisioning", maas.AddressOptions{})
+				b.operations.start(OperationProvision, instanceID.String(), "")
+				return b
+			},
+			addresses: 1,
+		},
+		{
+			name: "addresses not listed",
+			setup: func(t *testing.T, b *MaasBroker, server *fakemaas.Server) *MaasBroker {
+				instanceID := uuid.NewRandom()
+				provisionQueue(t, b, instanceID, "queue1")
+				server.DeprovisionAddress(context.Background(), testInfraID, instanceID)
+				server.Fail(fakemaas.Failure{Method: http.MethodGet, PathPrefix: "/v3/instance/" + testInfraID + "/address", Status: http.StatusServiceUnavailable, Count: 2})
+				return b
+			},
+			errors: 1,
+		},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		b, server := newTestBroker(t, MaasBrokerConfig{})
+		b = test.setup(t, b, server)
+		reconciler := NewReconciler(b, ReconcilerConfig{}, b.log)
+
+		for _, repair := range []bool{false, true} {
+			report, err := reconciler.Reconcile(ctx, repair)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if len(report.Missing) != test.missing || len(report.Orphans) != test.orphans || len(report.Errors) != test.errors {
+				t.Errorf("%s: expected %d missing, %d orphans and %d errors, got %v", test.name, test.missing, test.orphans, test.errors, report)
+				continue
+			}
+			for _, drift := range append(report.Missing, report.Orphans...) {
+				if expected := map[bool]string{true: test.repair}[repair]; drift.Repair != expected {
+					t.Errorf("%s: expected repair %q, got %q", test.name, expected, drift.Repair)
+				}
+			}
+		}
+
+		report, err := reconciler.Reconcile(ctx, false)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.errors == 0 && (len(report.Missing) != 0 || len(report.Orphans) != 0) {
+			t.Errorf("%s: expected no drift after repairing, got %v", test.name, report)
+		}
+		if addresses := server.Addresses(testInfraID); len(addresses) != test.addresses {
+			t.Errorf("%s: expected %d addresses, got %v", test.name, test.addresses, addresses)
+		}
+	}
+}
+
+func TestReconcileWarnsOnce(t *testing.T) {
+	ctx := context.Background()
+	b, server := newTestBroker(t, MaasBrokerConfig{})
+	logger := logging.MustGetLogger("reconcile-test")
+	reconciler := NewReconciler(b, ReconcilerConfig{}, logger)
+	orphanID := uuid.NewRandom()
+
+	// warnings reconciles, returning the number of warnings logged.
+	warnings := func() int {
+		backend := logging.NewMemoryBackend(100)
+		logger.SetBackend(logging.AddModuleLevel(backend))
+		if _, err := reconciler.Reconcile(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for node := backend.Head(); node != nil; node = node.Next() {
+			if node.Record.Level == logging.WARNING {
+				count++
+			}
+		}
+		return count
+	}
+
+	steps := []struct {
+		name     string
+		change   func()
+		warnings int
+	}{
+		{name: "orphan found", change: func() {
+			maas.ProvisionAnycast(ctx, server, testInfraID, orphanID, "orphan", maas.AddressOptions{})
+		}, warnings: 1},
+		{name: "orphan found again", warnings: 0},
+		{name: "address missing", change: func() {
+			instanceID := uuid.NewRandom()
+			provisionQueue(t, b, instanceID, "queue1")
+			server.DeprovisionAddress(ctx, testInfraID, instanceID)
+		}, warnings: 1},
+		{name: "orphan deleted", change: func() {
+			server.DeprovisionAddress(ctx, testInfraID, orphanID)
+		}, warnings: 0},
+		{name: "orphan re-created", change: func() {
+			maas.ProvisionAnycast(ctx, server, testInfraID, orphanID, "orphan", maas.AddressOptions{})
+		}, warnings: 1},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		if count := warnings(); count != step.warnings {
+			t.Errorf("%s: expected %d warnings, got %d", step.name, step.warnings, count)
+		}
+	}
+}
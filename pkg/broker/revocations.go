@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+)
+
+const (
+	// UserInstanceLabel labels the users of bindings with their service instance.
+	UserInstanceLabel = "enmasse.io/instance"
+	// RevokesLabel and RevokeAfterLabel label the user created by a credential rotation with the user it
+	// replaces, and the time (in seconds since the epoch) at which that user is revoked. Recording pending
+	// revocations in the backend lets a restarted broker complete them.
+	RevokesLabel     = "enmasse.io/revokes"
+	RevokeAfterLabel = "enmasse.io/revoke-after"
+)
+
+// revocation is a user retired by a credential rotation, pending revocation.
+type revocation struct {
+	infraID    string
+	instanceID string
+	bindingID  string
+	username   string
+	after      time.Time
+}
+
+// pendingRevocations finds the retired users that still exist in the backend.
+func (b MaasBroker) pendingRevocations(ctx context.Context) ([]revocation, error) {
+	instances, err := b.backend.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var revocations []revocation
+	for _, instance := range instances {
+		infraID := instance.Metadata.Name
+		users, err := b.backend.GetUsers(ctx, infraID)
+		if err != nil {
+			return nil, fmt.Errorf("could not list the users of instance %s: %v", infraID, err)
+		}
+		existing := make(map[string]bool)
+		for _, user := range users {
+			existing[user.Metadata.Name] = true
+		}
+		for _, user := range users {
+			retired := user.Metadata.Labels[RevokesLabel]
+			if retired == "" || !existing[retired] {
+				continue
+			}
+			seconds, err := strconv.ParseInt(user.Metadata.Labels[RevokeAfterLabel], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("user %s of instance %s has an invalid %s label", user.Metadata.Name, infraID, RevokeAfterLabel)
+			}
+			revocations = append(revocations, revocation{
+				infraID:    infraID,
+				instanceID: user.Metadata.Labels[UserInstanceLabel],
+				bindingID:  user.Metadata.Uuid,
+				username:   retired,
+				after:      time.Unix(seconds, 0),
+			})
+		}
+	}
+	return revocations, nil
+}
+
+// ResumeRevocations schedules the revocation of the users retired by credential rotations before the broker
+// started, revoking those whose overlap window has already ended.
+func (b MaasBroker) ResumeRevocations(ctx context.Context) error {
+	if !b.bindingUsers {
+		return nil
+	}
+	log := reqctx.Logger(ctx, b.log)
+	revocations, err := b.pendingRevocations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pending := range revocations {
+		pending := pending
+		delay := time.Until(pending.after)
+		if delay < 0 {
+			delay = 0
+		}
+		log.Infof("User %s of binding %s will be revoked in %s", pending.username, pending.bindingID, delay)
+		time.AfterFunc(delay, func() {
+			b.revokeUser(ctx, pending)
+		})
+	}
+	return nil
+}
+
+// revokeExpiredUsers revokes the retired users whose overlap window has ended, returning the failures.
+func (b MaasBroker) revokeExpiredUsers(ctx context.Context) []string {
+	if !b.bindingUsers {
+		return nil
+	}
+	revocations, err := b.pendingRevocations(ctx)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var failures []string
+	for _, pending := range revocations {
+		if time.Now().Before(pending.after) {
+			continue
+		}
+		if err := b.revokeUser(ctx, pending); err != nil {
+			failures = append(failures, fmt.Sprintf("could not revoke user %s: %v", pending.username, err))
+		}
+	}
+	return failures
+}
+
+// revokeUser deletes a user retired by a credential rotation.
+func (b MaasBroker) revokeUser(ctx context.Context, pending revocation) error {
+	log := reqctx.Logger(ctx, b.log)
+	unlock := b.locks.Lock(pending.instanceID)
+	defer unlock()
+
+	if err := b.backend.DeleteUser(ctx, pending.infraID, pending.username); err != nil {
+		log.Errorf("Failed to revoke user %s of binding %s: %v", pending.username, pending.bindingID, err)
+		return err
+	}
+
+	if binding := b.store.getBinding(pending.bindingID); binding != nil {
+		revoked := *binding
+		revoked.RetiredUsernames = []string{}
+		for _, retired := range binding.RetiredUsernames {
+			if retired != pending.username {
+				revoked.RetiredUsernames = append(revoked.RetiredUsernames, retired)
+			}
+		}
+		b.store.putBinding(&revoked)
+	}
+	log.Infof("Revoked user %s of binding %s", pending.username, pending.bindingID)
+	return nil
+}
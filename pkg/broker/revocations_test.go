@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+const testInfraID = "org1"
+
+func newTestBroker(t *testing.T, config MaasBrokerConfig) (*MaasBroker, *fakemaas.Server) {
+	server := fakemaas.NewServer(fakemaas.Options{})
+	server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: testInfraID}})
+	b, err := NewMaasBroker(config, logging.MustGetLogger("test"), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, server
+}
+
+// waitForUsers polls the users of the test instance until they number count.
+func waitForUsers(server *fakemaas.Server, count int) []maas.User {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		users := server.Users(testInfraID)
+		if len(users) == count || time.Now().After(deadline) {
+			return users
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRotateCredentials(t *testing.T) {
+	ctx := context.Background()
+	b, server := newTestBroker(t, MaasBrokerConfig{
+		Credentials:     CredentialsConfig{BindingUsers: true},
+		RotationOverlap: 50 * time.Millisecond,
+	})
+
+	instanceID, bindingID := uuid.NewRandom(), uuid.NewRandom()
+	serviceID, planID := uuid.Parse(QueueServiceUUID), uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid)
+	if _, err := b.Provision(ctx, instanceID, &ProvisionRequest{
+		OrganizationID: testInfraID,
+		ServiceID:      serviceID,
+		PlanID:         planID,
+		Parameters:     map[string]string{"name": "my-queue"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := b.Bind(ctx, instanceID, bindingID, &BindRequest{ServiceID: serviceID, PlanID: planID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotate, err := b.RotateCredentials(ctx, instanceID, bindingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotate.StatusCode != http.StatusOK || rotate.Credentials["username"] == bind.Credentials["username"] {
+		t.Fatalf("expected new credentials, got %d %v", rotate.StatusCode, rotate.Credentials)
+	}
+	users := server.Users(testInfraID)
+	if len(users) != 2 {
+		t.Fatalf("expected both users during the overlap window, got %v", users)
+	}
+	rotated := users[1]
+	if rotated.Metadata.Name != rotate.Credentials["username"] {
+		t.Fatalf("expected user %s, got %s", rotate.Credentials["username"], rotated.Metadata.Name)
+	}
+	if rotated.Metadata.Labels[RevokesLabel] != bind.Credentials["username"] || rotated.Metadata.Labels[UserInstanceLabel] != instanceID.String() {
+		t.Errorf("expected the pending revocation in the labels, got %v", rotated.Metadata.Labels)
+	}
+	if _, err := strconv.ParseInt(rotated.Metadata.Labels[RevokeAfterLabel], 10, 64); err != nil {
+		t.Errorf("expected the revocation time in the labels, got %v", rotated.Metadata.Labels)
+	}
+
+	users = waitForUsers(server, 1)
+	if len(users) != 1 || users[0].Metadata.Name != rotated.Metadata.Name {
+		t.Errorf("expected the retired user to be revoked, got %v", users)
+	}
+	if binding := b.store.getBinding(bindingID.String()); len(binding.RetiredUsernames) != 0 {
+		t.Errorf("expected no retired users left, got %v", binding.RetiredUsernames)
+	}
+}
+
+func TestRevokeExpiredUsers(t *testing.T) {
+	tests := []struct {
+		name         string
+		bindingUsers bool
+		retired      string
+		revokeAfter  string
+		remaining    []string
+		failures     int
+	}{
+		{name: "expired", bindingUsers: true, retired: "binding-b1", revokeAfter: "-1h", remaining: []string{"binding-b1-1"}},
+		{name: "pending", bindingUsers: true, retired: "binding-b1", revokeAfter: "1h", remaining: []string{"binding-b1", "binding-b1-1"}},
+		{name: "already revoked", bindingUsers: true, retired: "binding-b0", revokeAfter: "-1h", remaining: []string{"binding-b1", "binding-b1-1"}},
+		{name: "invalid label", bindingUsers: true, retired: "binding-b1", remaining: []string{"binding-b1", "binding-b1-1"}, failures: 1},
+		{name: "binding users disabled", retired: "binding-b1", revokeAfter: "-1h", remaining: []string{"binding-b1", "binding-b1-1"}},
+	}
+
+	for _, test := range tests {
+		b, server := newTestBroker(t, MaasBrokerConfig{Credentials: CredentialsConfig{BindingUsers: test.bindingUsers}})
+		labels := map[string]string{UserInstanceLabel: "i1", RevokesLabel: test.retired}
+		if test.revokeAfter != "" {
+			offset, _ := time.ParseDuration(test.revokeAfter)
+			labels[RevokeAfterLabel] = strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+		}
+		server.AddUser(testInfraID, maas.User{Metadata: maas.Metadata{Name: "binding-b1", Uuid: "b1"}})
+		server.AddUser(testInfraID, maas.User{Metadata: maas.Metadata{Name: "binding-b1-1", Uuid: "b1", Labels: labels}})
+
+		failures := b.revokeExpiredUsers(context.Background())
+		if len(failures) != test.failures {
+			t.Errorf("%s: expected %d failures, got %v", test.name, test.failures, failures)
+		}
+		var remaining []string
+		for _, user := range server.Users(testInfraID) {
+			remaining = append(remaining, user.Metadata.Name)
+		}
+		if len(remaining) != len(test.remaining) || remaining[0] != test.remaining[0] {
+			t.Errorf("%s: expected users %v, got %v", test.name, test.remaining, remaining)
+		}
+	}
+}
+
+func TestResumeRevocations(t *testing.T) {
+	b, server := newTestBroker(t, MaasBrokerConfig{Credentials: CredentialsConfig{BindingUsers: true}})
+	for _, user := range []maas.User{
+		{Metadata: maas.Metadata{Name: "binding-b1", Uuid: "b1"}},
+		{Metadata: maas.Metadata{Name: "binding-b1-1", Uuid: "b1", Labels: map[string]string{
+			UserInstanceLabel: "i1",
+			RevokesLabel:      "binding-b1",
+			RevokeAfterLabel:  strconv.FormatInt(time.Now().Add(100*time.Millisecond).Unix(), 10),
+		}}},
+	} {
+		server.AddUser(testInfraID, user)
+	}
+
+	if err := b.ResumeRevocations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	users := waitForUsers(server, 1)
+	if len(users) != 1 || users[0].Metadata.Name != "binding-b1-1" {
+		t.Errorf("expected the retired user to be revoked, got %v", users)
+	}
+}
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+)
+
+// InstanceRecord is what the broker remembers about a service instance.
+type InstanceRecord struct {
+	InstanceID   string            `json:"instance_id"`
+	InfraID      string            `json:"infra_id"`
+	ServiceID    string            `json:"service_id"`
+	PlanID       string            `json:"plan_id"`
+	Parameters   map[string]string `json:"parameters,omitempty"`
+	DashboardURL string            `json:"dashboard_url,omitempty"`
+	Namespace    string            `json:"namespace,omitempty"`
+}
+
+// BindingRecord is what the broker remembers about a service binding.
+type BindingRecord struct {
+	BindingID  string            `json:"binding_id"`
+	InstanceID string            `json:"instance_id"`
+	InfraID    string            `json:"infra_id"`
+	ServiceID  string            `json:"service_id"`
+	PlanID     string            `json:"plan_id"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Username is the user of the binding, empty if bindings share the credentials of the instance.
+	Username    string                 `json:"username,omitempty"`
+	Credentials map[string]interface{} `json:"-"`
+	// Generation counts the credential rotations of the binding.
+	Generation int `json:"generation"`
+	// RetiredUsernames are the users replaced by a rotation that remain valid until the overlap window ends.
+	RetiredUsernames []string `json:"retired_usernames,omitempty"`
+}
+
+// store keeps track of the instances and bindings created by the broker. It is held in memory only.
+type store struct {
+	mutex     sync.RWMutex
+	instances map[string]*InstanceRecord
+	bindings  map[string]*BindingRecord
+}
+
+func newStore() *store {
+	return &store{
+		instances: make(map[string]*InstanceRecord),
+		bindings:  make(map[string]*BindingRecord),
+	}
+}
+
+func (s *store) getInstance(instanceID string) *InstanceRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.instances[instanceID]
+}
+
+// listInstances returns the instances sorted by ID.
+func (s *store) listInstances() []*InstanceRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	instances := make([]*InstanceRecord, 0, len(s.instances))
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].InstanceID < instances[j].InstanceID })
+	return instances
+}
+
+func (s *store) putInstance(instance *InstanceRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.instances[instance.InstanceID] = instance
+}
+
+func (s *store) deleteInstance(instanceID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.instances, instanceID)
+}
+
+func (s *store) getBinding(bindingID string) *BindingRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bindings[bindingID]
+}
+
+// listBindings returns the bindings sorted by ID.
+func (s *store) listBindings() []*BindingRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	bindings := make([]*BindingRecord, 0, len(s.bindings))
+	for _, binding := range s.bindings {
+		bindings = append(bindings, binding)
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].BindingID < bindings[j].BindingID })
+	return bindings
+}
+
+func (s *store) putBinding(binding *BindingRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bindings[binding.BindingID] = binding
+}
+
+func (s *store) deleteBinding(bindingID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.bindings, bindingID)
+}
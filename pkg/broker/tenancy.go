@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/kubernetes-incubator/service-catalog/.glide/cache/src/https-k8s.io-kubernetes/pkg/util/strings"
+)
+
+const (
+	TenancyOrganization = "organization"
+	TenancySpace        = "space"
+	TenancyNamespace    = "namespace"
+	TenancyShared       = "shared"
+)
+
+type TenancyConfig struct {
+	// Policy selects how service instances are mapped to MaaS infrastructure instances: one per
+	// organization (the default), per space, per Kubernetes namespace, or a single shared one.
+	Policy string
+	// SharedInfraID is the infrastructure instance used by the shared policy.
+	SharedInfraID string
+}
+
+// TenancyPolicy chooses the MaaS infrastructure instance a service instance is provisioned into.
+type TenancyPolicy interface {
+	Name() string
+	InfraID(req *ProvisionRequest) (string, error)
+}
+
+func NewTenancyPolicy(config TenancyConfig) (TenancyPolicy, error) {
+	switch config.Policy {
+	case "", TenancyOrganization:
+		return organizationTenancy{}, nil
+	case TenancySpace:
+		return spaceTenancy{}, nil
+	case TenancyNamespace:
+		return namespaceTenancy{}, nil
+	case TenancyShared:
+		if config.SharedInfraID == "" {
+			return nil, fmt.Errorf("tenancy policy %s requires sharedinfraid", TenancyShared)
+		}
+		return sharedTenancy{infraID: config.SharedInfraID}, nil
+	default:
+		return nil, fmt.Errorf("unknown tenancy policy %s", config.Policy)
+	}
+}
+
+type organizationTenancy struct{}
+
+func (organizationTenancy) Name() string {
+	return TenancyOrganization
+}
+
+func (organizationTenancy) InfraID(req *ProvisionRequest) (string, error) {
+	if req.OrganizationID == "" {
+		req.OrganizationID = "some-unique-guid"
+		req.SpaceID = "some-unique-guid"
+	}
+	return shortenInfraID(req.OrganizationID), nil
+}
+
+type spaceTenancy struct{}
+
+func (spaceTenancy) Name() string {
+	return TenancySpace
+}
+
+func (spaceTenancy) InfraID(req *ProvisionRequest) (string, error) {
+	if req.SpaceID == "" {
+		return "", errors.NewBadRequest("Tenancy policy " + TenancySpace + " requires space_guid")
+	}
+	return shortenInfraID(req.SpaceID), nil
+}
+
+type namespaceTenancy struct{}
+
+func (namespaceTenancy) Name() string {
+	return TenancyNamespace
+}
+
+// InfraID derives the infrastructure instance from a hash of the namespace, as namespace names are too
+// long to be used directly.
+func (namespaceTenancy) InfraID(req *ProvisionRequest) (string, error) {
+	if req.Context == nil || req.Context.Namespace == "" {
+		return "", errors.NewBadRequest("Tenancy policy " + TenancyNamespace + " requires context.namespace")
+	}
+	hash := sha1.Sum([]byte(req.Context.Namespace))
+	return shortenInfraID(hex.EncodeToString(hash[:])), nil
+}
+
+type sharedTenancy struct {
+	infraID string
+}
+
+func (sharedTenancy) Name() string {
+	return TenancyShared
+}
+
+func (t sharedTenancy) InfraID(req *ProvisionRequest) (string, error) {
+	return t.infraID, nil
+}
+
+// TODO: this is a temporary hack needed because otherwise the resulting address configmap name is too long
+func shortenInfraID(id string) string {
+	return strings.ShortenString(id, 8)
+}
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/pborman/uuid"
+)
+
+func TestNewTenancyPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TenancyConfig
+		policy string
+		valid  bool
+	}{
+		{name: "default", policy: TenancyOrganization, valid: true},
+		{name: "organization", config: TenancyConfig{Policy: TenancyOrganization}, policy: TenancyOrganization, valid: true},
+		{name: "space", config: TenancyConfig{Policy: TenancySpace}, policy: TenancySpace, valid: true},
+		{name: "namespace", config: TenancyConfig{Policy: TenancyNamespace}, policy: TenancyNamespace, valid: true},
+		{name: "shared", config: TenancyConfig{Policy: TenancyShared, SharedInfraID: "shared"}, policy: TenancyShared, valid: true},
+		{name: "shared without instance", config: TenancyConfig{Policy: TenancyShared}},
+		{name: "unknown", config: TenancyConfig{Policy: "cluster"}},
+	}
+
+	for _, test := range tests {
+		policy, err := NewTenancyPolicy(test.config)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if policy.Name() != test.policy {
+			t.Errorf("%s: expected policy %s, got %s", test.name, test.policy, policy.Name())
+		}
+	}
+}
+
+func TestTenancyInfraID(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TenancyConfig
+		req     ProvisionRequest
+		infraID string
+	}{
+		{name: "organization", req: ProvisionRequest{OrganizationID: "2b9a1c5e-org", SpaceID: "space"}, infraID: "2b9a1c5e"},
+		{name: "organization missing", req: ProvisionRequest{}, infraID: "some-uni"},
+		{name: "space", config: TenancyConfig{Policy: TenancySpace}, req: ProvisionRequest{OrganizationID: "org", SpaceID: "7f3e2d1c-space"}, infraID: "7f3e2d1c"},
+		{name: "space missing", config: TenancyConfig{Policy: TenancySpace}, req: ProvisionRequest{OrganizationID: "org"}},
+		{name: "namespace", config: TenancyConfig{Policy: TenancyNamespace}, req: ProvisionRequest{Context: &PlatformContext{Namespace: "myproject"}}, infraID: "8966a986"},
+		{name: "namespace missing", config: TenancyConfig{Policy: TenancyNamespace}, req: ProvisionRequest{Context: &PlatformContext{Platform: "kubernetes"}}},
+		{name: "shared", config: TenancyConfig{Policy: TenancyShared, SharedInfraID: "shared"}, req: ProvisionRequest{OrganizationID: "org"}, infraID: "shared"},
+	}
+
+	for _, test := range tests {
+		policy, err := NewTenancyPolicy(test.config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		infraID, err := policy.InfraID(&test.req)
+		if test.infraID == "" {
+			if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusBadRequest {
+				t.Errorf("%s: expected a bad request, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if infraID != test.infraID {
+			t.Errorf("%s: expected infrastructure instance %s, got %s", test.name, test.infraID, infraID)
+		}
+	}
+}
+
+func TestProvisionIntoNewInfra(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TenancyConfig
+		req     ProvisionRequest
+		infraID string
+	}{
+		{name: "existing instance", req: ProvisionRequest{OrganizationID: testInfraID}, infraID: testInfraID},
+		{name: "new organization", req: ProvisionRequest{OrganizationID: "org2"}, infraID: "org2"},
+		{name: "new space", config: TenancyConfig{Policy: TenancySpace}, req: ProvisionRequest{SpaceID: "space2"}, infraID: "space2"},
+		{name: "new namespace", config: TenancyConfig{Policy: TenancyNamespace}, req: ProvisionRequest{Context: &PlatformContext{Platform: "kubernetes", Namespace: "myproject"}}, infraID: "8966a986"},
+		{name: "shared instance", config: TenancyConfig{Policy: TenancyShared, SharedInfraID: "shared"}, infraID: "shared"},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		b, server := newTestBroker(t, MaasBrokerConfig{Tenancy: test.config})
+		instanceID := uuid.NewRandom()
+		test.req.ServiceID = uuid.Parse(QueueServiceUUID)
+		test.req.PlanID = uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid)
+		test.req.Parameters = map[string]string{"name": "my-queue"}
+		if _, err := b.Provision(ctx, instanceID, &test.req); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		addresses := server.Addresses(test.infraID)
+		if len(addresses) != 1 || addresses[0].Metadata.Uuid != instanceID.String() {
+			t.Errorf("%s: expected the address in instance %s, got %v", test.name, test.infraID, addresses)
+		}
+		if instances := server.Instances(); test.infraID != testInfraID && len(instances) != 2 {
+			t.Errorf("%s: expected instance %s to be provisioned, got %v", test.name, test.infraID, instances)
+		}
+	}
+}
+
+func TestRejectedProvisionCreatesNoInfra(t *testing.T) {
+	queue, topic := fakemaas.DefaultFlavors()[0], fakemaas.DefaultFlavors()[3]
+	tests := []struct {
+		name       string
+		serviceID  string
+		planID     string
+		parameters map[string]string
+	}{
+		{name: "missing name", serviceID: QueueServiceUUID, planID: queue.Metadata.Uuid},
+		{name: "plan of another service", serviceID: QueueServiceUUID, planID: topic.Metadata.Uuid, parameters: map[string]string{"name": "my-queue"}},
+		{name: "unknown service", serviceID: uuid.New(), planID: queue.Metadata.Uuid, parameters: map[string]string{"name": "my-queue"}},
+		{name: "invalid group", serviceID: QueueServiceUUID, planID: queue.Metadata.Uuid, parameters: map[string]string{"name": "my-queue", "group": "Group_1"}},
+		{name: "group of an anycast address", serviceID: AnycastServiceUUID, planID: AnycastPlanUUID, parameters: map[string]string{"name": "my-anycast", "group": "group1"}},
+		{name: "invalid template parameter", serviceID: QueueServiceUUID, planID: queue.Metadata.Uuid, parameters: map[string]string{"name": "my-queue", "MEMORY": "1 gigabyte"}},
+	}
+
+	for _, test := range tests {
+		b, server := newTestBroker(t, MaasBrokerConfig{TemplateParameters: map[string]string{"MEMORY": "^[0-9]+Mi$"}})
+		_, err := b.Provision(context.Background(), uuid.NewRandom(), &ProvisionRequest{
+			OrganizationID: "org2",
+			ServiceID:      uuid.Parse(test.serviceID),
+			PlanID:         uuid.Parse(test.planID),
+			Parameters:     test.parameters,
+		})
+		if brokerError, ok := err.(errors.BrokerError); !ok || brokerError.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %v", test.name, err)
+		}
+		if instances := server.Instances(); len(instances) != 1 {
+			t.Errorf("%s: expected no infrastructure instance to be provisioned, got %v", test.name, instances)
+		}
+	}
+}
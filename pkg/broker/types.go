@@ -15,6 +15,9 @@ type Service struct {
 	DashboardClient *DashboardClient       `json:"dashboard_client,omitempty"`
 	PlanUpdatable   bool                   `json:"plan_updateable,omitempty"`
 	Plans           []Plan                 `json:"plans"`
+
+	InstancesRetrievable bool `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool `json:"bindings_retrievable,omitempty"`
 }
 
 type DashboardClient struct {
@@ -54,6 +57,32 @@ type LastOperationResponse struct {
 	Description string             `json:"description,omitempty"`
 }
 
+// PlatformContext is the context object describing the platform a request originates from.
+type PlatformContext struct {
+	Platform         string `json:"platform"`
+	Namespace        string `json:"namespace,omitempty"`
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+}
+
+func (c *PlatformContext) String() string {
+	if c == nil {
+		return "none"
+	}
+	if c.Platform == "kubernetes" {
+		return "platform=" + c.Platform + " namespace=" + c.Namespace
+	}
+	return "platform=" + c.Platform + " organization=" + c.OrganizationGUID + " space=" + c.SpaceGUID
+}
+
+// GetNamespace returns the Kubernetes namespace a request originates from, if any.
+func (c *PlatformContext) GetNamespace() string {
+	if c == nil {
+		return ""
+	}
+	return c.Namespace
+}
+
 type ProvisionRequest struct {
 	OrganizationID    string            `json:"organization_guid"`
 	PlanID            uuid.UUID         `json:"plan_id"`
@@ -61,6 +90,7 @@ type ProvisionRequest struct {
 	SpaceID           string            `json:"space_guid"`
 	Parameters        map[string]string `json:"parameters,omitempty"`
 	AcceptsIncomplete bool              `json:"accepts_incomplete,omitempty"`
+	Context           *PlatformContext  `json:"context,omitempty"`
 }
 
 type ProvisionResponse struct {
@@ -69,6 +99,13 @@ type ProvisionResponse struct {
 	Operation    string `json:"operation,omitempty"`
 }
 
+type GetInstanceResponse struct {
+	ServiceID    string            `json:"service_id"`
+	PlanID       string            `json:"plan_id"`
+	DashboardURL string            `json:"dashboard_url,omitempty"`
+	Parameters   map[string]string `json:"parameters,omitempty"`
+}
+
 type UpdateRequest struct {
 	ServiceID      uuid.UUID         `json:"service_id"`
 	PlanID         uuid.UUID         `json:"plan_id,omitempty"`
@@ -79,7 +116,8 @@ type UpdateRequest struct {
 		OrganizationID uuid.UUID `json:"organization_id,omitempty"`
 		SpaceID        uuid.UUID `json:"space_id,omitempty"`
 	} `json:"previous_values,omitempty"`
-	AcceptsIncomplete bool `json:"accepts_incomplete,omitempty"`
+	AcceptsIncomplete bool             `json:"accepts_incomplete,omitempty"`
+	Context           *PlatformContext `json:"context,omitempty"`
 }
 
 type UpdateResponse struct {
@@ -94,17 +132,37 @@ type BindRequest struct {
 		AppID uuid.UUID `json:"app_guid,omitempty"`
 		Route string    `json:"route,omitempty"`
 	} `json:"bind_resource,omitempty"`
-	Parameters map[string]string `json:"parameters,omitempty"`
+	Parameters        map[string]string `json:"parameters,omitempty"`
+	AcceptsIncomplete bool              `json:"accepts_incomplete,omitempty"`
+	Context           *PlatformContext  `json:"context,omitempty"`
 }
 
 type BindResponse struct {
+	StatusCode      int                    `json:"-"`
+	Operation       string                 `json:"operation,omitempty"`
 	Credentials     map[string]interface{} `json:"credentials,omitempty"`
 	SyslogDrainURL  string                 `json:"syslog_drain_url,omitempty"`
 	RouteServiceURL string                 `json:"route_service_url,omitempty"`
 	VolumeMounts    []interface{}          `json:"volume_mounts,omitempty"`
 }
 
+type GetBindingResponse struct {
+	Credentials     map[string]interface{} `json:"credentials,omitempty"`
+	SyslogDrainURL  string                 `json:"syslog_drain_url,omitempty"`
+	RouteServiceURL string                 `json:"route_service_url,omitempty"`
+	VolumeMounts    []interface{}          `json:"volume_mounts,omitempty"`
+	Parameters      map[string]string      `json:"parameters,omitempty"`
+}
+
+type UnbindRequest struct {
+	ServiceID         string
+	PlanID            string
+	AcceptsIncomplete bool
+}
+
 type UnbindResponse struct {
+	StatusCode int    `json:"-"`
+	Operation  string `json:"operation,omitempty"`
 }
 
 type DeprovisionResponse struct {
@@ -112,9 +170,14 @@ type DeprovisionResponse struct {
 }
 
 type ErrorResponse struct {
+	Error       string `json:"error,omitempty"`
 	Description string `json:"description"`
 }
 
 func NewErrorResponse(Description string) ErrorResponse {
 	return ErrorResponse{Description: Description}
 }
+
+func NewErrorResponseWithCode(ErrorCode string, Description string) ErrorResponse {
+	return ErrorResponse{Error: ErrorCode, Description: Description}
+}
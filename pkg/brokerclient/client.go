@@ -0,0 +1,208 @@
+// Package brokerclient talks to the broker over the Open Service Broker API, and to its admin API. It is
+// used by brokerctl, in place of curl scripts.
+package brokerclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+)
+
+// DefaultAPIVersion is the Open Service Broker API version sent in the X-Broker-API-Version header.
+const DefaultAPIVersion = "2.11"
+
+type Config struct {
+	// URL is the base URL of the broker, e.g. http://localhost:1338, or of its admin API.
+	URL string
+	// Username and Password authenticate requests with HTTP basic authentication, if set.
+	Username string
+	Password string
+	// Token is sent as a bearer token, if set.
+	Token      string
+	APIVersion string
+}
+
+type Client struct {
+	config Config
+	client *http.Client
+}
+
+func New(config Config) *Client {
+	if config.APIVersion == "" {
+		config.APIVersion = DefaultAPIVersion
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	return &Client{config: config, client: http.DefaultClient}
+}
+
+func (c *Client) Catalog(ctx context.Context) (*broker.CatalogResponse, error) {
+	var resp broker.CatalogResponse
+	if _, err := c.Do(ctx, http.MethodGet, "/v2/catalog", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Provision(ctx context.Context, instanceID string, req *broker.ProvisionRequest) (*broker.ProvisionResponse, error) {
+	var resp broker.ProvisionResponse
+	status, err := c.Do(ctx, http.MethodPut, instancePath(instanceID), incomplete(req.AcceptsIncomplete), req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusCode = status
+	return &resp, nil
+}
+
+func (c *Client) Update(ctx context.Context, instanceID string, req *broker.UpdateRequest) (*broker.UpdateResponse, error) {
+	var resp broker.UpdateResponse
+	if _, err := c.Do(ctx, http.MethodPatch, instancePath(instanceID), incomplete(req.AcceptsIncomplete), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Deprovision(ctx context.Context, instanceID string, serviceID string, planID string, acceptsIncomplete bool) (*broker.DeprovisionResponse, error) {
+	query := incomplete(acceptsIncomplete)
+	query.Set("service_id", serviceID)
+	query.Set("plan_id", planID)
+	var resp broker.DeprovisionResponse
+	if _, err := c.Do(ctx, http.MethodDelete, instancePath(instanceID), query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) GetInstance(ctx context.Context, instanceID string) (*broker.GetInstanceResponse, error) {
+	var resp broker.GetInstanceResponse
+	if _, err := c.Do(ctx, http.MethodGet, instancePath(instanceID), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Bind(ctx context.Context, instanceID string, bindingID string, req *broker.BindRequest) (*broker.BindResponse, error) {
+	var resp broker.BindResponse
+	status, err := c.Do(ctx, http.MethodPut, bindingPath(instanceID, bindingID), incomplete(req.AcceptsIncomplete), req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusCode = status
+	return &resp, nil
+}
+
+func (c *Client) GetBinding(ctx context.Context, instanceID string, bindingID string) (*broker.GetBindingResponse, error) {
+	var resp broker.GetBindingResponse
+	if _, err := c.Do(ctx, http.MethodGet, bindingPath(instanceID, bindingID), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Unbind(ctx context.Context, instanceID string, bindingID string, req *broker.UnbindRequest) (*broker.UnbindResponse, error) {
+	query := incomplete(req.AcceptsIncomplete)
+	query.Set("service_id", req.ServiceID)
+	query.Set("plan_id", req.PlanID)
+	var resp broker.UnbindResponse
+	status, err := c.Do(ctx, http.MethodDelete, bindingPath(instanceID, bindingID), query, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusCode = status
+	return &resp, nil
+}
+
+// LastOperation polls the last operation of an instance, or of a binding if bindingID is not empty.
+func (c *Client) LastOperation(ctx context.Context, instanceID string, bindingID string, operation string) (*broker.LastOperationResponse, error) {
+	path := instancePath(instanceID)
+	if bindingID != "" {
+		path = bindingPath(instanceID, bindingID)
+	}
+	query := url.Values{}
+	if operation != "" {
+		query.Set("operation", operation)
+	}
+	var resp broker.LastOperationResponse
+	if _, err := c.Do(ctx, http.MethodGet, path+"/last_operation", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Do sends a request with a JSON body, unless body is nil, and decodes the JSON response into out. Responses
+// with an error status are returned as an errors.BrokerError, described by their error body.
+func (c *Client) Do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) (int, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	target := c.config.URL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Broker-API-Version", c.config.APIVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	} else if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var errorResponse broker.ErrorResponse
+		if err := json.Unmarshal(data, &errorResponse); err != nil || errorResponse.Description == "" {
+			errorResponse.Description = strings.TrimSpace(string(data))
+		}
+		return resp.StatusCode, errors.BrokerError{Status: resp.StatusCode, ErrorCode: errorResponse.Error, Description: errorResponse.Description}
+	}
+	if out != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("could not parse response of %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func instancePath(instanceID string) string {
+	return "/v2/service_instances/" + url.PathEscape(instanceID)
+}
+
+func bindingPath(instanceID string, bindingID string) string {
+	return instancePath(instanceID) + "/service_bindings/" + url.PathEscape(bindingID)
+}
+
+func incomplete(acceptsIncomplete bool) url.Values {
+	query := url.Values{}
+	if acceptsIncomplete {
+		query.Set("accepts_incomplete", "true")
+	}
+	return query
+}
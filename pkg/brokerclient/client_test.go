@@ -0,0 +1,130 @@
+package brokerclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/handler"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+const infraID = "org1"
+
+func newBroker(t *testing.T) *httptest.Server {
+	server := fakemaas.NewServer(fakemaas.Options{})
+	server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: infraID}})
+	log := logging.MustGetLogger("test")
+	b, err := broker.NewMaasBroker(broker.MaasBrokerConfig{}, log, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(handler.NewHandler(log, b, nil))
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	ts := newBroker(t)
+	defer ts.Close()
+	client := New(Config{URL: ts.URL + "/"})
+
+	catalog, err := client.Catalog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) == 0 {
+		t.Fatal("expected services in the catalog")
+	}
+
+	instanceID := uuid.New()
+	serviceID := uuid.Parse(broker.QueueServiceUUID)
+	planID := uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid)
+	provision, err := client.Provision(ctx, instanceID, &broker.ProvisionRequest{
+		OrganizationID: infraID,
+		ServiceID:      serviceID,
+		PlanID:         planID,
+		Parameters:     map[string]string{"name": "my-queue"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provision.StatusCode != http.StatusCreated {
+		t.Errorf("expected status 201, got %d", provision.StatusCode)
+	}
+
+	bindingID := uuid.New()
+	bind, err := client.Bind(ctx, instanceID, bindingID, &broker.BindRequest{ServiceID: serviceID, PlanID: planID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bind.StatusCode != http.StatusCreated || bind.Credentials["addressName"] != "my-queue" {
+		t.Errorf("unexpected binding %d %v", bind.StatusCode, bind.Credentials)
+	}
+	binding, err := client.GetBinding(ctx, instanceID, bindingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.Credentials["username"] != bind.Credentials["username"] {
+		t.Errorf("expected the credentials of the binding, got %v", binding.Credentials)
+	}
+
+	unbind, err := client.Unbind(ctx, instanceID, bindingID, &broker.UnbindRequest{ServiceID: serviceID.String(), PlanID: planID.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unbind.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", unbind.StatusCode)
+	}
+
+	if _, err := client.Deprovision(ctx, instanceID, serviceID.String(), planID.String(), false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Deprovision(ctx, instanceID, serviceID.String(), planID.String(), false)
+	if brokerErr, ok := err.(errors.BrokerError); !ok || brokerErr.Status != http.StatusGone {
+		t.Errorf("expected status 410 deprovisioning twice, got %v", err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   Config
+		username string
+		password string
+		auth     string
+	}{
+		{name: "basic", config: Config{Username: "admin", Password: "password"}, username: "admin", password: "password"},
+		{name: "token", config: Config{Token: "s3cr3t"}, auth: "Bearer s3cr3t"},
+		{name: "anonymous"},
+	} {
+		var r *http.Request
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r = req
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"description": "Unauthorized"}`))
+		}))
+		test.config.URL = ts.URL
+		_, err := New(test.config).Catalog(context.Background())
+		ts.Close()
+
+		if brokerErr, ok := err.(errors.BrokerError); !ok || brokerErr.Status != http.StatusUnauthorized || brokerErr.Description != "Unauthorized" {
+			t.Errorf("%s: expected an unauthorized error, got %v", test.name, err)
+		}
+		if r.Header.Get("X-Broker-API-Version") != DefaultAPIVersion {
+			t.Errorf("%s: expected API version %s, got %q", test.name, DefaultAPIVersion, r.Header.Get("X-Broker-API-Version"))
+		}
+		username, password, _ := r.BasicAuth()
+		if username != test.username || password != test.password {
+			t.Errorf("%s: unexpected basic authentication %s:%s", test.name, username, password)
+		}
+		if test.auth != "" && r.Header.Get("Authorization") != test.auth {
+			t.Errorf("%s: expected authorization %q, got %q", test.name, test.auth, r.Header.Get("Authorization"))
+		}
+	}
+}
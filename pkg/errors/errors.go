@@ -7,9 +7,14 @@ import (
 
 type BrokerError struct {
 	Status      int
+	ErrorCode   string
 	Description string
 }
 
+const (
+	ConcurrencyError = "ConcurrencyError"
+)
+
 func NewServiceInstanceAlreadyExists(UUID string) BrokerError {
 	return BrokerError{
 		Status:      http.StatusConflict,
@@ -24,6 +29,42 @@ func NewServiceInstanceGone(UUID string) BrokerError {
 	}
 }
 
+func NewServiceBindingAlreadyExists(UUID string) BrokerError {
+	return BrokerError{
+		Status:      http.StatusConflict,
+		Description: "Service binding " + UUID + " already exists",
+	}
+}
+
+func NewServiceBindingGone(UUID string) BrokerError {
+	return BrokerError{
+		Status:      http.StatusGone,
+		Description: "Service binding " + UUID + " is gone",
+	}
+}
+
+func NewServiceBindingNotFound(UUID string) BrokerError {
+	return BrokerError{
+		Status:      http.StatusNotFound,
+		Description: "Service binding " + UUID + " does not exist",
+	}
+}
+
+func NewServiceInstanceNotFound(UUID string) BrokerError {
+	return BrokerError{
+		Status:      http.StatusNotFound,
+		Description: "Service instance " + UUID + " does not exist",
+	}
+}
+
+func NewConcurrencyError(UUID string) BrokerError {
+	return BrokerError{
+		Status:      http.StatusUnprocessableEntity,
+		ErrorCode:   ConcurrencyError,
+		Description: "Another operation for service instance " + UUID + " is in progress",
+	}
+}
+
 func NewBadRequest(Description string) BrokerError {
 	return BrokerError{
 		Status:      http.StatusBadRequest,
@@ -31,6 +72,13 @@ func NewBadRequest(Description string) BrokerError {
 	}
 }
 
+func NewForbidden(Description string) BrokerError {
+	return BrokerError{
+		Status:      http.StatusForbidden,
+		Description: Description,
+	}
+}
+
 func NewBrokerError(statusCode int, Description string) BrokerError {
 	return BrokerError{
 		Status:      statusCode,
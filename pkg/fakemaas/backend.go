@@ -0,0 +1,185 @@
+package fakemaas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/pborman/uuid"
+)
+
+// The maas.Backend methods act on the same state as the REST API. Latency and injected failures apply to
+// them as to the equivalent requests, so failures can be injected by method and path either way.
+
+// call applies the latency and injected failures of the request equivalent to a Backend call.
+func (s *Server) call(method string, path string) error {
+	latency, status := s.intercept(method, path)
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if status != 0 {
+		return fmt.Errorf("Received error from MaaS API server: %d", status)
+	}
+	return nil
+}
+
+func (s *Server) GetFlavors(ctx context.Context) ([]maas.Flavor, error) {
+	if err := s.call(http.MethodGet, "/v3/flavor"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]maas.Flavor{}, s.flavors...), nil
+}
+
+func (s *Server) GetInstances(ctx context.Context) ([]maas.Instance, error) {
+	if err := s.call(http.MethodGet, "/v3/instance"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.instanceList(), nil
+}
+
+func (s *Server) GetInstance(ctx context.Context, id string) (*maas.Instance, error) {
+	if err := s.call(http.MethodGet, "/v3/instance/"+id); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, ok := s.instances[id]
+	if !ok {
+		return nil, nil
+	}
+	instance := inst.instance
+	return &instance, nil
+}
+
+func (s *Server) ProvisionMaaSInfra(ctx context.Context, infraID string) error {
+	if err := s.call(http.MethodPost, "/v3/instance"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addInstance(maas.Instance{Metadata: maas.Metadata{Name: infraID}})
+	return nil
+}
+
+func (s *Server) GetAddresses(ctx context.Context, infraID string) ([]maas.Address, error) {
+	if err := s.call(http.MethodGet, "/v3/instance/"+infraID+"/address"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return nil, err
+	}
+	return addressList(inst), nil
+}
+
+func (s *Server) ProvisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID, name string, storeAndForward bool, multicast bool, flavor string, options maas.AddressOptions) error {
+	if err := s.call(http.MethodPost, "/v3/instance/"+infraID+"/address"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return err
+	}
+	return s.putAddresses(inst, []maas.Address{{
+		Metadata: maas.Metadata{
+			Name:   name,
+			Uuid:   instanceUUID.String(),
+			Labels: options.Labels,
+		},
+		Spec: maas.AddressSpec{
+			StoreAndForward:    storeAndForward,
+			Multicast:          multicast,
+			Flavor:             flavor,
+			Group:              options.Group,
+			TemplateParameters: options.TemplateParameters,
+		},
+	}})
+}
+
+func (s *Server) DeprovisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID) error {
+	s.mu.Lock()
+	inst, err := s.instance(infraID)
+	var name string
+	if err == nil {
+		for _, address := range inst.addresses {
+			if address.Metadata.Uuid == instanceUUID.String() {
+				name = address.Metadata.Name
+			}
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("Received error from MaaS API server: %d", http.StatusNotFound)
+	}
+
+	if err := s.call(http.MethodDelete, "/v3/instance/"+infraID+"/address/"+name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(inst.addresses, name)
+	return nil
+}
+
+func (s *Server) GetUsers(ctx context.Context, infraID string) ([]maas.User, error) {
+	if err := s.call(http.MethodGet, "/v3/instance/"+infraID+"/user"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return nil, err
+	}
+	return userList(inst), nil
+}
+
+func (s *Server) CreateUser(ctx context.Context, infraID string, user maas.User) error {
+	if err := s.call(http.MethodPost, "/v3/instance/"+infraID+"/user"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return err
+	}
+	inst.users[user.Metadata.Name] = user
+	return nil
+}
+
+// DeleteUser ignores users that do not exist, like MaasClient.
+func (s *Server) DeleteUser(ctx context.Context, infraID string, name string) error {
+	if err := s.call(http.MethodDelete, "/v3/instance/"+infraID+"/user/"+name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return err
+	}
+	delete(inst.users, name)
+	return nil
+}
+
+func (s *Server) instance(infraID string) (*instance, error) {
+	inst, ok := s.instances[infraID]
+	if !ok {
+		return nil, fmt.Errorf("Received error from MaaS API server: %d", http.StatusNotFound)
+	}
+	return inst, nil
+}
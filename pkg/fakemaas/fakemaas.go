@@ -0,0 +1,530 @@
+// Package fakemaas implements the MaaS address controller REST API in memory, so that the broker can be
+// exercised without a running EnMasse, either from go tests through httptest or as a standalone server.
+// The Server is also a maas.Backend, for running the broker against it in-process.
+package fakemaas
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+type Options struct {
+	// Latency delays every response.
+	Latency time.Duration
+	// FailureRate is the fraction of requests, between 0 and 1, that fail with 500 Internal Server Error.
+	FailureRate float64
+	// Flavors are the flavors offered, DefaultFlavors if nil.
+	Flavors []maas.Flavor
+	// ReadyAfter is how long addresses report not to be ready after being created.
+	ReadyAfter time.Duration
+}
+
+// Failure makes requests fail with Status. It applies to the requests whose method is Method, or any
+// method if empty, and whose path starts with PathPrefix, Count times, or until removed if Count is negative.
+// A failure with a zero Count never applies.
+type Failure struct {
+	Method     string
+	PathPrefix string
+	Status     int
+	Count      int
+}
+
+type instance struct {
+	instance  maas.Instance
+	addresses map[string]maas.Address
+	users     map[string]maas.User
+}
+
+type Server struct {
+	router mux.Router
+
+	mu        sync.Mutex
+	options   Options
+	flavors   []maas.Flavor
+	instances map[string]*instance
+	failures  []*Failure
+	random    *rand.Rand
+}
+
+// DefaultFlavors returns the flavors of examples/address-controller, with UUIDs derived from their names.
+func DefaultFlavors() []maas.Flavor {
+	return []maas.Flavor{
+		NewFlavor("vanilla-queue", maas.Queue, "Simple in memory queue"),
+		NewFlavor("small-persisted-queue", maas.Queue, "Small queue with persistence"),
+		NewFlavor("large-persisted-queue", maas.Queue, "Large queue with persistence"),
+		NewFlavor("vanilla-topic", maas.Topic, "Simple in memory topic"),
+		NewFlavor("small-persisted-topic", maas.Topic, "Small topic with persistence"),
+		NewFlavor("large-persisted-topic", maas.Topic, "Large topic with persistence"),
+	}
+}
+
+func NewFlavor(name string, flavorType string, description string) maas.Flavor {
+	return maas.Flavor{
+		Metadata: maas.Metadata{
+			Name: name,
+			Uuid: uuid.NewSHA1(uuid.NameSpace_URL, []byte("urn:enmasse:flavor:"+name)).String(),
+		},
+		Spec: maas.FlavorSpec{
+			Type:        flavorType,
+			Description: description,
+		},
+	}
+}
+
+func NewServer(options Options) *Server {
+	s := &Server{
+		options:   options,
+		flavors:   options.Flavors,
+		instances: make(map[string]*instance),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if s.flavors == nil {
+		s.flavors = DefaultFlavors()
+	}
+
+	s.router.HandleFunc("/v3/flavor", s.getFlavors).Methods(http.MethodGet)
+	s.router.HandleFunc("/v3/instance", s.getInstances).Methods(http.MethodGet)
+	s.router.HandleFunc("/v3/instance", s.createInstance).Methods(http.MethodPost)
+	s.router.HandleFunc("/v3/instance/{instance}", s.getInstance).Methods(http.MethodGet)
+	s.router.HandleFunc("/v3/instance/{instance}", s.deleteInstance).Methods(http.MethodDelete)
+	s.router.HandleFunc("/v3/instance/{instance}/address", s.getAddresses).Methods(http.MethodGet)
+	s.router.HandleFunc("/v3/instance/{instance}/address", s.createAddresses).Methods(http.MethodPost)
+	s.router.HandleFunc("/v3/instance/{instance}/address/{address}", s.getAddress).Methods(http.MethodGet)
+	s.router.HandleFunc("/v3/instance/{instance}/address/{address}", s.deleteAddress).Methods(http.MethodDelete)
+	s.router.HandleFunc("/v3/instance/{instance}/user", s.getUsers).Methods(http.MethodGet)
+	s.router.HandleFunc("/v3/instance/{instance}/user", s.createUser).Methods(http.MethodPost)
+	s.router.HandleFunc("/v3/instance/{instance}/user/{user}", s.deleteUser).Methods(http.MethodDelete)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	latency, status := s.intercept(r.Method, r.URL.Path)
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": "injected failure"})
+		return
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+// intercept returns the latency of a request and the status of the failure injected into it, if any.
+func (s *Server) intercept(method string, path string) (time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, failure := range s.failures {
+		if failure.Method != "" && failure.Method != method {
+			continue
+		}
+		if !strings.HasPrefix(path, failure.PathPrefix) {
+			continue
+		}
+		if failure.Count > 0 {
+			failure.Count--
+			if failure.Count == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return s.options.Latency, failure.Status
+	}
+
+	if s.options.FailureRate > 0 && s.random.Float64() < s.options.FailureRate {
+		return s.options.Latency, http.StatusInternalServerError
+	}
+	return s.options.Latency, 0
+}
+
+// SetLatency changes the latency of subsequent requests.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.Latency = latency
+}
+
+// SetFailureRate changes the fraction of subsequent requests that fail.
+func (s *Server) SetFailureRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.FailureRate = rate
+}
+
+// SetReadyAfter changes how long subsequently created addresses are not ready.
+func (s *Server) SetReadyAfter(readyAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.ReadyAfter = readyAfter
+}
+
+// SetAddressStatus overrides the status of an address, as if reported by the address controller.
+func (s *Server) SetAddressStatus(infraID string, name string, status maas.AddressStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return err
+	}
+	address, ok := inst.addresses[name]
+	if !ok {
+		return fmt.Errorf("address %s not found", name)
+	}
+	address.Status = &status
+	inst.addresses[name] = address
+	return nil
+}
+
+// Fail injects failure into the requests matching it. Failures are matched in the order they were added.
+func (s *Server) Fail(failure Failure) {
+	if failure.Count == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure)
+}
+
+// ClearFailures removes all injected failures.
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = nil
+}
+
+// Instances returns the instances, sorted by name.
+func (s *Server) Instances() []maas.Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.instanceList()
+}
+
+// Addresses returns the addresses of an instance, sorted by name.
+func (s *Server) Addresses(infraID string) []maas.Address {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inst, ok := s.instances[infraID]; ok {
+		return addressList(inst)
+	}
+	return nil
+}
+
+// Users returns the users of an instance, sorted by name.
+func (s *Server) Users(infraID string) []maas.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.instances[infraID]
+	if !ok {
+		return nil
+	}
+	return userList(inst)
+}
+
+// AddUser adds a user to an instance, as if it had been created through the API.
+func (s *Server) AddUser(infraID string, user maas.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.instance(infraID)
+	if err != nil {
+		return err
+	}
+	inst.users[user.Metadata.Name] = user
+	return nil
+}
+
+func userList(inst *instance) []maas.User {
+	users := []maas.User{}
+	for _, user := range inst.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Metadata.Name < users[j].Metadata.Name })
+	return users
+}
+
+// AddInstance adds an instance, as if it had been created through the API.
+func (s *Server) AddInstance(inst maas.Instance) maas.Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addInstance(inst)
+}
+
+func (s *Server) addInstance(inst maas.Instance) maas.Instance {
+	name := inst.Metadata.Name
+	if existing, ok := s.instances[name]; ok {
+		return existing.instance
+	}
+	if inst.Spec.Namespace == "" {
+		inst.Spec.Namespace = "enmasse-" + name
+	}
+	if inst.Spec.MessagingHost == "" {
+		inst.Spec.MessagingHost = "messaging-" + inst.Spec.Namespace + ".example.com"
+	}
+	if inst.Spec.MQTTHost == "" {
+		inst.Spec.MQTTHost = "mqtt-" + inst.Spec.Namespace + ".example.com"
+	}
+	if inst.Spec.ConsoleHost == "" {
+		inst.Spec.ConsoleHost = "console-" + inst.Spec.Namespace + ".example.com"
+	}
+	s.instances[name] = &instance{
+		instance:  inst,
+		addresses: make(map[string]maas.Address),
+		users:     make(map[string]maas.User),
+	}
+	return inst
+}
+
+func (s *Server) instanceList() []maas.Instance {
+	instances := []maas.Instance{}
+	for _, inst := range s.instances {
+		instances = append(instances, inst.instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Metadata.Name < instances[j].Metadata.Name })
+	return instances
+}
+
+func addressList(inst *instance) []maas.Address {
+	addresses := []maas.Address{}
+	for _, address := range inst.addresses {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].Metadata.Name < addresses[j].Metadata.Name })
+	return addresses
+}
+
+func (s *Server) getFlavors(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, maas.FlavorList{Kind: "FlavorList", ApiVersion: "v3", Items: s.flavors})
+}
+
+func (s *Server) getInstances(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, maas.InstanceList{Items: s.instanceList()})
+}
+
+func (s *Server) createInstance(w http.ResponseWriter, r *http.Request) {
+	var inst maas.Instance
+	if err := json.NewDecoder(r.Body).Decode(&inst); err != nil || inst.Metadata.Name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid instance"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.addInstance(inst))
+}
+
+func (s *Server) getInstance(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, inst.instance)
+}
+
+func (s *Server) deleteInstance(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	delete(s.instances, inst.instance.Metadata.Name)
+	writeJSON(w, http.StatusOK, maas.InstanceList{Items: s.instanceList()})
+}
+
+func (s *Server) getAddresses(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, maas.AddressList{Items: addressList(inst)})
+}
+
+// createAddresses accepts either a single address or an address list, like the address controller.
+func (s *Server) createAddresses(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		maas.Address
+		Items []maas.Address `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid address: " + err.Error()})
+		return
+	}
+	addresses := body.Items
+	if len(addresses) == 0 {
+		addresses = []maas.Address{body.Address}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	if err := s.putAddresses(inst, addresses); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, maas.AddressList{Items: addressList(inst)})
+}
+
+// putAddresses adds or replaces the addresses of an instance, unless one of them is invalid. The addresses
+// become ready after the configured delay.
+func (s *Server) putAddresses(inst *instance, addresses []maas.Address) error {
+	for _, address := range addresses {
+		if address.Metadata.Name == "" {
+			return fmt.Errorf("address without name")
+		}
+		if address.Spec.Flavor != "" && !s.hasFlavor(address.Spec.Flavor) {
+			return fmt.Errorf("unknown flavor %s", address.Spec.Flavor)
+		}
+	}
+	for _, address := range addresses {
+		if address.Metadata.Uuid == "" {
+			address.Metadata.Uuid = uuid.New()
+		}
+		address.Status = &maas.AddressStatus{IsReady: s.options.ReadyAfter == 0}
+		if !address.Status.IsReady {
+			address.Status.Messages = []string{"Waiting for the router and broker deployments"}
+			time.AfterFunc(s.options.ReadyAfter, s.markReady(inst, address.Metadata.Name, address.Metadata.Uuid))
+		}
+		inst.addresses[address.Metadata.Name] = address
+	}
+	return nil
+}
+
+// markReady returns a function marking an address ready, unless it has been replaced in the meantime.
+func (s *Server) markReady(inst *instance, name string, addressUUID string) func() {
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if address, ok := inst.addresses[name]; ok && address.Metadata.Uuid == addressUUID {
+			address.Status = &maas.AddressStatus{IsReady: true}
+			inst.addresses[name] = address
+		}
+	}
+}
+
+func (s *Server) getAddress(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	address, ok := inst.addresses[mux.Vars(r)["address"]]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "address not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, address)
+}
+
+func (s *Server) deleteAddress(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["address"]
+	if _, ok := inst.addresses[name]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "address not found"})
+		return
+	}
+	delete(inst.addresses, name)
+	writeJSON(w, http.StatusOK, maas.AddressList{Items: addressList(inst)})
+}
+
+func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, maas.UserList{Items: userList(inst)})
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var user maas.User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil || user.Metadata.Name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	inst.users[user.Metadata.Name] = user
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.lookupInstance(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["user"]
+	if _, ok := inst.users[name]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+	delete(inst.users, name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// lookupInstance returns the instance named in the request path, or writes 404 Not Found.
+func (s *Server) lookupInstance(w http.ResponseWriter, r *http.Request) (*instance, bool) {
+	inst, ok := s.instances[mux.Vars(r)["instance"]]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "instance not found"})
+	}
+	return inst, ok
+}
+
+func (s *Server) hasFlavor(name string) bool {
+	for _, flavor := range s.flavors {
+		if flavor.Metadata.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,36 @@
+package fakemaas
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFailureCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		failure  Failure
+		failures int
+	}{
+		{name: "never", failure: Failure{Status: http.StatusServiceUnavailable}, failures: 0},
+		{name: "once", failure: Failure{Status: http.StatusServiceUnavailable, Count: 1}, failures: 1},
+		{name: "twice", failure: Failure{Status: http.StatusServiceUnavailable, Count: 2}, failures: 2},
+		{name: "until removed", failure: Failure{Status: http.StatusServiceUnavailable, Count: -1}, failures: 5},
+		{name: "other method", failure: Failure{Method: http.MethodPost, Status: http.StatusServiceUnavailable, Count: -1}, failures: 0},
+		{name: "other path", failure: Failure{PathPrefix: "/v3/instance", Status: http.StatusServiceUnavailable, Count: -1}, failures: 0},
+	}
+
+	for _, test := range tests {
+		server := NewServer(Options{})
+		server.Fail(test.failure)
+		failures := 0
+		for i := 0; i < 5; i++ {
+			if _, err := server.GetFlavors(context.Background()); err != nil {
+				failures++
+			}
+		}
+		if failures != test.failures {
+			t.Errorf("%s: expected %d failures, got %d", test.name, test.failures, failures)
+		}
+	}
+}
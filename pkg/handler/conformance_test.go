@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+)
+
+// The conformance tests drive the handler backed by the MaaS broker, which talks to an in-memory address
+// controller, through the lifecycle of instances and bindings, checking the status codes required by the
+// Open Service Broker API.
+
+const (
+	otherInstanceID = "0b0ba2c6-7e27-4a7e-a6c4-6b1f3d62f6a1"
+	infraID         = "org1"
+)
+
+var (
+	queuePlanID = fakemaas.DefaultFlavors()[0].Metadata.Uuid
+	topicPlanID = fakemaas.DefaultFlavors()[3].Metadata.Uuid
+)
+
+func provisionRequest(serviceID string, planID string, name string) string {
+	return `{"service_id": "` + serviceID + `", "plan_id": "` + planID + `", "organization_guid": "` + infraID + `", "space_guid": "space", "parameters": {"name": "` + name + `"}}`
+}
+
+func bindRequest(role string) string {
+	return `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "` + queuePlanID + `", "parameters": {"role": "` + role + `"}}`
+}
+
+type conformanceStep struct {
+	name   string
+	method string
+	path   string
+	body   string
+	status int
+	// code is the error code expected in the body of error responses
+	code  string
+	check func(t *testing.T, body map[string]interface{})
+}
+
+func newConformanceHandler(t *testing.T, config broker.MaasBrokerConfig) (http.Handler, *fakemaas.Server) {
+	server := fakemaas.NewServer(fakemaas.Options{})
+	server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: infraID}})
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	log := logging.MustGetLogger("test")
+	client, err := maas.NewMaasClient(maas.MaasClientConfig{Url: ts.URL}, log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := broker.NewMaasBroker(config, log, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(log, b, nil), server
+}
+
+func runSteps(t *testing.T, h http.Handler, steps []conformanceStep) {
+	for _, step := range steps {
+		rec := serve(h, step.method, step.path, step.body, nil)
+		if rec.Code != step.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", step.name, step.status, rec.Code, rec.Body.String())
+		}
+		body := decodeObject(t, rec)
+		if step.status >= http.StatusBadRequest {
+			checkError(t, rec, step.code)
+		}
+		if step.check != nil {
+			step.check(t, body)
+		}
+	}
+}
+
+func TestConformanceLifecycle(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{Credentials: broker.CredentialsConfig{BindingUsers: true}})
+
+	queue := provisionRequest(broker.QueueServiceUUID, queuePlanID, "my-queue")
+	unbindQuery := "?service_id=" + broker.QueueServiceUUID + "&plan_id=" + queuePlanID
+	deprovisionQuery := unbindQuery
+
+	runSteps(t, h, []conformanceStep{
+		{name: "catalog", method: http.MethodGet, path: "/v2/catalog", status: http.StatusOK,
+			check: func(t *testing.T, body map[string]interface{}) {
+				if services, _ := body["services"].([]interface{}); len(services) != 4 {
+					t.Errorf("expected anycast, multicast, queue and topic services, got %v", body["services"])
+				}
+			}},
+		{name: "get unknown instance", method: http.MethodGet, path: instancePath, status: http.StatusNotFound},
+		{name: "last operation of unknown instance", method: http.MethodGet, path: instancePath + "/last_operation", status: http.StatusGone},
+		{name: "provision", method: http.MethodPut, path: instancePath, body: queue, status: http.StatusCreated},
+		{name: "provision identical", method: http.MethodPut, path: instancePath, body: queue, status: http.StatusOK},
+		{name: "provision conflicting", method: http.MethodPut, path: instancePath,
+			body: provisionRequest(broker.QueueServiceUUID, queuePlanID, "other-queue"), status: http.StatusConflict},
+		{name: "provision without name", method: http.MethodPut, path: "/v2/service_instances/" + otherInstanceID,
+			body: provisionRequest(broker.QueueServiceUUID, queuePlanID, ""), status: http.StatusBadRequest},
+		{name: "provision mismatching plan", method: http.MethodPut, path: "/v2/service_instances/" + otherInstanceID,
+			body: provisionRequest(broker.QueueServiceUUID, topicPlanID, "my-topic"), status: http.StatusBadRequest},
+		{name: "provision unknown service", method: http.MethodPut, path: "/v2/service_instances/" + otherInstanceID,
+			body: provisionRequest(bindingID, queuePlanID, "my-address"), status: http.StatusBadRequest},
+		{name: "get instance", method: http.MethodGet, path: instancePath, status: http.StatusOK,
+			check: func(t *testing.T, body map[string]interface{}) {
+				if body["service_id"] != broker.QueueServiceUUID || body["plan_id"] != queuePlanID {
+					t.Errorf("unexpected instance %v", body)
+				}
+			}},
+		{name: "last operation", method: http.MethodGet, path: instancePath + "/last_operation", status: http.StatusOK,
+			check: func(t *testing.T, body map[string]interface{}) {
+				if body["state"] != string(broker.LastOperationStateSucceeded) {
+					t.Errorf("unexpected state %v", body)
+				}
+			}},
+		{name: "bind", method: http.MethodPut, path: bindingPath, body: bindRequest(broker.RoleSend), status: http.StatusCreated,
+			check: func(t *testing.T, body map[string]interface{}) {
+				credentials, _ := body["credentials"].(map[string]interface{})
+				if credentials["username"] == nil || credentials["password"] == nil {
+					t.Errorf("expected username and password in credentials, got %v", body)
+				}
+			}},
+		{name: "bind identical", method: http.MethodPut, path: bindingPath, body: bindRequest(broker.RoleSend), status: http.StatusOK},
+		{name: "bind conflicting", method: http.MethodPut, path: bindingPath, body: bindRequest(broker.RoleReceive), status: http.StatusConflict},
+		{name: "bind to unknown instance", method: http.MethodPut, path: "/v2/service_instances/" + otherInstanceID + "/service_bindings/" + bindingID,
+			body: bindRequest(broker.RoleSend), status: http.StatusNotFound},
+		{name: "get binding", method: http.MethodGet, path: bindingPath, status: http.StatusOK},
+		{name: "binding last operation", method: http.MethodGet, path: bindingPath + "/last_operation", status: http.StatusOK},
+		{name: "unbind", method: http.MethodDelete, path: bindingPath + unbindQuery, status: http.StatusOK},
+		{name: "unbind again", method: http.MethodDelete, path: bindingPath + unbindQuery, status: http.StatusGone},
+		{name: "get unbound binding", method: http.MethodGet, path: bindingPath, status: http.StatusNotFound},
+		{name: "last operation of unbound binding", method: http.MethodGet, path: bindingPath + "/last_operation", status: http.StatusGone},
+		{name: "deprovision", method: http.MethodDelete, path: instancePath + deprovisionQuery, status: http.StatusOK},
+		{name: "deprovision again", method: http.MethodDelete, path: instancePath + deprovisionQuery, status: http.StatusGone},
+		{name: "last operation of deprovisioned instance", method: http.MethodGet, path: instancePath + "/last_operation", status: http.StatusGone},
+		{name: "get deprovisioned instance", method: http.MethodGet, path: instancePath, status: http.StatusNotFound},
+	})
+
+	if users := server.Users(infraID); len(users) != 0 {
+		t.Errorf("expected the binding user to be deleted, got %v", users)
+	}
+	if addresses := server.Addresses(infraID); len(addresses) != 0 {
+		t.Errorf("expected the address to be deleted, got %v", addresses)
+	}
+}
+
+func TestConformanceAsyncBinding(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{Credentials: broker.CredentialsConfig{BindingUsers: true}})
+
+	runSteps(t, h, []conformanceStep{
+		{name: "provision", method: http.MethodPut, path: instancePath,
+			body: provisionRequest(broker.QueueServiceUUID, queuePlanID, "my-queue"), status: http.StatusCreated},
+	})
+
+	server.SetLatency(100 * time.Millisecond)
+	var operation string
+	runSteps(t, h, []conformanceStep{
+		{name: "bind asynchronously", method: http.MethodPut, path: bindingPath + "?accepts_incomplete=true",
+			body: bindRequest(broker.RoleSend), status: http.StatusAccepted,
+			check: func(t *testing.T, body map[string]interface{}) {
+				operation, _ = body["operation"].(string)
+			}},
+		{name: "bind concurrently", method: http.MethodPut, path: bindingPath + "?accepts_incomplete=true",
+			body: bindRequest(broker.RoleSend), status: http.StatusUnprocessableEntity, code: errors.ConcurrencyError},
+	})
+	server.SetLatency(0)
+
+	body := pollLastOperation(t, h, bindingPath+"/last_operation?operation="+operation, nil)
+	if body["state"] != string(broker.LastOperationStateSucceeded) {
+		t.Fatalf("unexpected state %v", body)
+	}
+
+	runSteps(t, h, []conformanceStep{
+		{name: "get binding", method: http.MethodGet, path: bindingPath, status: http.StatusOK},
+	})
+}
+
+func TestConformanceSharedCredentials(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{})
+
+	shared := `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "` + queuePlanID + `"}`
+	runSteps(t, h, []conformanceStep{
+		{name: "provision", method: http.MethodPut, path: instancePath,
+			body: provisionRequest(broker.QueueServiceUUID, queuePlanID, "my-queue"), status: http.StatusCreated},
+		{name: "bind with role", method: http.MethodPut, path: bindingPath, body: bindRequest(broker.RoleSend), status: http.StatusBadRequest},
+		{name: "bind", method: http.MethodPut, path: bindingPath, body: shared, status: http.StatusCreated,
+			check: func(t *testing.T, body map[string]interface{}) {
+				credentials, _ := body["credentials"].(map[string]interface{})
+				if credentials["addressName"] != "my-queue" || credentials["username"] != nil {
+					t.Errorf("expected the shared connection details, got %v", body)
+				}
+			}},
+		{name: "rotate", method: http.MethodPost, path: bindingPath + "/rotate", status: http.StatusBadRequest},
+		{name: "unbind", method: http.MethodDelete, path: bindingPath + "?service_id=" + broker.QueueServiceUUID + "&plan_id=" + queuePlanID,
+			status: http.StatusOK},
+	})
+
+	if users := server.Users(infraID); len(users) != 0 {
+		t.Errorf("expected no binding users, got %v", users)
+	}
+}
+
+// pollLastOperation polls the last operation at path until it is no longer in progress, returning its body.
+// The descriptions reported while in progress are passed to progress.
+func pollLastOperation(t *testing.T, h http.Handler, path string, progress func(description string)) map[string]interface{} {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := serve(h, http.MethodGet, path, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		body := decodeObject(t, rec)
+		if body["state"] != string(broker.LastOperationStateInProgress) {
+			return body
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("operation still in progress: %v", body)
+		}
+		if progress != nil {
+			description, _ := body["description"].(string)
+			progress(description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConformanceAsyncProvisioning(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{
+		Readiness: broker.ReadinessConfig{PollInterval: 10 * time.Millisecond},
+	})
+	server.SetReadyAfter(200 * time.Millisecond)
+
+	var operation string
+	runSteps(t, h, []conformanceStep{
+		{name: "provision asynchronously", method: http.MethodPut, path: instancePath + "?accepts_incomplete=true",
+			body: provisionRequest(broker.QueueServiceUUID, queuePlanID, "my-queue"), status: http.StatusAccepted,
+			check: func(t *testing.T, body map[string]interface{}) {
+				operation, _ = body["operation"].(string)
+			}},
+		{name: "deprovision while provisioning", method: http.MethodDelete,
+			path:   instancePath + "?service_id=" + broker.QueueServiceUUID + "&plan_id=" + queuePlanID,
+			status: http.StatusUnprocessableEntity, code: errors.ConcurrencyError},
+	})
+
+	var descriptions []string
+	body := pollLastOperation(t, h, instancePath+"/last_operation?operation="+operation, func(description string) {
+		descriptions = append(descriptions, description)
+	})
+	if body["state"] != string(broker.LastOperationStateSucceeded) {
+		t.Fatalf("expected provisioning to succeed, got %v", body)
+	}
+	if len(descriptions) == 0 || !strings.Contains(descriptions[len(descriptions)-1], "Waiting for the router") {
+		t.Errorf("expected the address status to describe the operation in progress, got %v", descriptions)
+	}
+}
+
+func TestConformanceProvisioningTimeout(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{
+		Readiness: broker.ReadinessConfig{
+			PollInterval:   10 * time.Millisecond,
+			FlavorTimeouts: map[string]time.Duration{fakemaas.DefaultFlavors()[0].Metadata.Name: 50 * time.Millisecond},
+		},
+	})
+	server.SetReadyAfter(time.Hour)
+
+	runSteps(t, h, []conformanceStep{
+		{name: "provision asynchronously", method: http.MethodPut, path: instancePath + "?accepts_incomplete=true",
+			body: provisionRequest(broker.QueueServiceUUID, queuePlanID, "my-queue"), status: http.StatusAccepted},
+	})
+	if err := server.SetAddressStatus(infraID, "my-queue", maas.AddressStatus{Messages: []string{"Insufficient memory"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := pollLastOperation(t, h, instancePath+"/last_operation", nil)
+	description, _ := body["description"].(string)
+	if body["state"] != string(broker.LastOperationStateFailed) || !strings.Contains(description, "Insufficient memory") || !strings.Contains(description, "after 50ms") {
+		t.Errorf("expected provisioning to time out, got %v", body)
+	}
+
+	runSteps(t, h, []conformanceStep{
+		{name: "deprovision failed instance", method: http.MethodDelete,
+			path: instancePath + "?service_id=" + broker.QueueServiceUUID + "&plan_id=" + queuePlanID, status: http.StatusOK},
+	})
+}
+
+func TestConformanceBackendFailure(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{})
+
+	server.Fail(fakemaas.Failure{Method: http.MethodGet, PathPrefix: "/v3/flavor", Status: http.StatusServiceUnavailable, Count: 1})
+	server.Fail(fakemaas.Failure{Method: http.MethodPost, PathPrefix: "/v3/instance/" + infraID + "/address", Status: http.StatusServiceUnavailable, Count: 1})
+
+	queue := provisionRequest(broker.QueueServiceUUID, queuePlanID, "my-queue")
+	runSteps(t, h, []conformanceStep{
+		{name: "catalog", method: http.MethodGet, path: "/v2/catalog", status: http.StatusInternalServerError},
+		{name: "provision", method: http.MethodPut, path: instancePath, body: queue, status: http.StatusInternalServerError},
+		{name: "provision retried", method: http.MethodPut, path: instancePath, body: queue, status: http.StatusCreated},
+	})
+}
+
+func TestConformanceNamespaces(t *testing.T) {
+	h, server := newConformanceHandler(t, broker.MaasBrokerConfig{})
+
+	fromNamespace := func(namespace string) string {
+		return `"context": {"platform": "kubernetes", "namespace": "` + namespace + `"}`
+	}
+	provision := `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "` + queuePlanID + `", "organization_guid": "` + infraID +
+		`", "space_guid": "space", ` + fromNamespace("team-a") + `, "parameters": {"name": "my-queue"}}`
+	bind := func(namespace string) string {
+		return `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "` + queuePlanID + `", ` + fromNamespace(namespace) + `}`
+	}
+	otherBindingPath := instancePath + "/service_bindings/" + otherInstanceID
+
+	runSteps(t, h, []conformanceStep{
+		{name: "provision", method: http.MethodPut, path: instancePath, body: provision, status: http.StatusCreated},
+	})
+	addresses := server.Addresses(infraID)
+	if len(addresses) != 1 || addresses[0].Metadata.Labels[broker.NamespaceLabel] != "team-a" {
+		t.Fatalf("expected the address to be labelled with namespace team-a, got %v", addresses)
+	}
+
+	runSteps(t, h, []conformanceStep{
+		{name: "bind from another namespace", method: http.MethodPut, path: bindingPath, body: bind("team-b"), status: http.StatusForbidden},
+		{name: "get binding refused", method: http.MethodGet, path: bindingPath, status: http.StatusNotFound},
+		{name: "bind from the namespace", method: http.MethodPut, path: bindingPath, body: bind("team-a"), status: http.StatusCreated},
+		{name: "bind without namespace", method: http.MethodPut, path: otherBindingPath,
+			body: `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "` + queuePlanID + `"}`, status: http.StatusCreated},
+	})
+}
@@ -4,33 +4,42 @@ import (
 	"net/http"
 
 	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/redact"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
 	"github.com/gorilla/mux"
 	"github.com/op/go-logging"
 	"github.com/pborman/uuid"
 )
 
-// TODO: implement asynchronous operations
 // TODO: authentication / authorization
 
 type handler struct {
 	log    *logging.Logger
 	router mux.Router
 	broker broker.Broker
+	tracer *redact.Tracer
 }
 
-func NewHandler(log *logging.Logger, b broker.Broker) http.Handler {
-	h := handler{log: log, broker: b}
+func NewHandler(log *logging.Logger, b broker.Broker, tracer *redact.Tracer) http.Handler {
+	h := handler{log: log, broker: b, tracer: tracer}
 
 	// TODO: handle X-Broker-API-Version header, currently poorly defined
 	//root := h.router.Headers("X-Broker-API-Version", "2.9").Subrouter()
 	root := h.router.PathPrefix("/").Subrouter()
 
-	root.HandleFunc("/v2/catalog", h.catalog).Methods(http.MethodGet)
-	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.provision).Methods(http.MethodPut)
-	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.update).Methods(http.MethodPatch)
-	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.deprovision).Methods(http.MethodDelete)
-	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}", h.bind).Methods(http.MethodPut)
-	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}", h.unbind).Methods(http.MethodDelete)
+	root.HandleFunc("/v2/catalog", h.traced("catalog", h.catalog)).Methods(http.MethodGet)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.traced("provision", h.provision)).Methods(http.MethodPut)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.traced("update", h.update)).Methods(http.MethodPatch)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.traced("deprovision", h.deprovision)).Methods(http.MethodDelete)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}", h.traced("get_instance", h.getInstance)).Methods(http.MethodGet)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}/last_operation", h.traced("last_operation", h.lastOperation)).Methods(http.MethodGet)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}", h.traced("bind", h.bind)).Methods(http.MethodPut)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}", h.traced("unbind", h.unbind)).Methods(http.MethodDelete)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}", h.traced("get_binding", h.getBinding)).Methods(http.MethodGet)
+	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}/last_operation", h.traced("binding_last_operation", h.bindingLastOperation)).Methods(http.MethodGet)
+
+	// Extensions to the Open Service Broker API
+	root.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}/rotate", h.traced("rotate", h.rotate)).Methods(http.MethodPost)
 
 	// TODO NotFoundHandler (must return json!)
 
@@ -38,44 +47,83 @@ func NewHandler(log *logging.Logger, b broker.Broker) http.Handler {
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(reqctx.RequestIDHeader)
+	if requestID == "" {
+		requestID = r.Header.Get(reqctx.BrokerRequestIDHeader)
+	}
+	requestID = reqctx.NewRequestID(requestID)
+	w.Header().Set(reqctx.RequestIDHeader, requestID)
+	r = r.WithContext(reqctx.WithRequestID(r.Context(), requestID))
+
+	log := reqctx.Logger(r.Context(), h.log)
+	log.Info("%s %s", r.Method, r.RequestURI)
+
+	identity, err := readOriginatingIdentity(r)
+	if err != nil {
+		writeErrorResponse(w, err, log)
+		return
+	}
+	if identity != nil {
+		log.Info("Request on behalf of %s user %s", identity.Platform, identity.User())
+		r = r.WithContext(broker.WithOriginatingIdentity(r.Context(), identity))
+	}
+
 	h.router.ServeHTTP(w, r)
 }
 
+// traced records the operation and the instance it applies to in the request context, so that they are
+// attached to everything logged while serving the request.
+func (h handler) traced(operation string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := reqctx.WithOperation(r.Context(), operation)
+		if instanceUUID, ok := mux.Vars(r)["instance_uuid"]; ok {
+			ctx = reqctx.WithInstanceID(ctx, instanceUUID)
+		}
+		fn(w, r.WithContext(ctx))
+	}
+}
+
 func (h handler) catalog(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	resp, err := h.broker.Catalog()
-	writeDefaultResponse(w, http.StatusOK, resp, err, h.log)
+	log := reqctx.Logger(r.Context(), h.log)
+	resp, err := h.broker.Catalog(r.Context())
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
 }
 
 func (h handler) provision(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	h.log.Info("Received provision request: " + r.RequestURI)
+	log := reqctx.Logger(r.Context(), h.log)
+	log.Info("Received provision request: %s", r.RequestURI)
 
 	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
 	if instanceUUID == nil {
-		h.log.Info("Invalid instance_uuid in request")
+		log.Info("Invalid instance_uuid in request")
 		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
 		return
 	}
 
 	var req *broker.ProvisionRequest
-	err := readRequest(h.log, r, &req)
+	err := readRequest(log, h.tracer, r, &req)
 
 	if err != nil {
-		writeErrorResponse(w, err, h.log)
+		writeErrorResponse(w, err, log)
 		return
 	}
+	if acceptsIncomplete(r) {
+		req.AcceptsIncomplete = true
+	}
 
-	resp, err := h.broker.Provision(instanceUUID, req)
+	resp, err := h.broker.Provision(r.Context(), instanceUUID, req)
 	if resp != nil {
-		writeDefaultResponse(w, resp.StatusCode, resp, err, h.log)
+		writeDefaultResponse(w, resp.StatusCode, resp, err, log)
 	} else {
-		writeDefaultResponse(w, 0, resp, err, h.log)
+		writeDefaultResponse(w, 0, resp, err, log)
 	}
 }
 
 func (h handler) update(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
 
 	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
 	if instanceUUID == nil {
@@ -84,54 +132,86 @@ func (h handler) update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req *broker.UpdateRequest
-	if err := readRequest(h.log, r, &req); err != nil {
+	if err := readRequest(log, h.tracer, r, &req); err != nil {
 		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: err.Error()})
 		return
 	}
 
-	resp, err := h.broker.Update(instanceUUID, req)
+	resp, err := h.broker.Update(r.Context(), instanceUUID, req)
 
-	writeDefaultResponse(w, http.StatusOK, resp, err, h.log)
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
 }
 
 func (h handler) deprovision(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
 
-	h.log.Info("Received deprovision request: " + r.RequestURI)
+	log.Info("Received deprovision request: %s", r.RequestURI)
 
 	instanceUUIDstring := mux.Vars(r)["instance_uuid"]
 	instanceUUID := uuid.Parse(instanceUUIDstring)
 	if instanceUUID == nil {
-		h.log.Info("Invalid instance_uuid in request: %s", instanceUUIDstring)
+		log.Info("Invalid instance_uuid in request: %s", instanceUUIDstring)
 		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
 		return
 	}
 
 	serviceId := r.FormValue("service_id")
 	if serviceId == "" {
-		h.log.Info("Missing service_id parameter")
+		log.Info("Missing service_id parameter")
 		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "missing service_id parameter"})
 		return
 	}
 
 	planId := r.FormValue("plan_id")
 	if planId == "" {
-		h.log.Info("Missing plan_id parameter")
+		log.Info("Missing plan_id parameter")
 		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "missing plan_id parameter"})
 		return
 	}
 
-	resp, err := h.broker.Deprovision(instanceUUID, serviceId, planId)
+	resp, err := h.broker.Deprovision(r.Context(), instanceUUID, serviceId, planId)
 
 	//if errors.IsNotFound(err) {
 	//	writeResponse(w, http.StatusGone, broker.DeprovisionResponse{})
 	//} else {
-	writeDefaultResponse(w, http.StatusOK, resp, err, h.log)
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
 	//}
 }
 
+func (h handler) getInstance(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
+
+	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
+	if instanceUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
+		return
+	}
+
+	resp, err := h.broker.GetInstance(r.Context(), instanceUUID)
+
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
+}
+
+func (h handler) lastOperation(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
+
+	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
+	if instanceUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
+		return
+	}
+
+	resp, err := h.broker.LastOperation(r.Context(), instanceUUID, readLastOperationRequest(r))
+
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
+}
+
 func (h handler) bind(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
 
 	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
 	if instanceUUID == nil {
@@ -146,18 +226,25 @@ func (h handler) bind(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req *broker.BindRequest
-	if err := readRequest(h.log, r, &req); err != nil {
-		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: err.Error()})
+	if err := readRequest(log, h.tracer, r, &req); err != nil {
+		writeErrorResponse(w, err, log)
 		return
 	}
+	if acceptsIncomplete(r) {
+		req.AcceptsIncomplete = true
+	}
 
-	resp, err := h.broker.Bind(instanceUUID, bindingUUID, req)
-
-	writeDefaultResponse(w, http.StatusCreated, resp, err, h.log)
+	resp, err := h.broker.Bind(r.Context(), instanceUUID, bindingUUID, req)
+	if resp != nil {
+		writeDefaultResponse(w, resp.StatusCode, resp, err, log)
+	} else {
+		writeDefaultResponse(w, 0, resp, err, log)
+	}
 }
 
 func (h handler) unbind(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
 
 	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
 	if instanceUUID == nil {
@@ -171,12 +258,81 @@ func (h handler) unbind(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.broker.Unbind(instanceUUID, bindingUUID)
+	req := &broker.UnbindRequest{
+		ServiceID:         r.FormValue("service_id"),
+		PlanID:            r.FormValue("plan_id"),
+		AcceptsIncomplete: acceptsIncomplete(r),
+	}
 
-	//if errors.IsNotFound(err) {
-	//	writeResponse(w, http.StatusGone, struct{}{})
-	//} else {
-	writeDefaultResponse(w, http.StatusOK, struct{}{}, err, h.log)
-	//}
-	return
+	resp, err := h.broker.Unbind(r.Context(), instanceUUID, bindingUUID, req)
+	if resp != nil {
+		writeDefaultResponse(w, resp.StatusCode, resp, err, log)
+	} else {
+		writeDefaultResponse(w, 0, resp, err, log)
+	}
+}
+
+func (h handler) getBinding(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
+
+	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
+	if instanceUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
+		return
+	}
+
+	bindingUUID := uuid.Parse(mux.Vars(r)["binding_uuid"])
+	if bindingUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid binding_uuid"})
+		return
+	}
+
+	resp, err := h.broker.GetBinding(r.Context(), instanceUUID, bindingUUID)
+
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
+}
+
+func (h handler) bindingLastOperation(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
+
+	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
+	if instanceUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
+		return
+	}
+
+	bindingUUID := uuid.Parse(mux.Vars(r)["binding_uuid"])
+	if bindingUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid binding_uuid"})
+		return
+	}
+
+	resp, err := h.broker.BindingLastOperation(r.Context(), instanceUUID, bindingUUID, readLastOperationRequest(r))
+
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
+}
+
+func (h handler) rotate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	log := reqctx.Logger(r.Context(), h.log)
+
+	log.Info("Received credentials rotation request: %s", r.RequestURI)
+
+	instanceUUID := uuid.Parse(mux.Vars(r)["instance_uuid"])
+	if instanceUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
+		return
+	}
+
+	bindingUUID := uuid.Parse(mux.Vars(r)["binding_uuid"])
+	if bindingUUID == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid binding_uuid"})
+		return
+	}
+
+	resp, err := h.broker.RotateCredentials(r.Context(), instanceUUID, bindingUUID)
+
+	writeDefaultResponse(w, http.StatusOK, resp, err, log)
 }
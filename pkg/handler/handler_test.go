@@ -0,0 +1,420 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	goerrors "errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
+	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+const (
+	instanceID = "a71f7ab8-e448-4826-8f05-32a185222dd7"
+	bindingID  = "dde0226b-ff95-4f9d-af51-2e9ec06b1f02"
+
+	instancePath = "/v2/service_instances/" + instanceID
+	bindingPath  = instancePath + "/service_bindings/" + bindingID
+)
+
+func TestMain(m *testing.M) {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+// fakeBroker returns the responses and errors configured for each method and records the last request.
+type fakeBroker struct {
+	err error
+
+	provisionResponse *broker.ProvisionResponse
+	bindResponse      *broker.BindResponse
+	unbindResponse    *broker.UnbindResponse
+
+	ctx               context.Context
+	provisionRequest  *broker.ProvisionRequest
+	bindRequest       *broker.BindRequest
+	unbindRequest     *broker.UnbindRequest
+	deprovisionParams []string
+	lastOperation     *broker.LastOperationRequest
+}
+
+func (b *fakeBroker) Catalog(ctx context.Context) (*broker.CatalogResponse, error) {
+	b.ctx = ctx
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.CatalogResponse{Services: []broker.Service{{Name: broker.QueueServiceName, Plans: []broker.Plan{}}}}, nil
+}
+
+func (b *fakeBroker) Provision(ctx context.Context, instanceUUID uuid.UUID, req *broker.ProvisionRequest) (*broker.ProvisionResponse, error) {
+	b.ctx, b.provisionRequest = ctx, req
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.provisionResponse, nil
+}
+
+func (b *fakeBroker) Update(ctx context.Context, instanceUUID uuid.UUID, req *broker.UpdateRequest) (*broker.UpdateResponse, error) {
+	b.ctx = ctx
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.UpdateResponse{}, nil
+}
+
+func (b *fakeBroker) Deprovision(ctx context.Context, instanceUUID uuid.UUID, serviceId string, planId string) (*broker.DeprovisionResponse, error) {
+	b.ctx, b.deprovisionParams = ctx, []string{serviceId, planId}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.DeprovisionResponse{}, nil
+}
+
+func (b *fakeBroker) GetInstance(ctx context.Context, instanceUUID uuid.UUID) (*broker.GetInstanceResponse, error) {
+	b.ctx = ctx
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.GetInstanceResponse{ServiceID: broker.QueueServiceUUID}, nil
+}
+
+func (b *fakeBroker) LastOperation(ctx context.Context, instanceUUID uuid.UUID, req *broker.LastOperationRequest) (*broker.LastOperationResponse, error) {
+	b.ctx, b.lastOperation = ctx, req
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.LastOperationResponse{State: broker.LastOperationStateInProgress}, nil
+}
+
+func (b *fakeBroker) Bind(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *broker.BindRequest) (*broker.BindResponse, error) {
+	b.ctx, b.bindRequest = ctx, req
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.bindResponse, nil
+}
+
+func (b *fakeBroker) Unbind(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *broker.UnbindRequest) (*broker.UnbindResponse, error) {
+	b.ctx, b.unbindRequest = ctx, req
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.unbindResponse, nil
+}
+
+func (b *fakeBroker) GetBinding(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID) (*broker.GetBindingResponse, error) {
+	b.ctx = ctx
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.GetBindingResponse{Credentials: map[string]interface{}{"username": "user"}}, nil
+}
+
+func (b *fakeBroker) BindingLastOperation(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID, req *broker.LastOperationRequest) (*broker.LastOperationResponse, error) {
+	b.ctx, b.lastOperation = ctx, req
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.LastOperationResponse{State: broker.LastOperationStateSucceeded}, nil
+}
+
+func (b *fakeBroker) RotateCredentials(ctx context.Context, instanceUUID uuid.UUID, bindingUUID uuid.UUID) (*broker.BindResponse, error) {
+	b.ctx = ctx
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &broker.BindResponse{StatusCode: http.StatusOK, Credentials: map[string]interface{}{"username": "user-2"}}, nil
+}
+
+// serve sends a request with an optional JSON body through the handler.
+func serve(h http.Handler, method string, path string, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeObject decodes a response body, which the OSB API requires to be a JSON object.
+func decodeObject(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body == nil {
+		t.Fatalf("response body %q is not a JSON object", rec.Body.String())
+	}
+	return body
+}
+
+// checkError verifies the shape of an error response: a JSON object with a description, and the error code if any.
+func checkError(t *testing.T, rec *httptest.ResponseRecorder, code string) {
+	body := decodeObject(t, rec)
+	if description, _ := body["description"].(string); description == "" {
+		t.Errorf("error response %q has no description", rec.Body.String())
+	}
+	if errorCode, _ := body["error"].(string); errorCode != code {
+		t.Errorf("expected error code %q, got %q", code, errorCode)
+	}
+}
+
+const (
+	provisionBody = `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "4c10ff42-be89-420a-9bab-27a9bef9aed8", "organization_guid": "org", "space_guid": "space", "parameters": {"name": "my-queue"}}`
+	bindBody      = `{"service_id": "` + broker.QueueServiceUUID + `", "plan_id": "4c10ff42-be89-420a-9bab-27a9bef9aed8"}`
+	updateBody    = `{"service_id": "` + broker.QueueServiceUUID + `", "parameters": {}}`
+)
+
+func TestEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		broker fakeBroker
+		status int
+		check  func(t *testing.T, b *fakeBroker, body map[string]interface{})
+	}{
+		{
+			name: "catalog", method: http.MethodGet, path: "/v2/catalog", status: http.StatusOK,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if services, _ := body["services"].([]interface{}); len(services) != 1 {
+					t.Errorf("expected one service, got %v", body["services"])
+				}
+			},
+		},
+		{
+			name: "provision created", method: http.MethodPut, path: instancePath, body: provisionBody,
+			broker: fakeBroker{provisionResponse: &broker.ProvisionResponse{StatusCode: http.StatusCreated, DashboardURL: "http://console"}},
+			status: http.StatusCreated,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if body["dashboard_url"] != "http://console" {
+					t.Errorf("expected dashboard_url, got %v", body)
+				}
+				if b.provisionRequest.Parameters["name"] != "my-queue" || b.provisionRequest.AcceptsIncomplete {
+					t.Errorf("unexpected provision request %+v", b.provisionRequest)
+				}
+			},
+		},
+		{
+			name: "provision identical", method: http.MethodPut, path: instancePath, body: provisionBody,
+			broker: fakeBroker{provisionResponse: &broker.ProvisionResponse{StatusCode: http.StatusOK}},
+			status: http.StatusOK,
+		},
+		{
+			name: "provision accepted", method: http.MethodPut, path: instancePath + "?accepts_incomplete=true", body: provisionBody,
+			broker: fakeBroker{provisionResponse: &broker.ProvisionResponse{StatusCode: http.StatusAccepted, Operation: "op-1"}},
+			status: http.StatusAccepted,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if body["operation"] != "op-1" || !b.provisionRequest.AcceptsIncomplete {
+					t.Errorf("expected asynchronous provisioning, got %v", body)
+				}
+			},
+		},
+		{
+			name: "update", method: http.MethodPatch, path: instancePath, body: updateBody, status: http.StatusOK,
+		},
+		{
+			name: "deprovision", method: http.MethodDelete, path: instancePath + "?service_id=s&plan_id=p", status: http.StatusOK,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if b.deprovisionParams[0] != "s" || b.deprovisionParams[1] != "p" {
+					t.Errorf("unexpected deprovision parameters %v", b.deprovisionParams)
+				}
+			},
+		},
+		{
+			name: "get instance", method: http.MethodGet, path: instancePath, status: http.StatusOK,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if body["service_id"] != broker.QueueServiceUUID {
+					t.Errorf("expected service_id, got %v", body)
+				}
+			},
+		},
+		{
+			name: "last operation", method: http.MethodGet, path: instancePath + "/last_operation?operation=op-1", status: http.StatusOK,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if body["state"] != string(broker.LastOperationStateInProgress) || b.lastOperation.Operation != "op-1" {
+					t.Errorf("unexpected last operation %v", body)
+				}
+			},
+		},
+		{
+			name: "bind created", method: http.MethodPut, path: bindingPath, body: bindBody,
+			broker: fakeBroker{bindResponse: &broker.BindResponse{StatusCode: http.StatusCreated, Credentials: map[string]interface{}{"username": "user"}}},
+			status: http.StatusCreated,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if _, ok := body["credentials"].(map[string]interface{}); !ok {
+					t.Errorf("expected credentials, got %v", body)
+				}
+			},
+		},
+		{
+			name: "bind identical", method: http.MethodPut, path: bindingPath, body: bindBody,
+			broker: fakeBroker{bindResponse: &broker.BindResponse{StatusCode: http.StatusOK}},
+			status: http.StatusOK,
+		},
+		{
+			name: "bind accepted", method: http.MethodPut, path: bindingPath + "?accepts_incomplete=true", body: bindBody,
+			broker: fakeBroker{bindResponse: &broker.BindResponse{StatusCode: http.StatusAccepted, Operation: "op-2"}},
+			status: http.StatusAccepted,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if body["operation"] != "op-2" || !b.bindRequest.AcceptsIncomplete {
+					t.Errorf("expected asynchronous binding, got %v", body)
+				}
+			},
+		},
+		{
+			name: "unbind", method: http.MethodDelete, path: bindingPath + "?service_id=s&plan_id=p",
+			broker: fakeBroker{unbindResponse: &broker.UnbindResponse{StatusCode: http.StatusOK}},
+			status: http.StatusOK,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if b.unbindRequest.ServiceID != "s" || b.unbindRequest.PlanID != "p" || b.unbindRequest.AcceptsIncomplete {
+					t.Errorf("unexpected unbind request %+v", b.unbindRequest)
+				}
+			},
+		},
+		{
+			name: "unbind accepted", method: http.MethodDelete, path: bindingPath + "?service_id=s&plan_id=p&accepts_incomplete=true",
+			broker: fakeBroker{unbindResponse: &broker.UnbindResponse{StatusCode: http.StatusAccepted, Operation: "op-3"}},
+			status: http.StatusAccepted,
+		},
+		{
+			name: "get binding", method: http.MethodGet, path: bindingPath, status: http.StatusOK,
+		},
+		{
+			name: "binding last operation", method: http.MethodGet, path: bindingPath + "/last_operation", status: http.StatusOK,
+			check: func(t *testing.T, b *fakeBroker, body map[string]interface{}) {
+				if body["state"] != string(broker.LastOperationStateSucceeded) {
+					t.Errorf("unexpected last operation %v", body)
+				}
+			},
+		},
+		{
+			name: "rotate", method: http.MethodPost, path: bindingPath + "/rotate", status: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := test.broker
+			rec := serve(NewHandler(logging.MustGetLogger("test"), &b, nil), test.method, test.path, test.body, nil)
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body.String())
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %q", contentType)
+			}
+			body := decodeObject(t, rec)
+			if test.check != nil {
+				test.check(t, &b, body)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		err    error
+		status int
+		code   string
+	}{
+		{"invalid instance id", http.MethodPut, "/v2/service_instances/not-a-uuid", provisionBody, nil, http.StatusBadRequest, ""},
+		{"invalid binding id", http.MethodPut, instancePath + "/service_bindings/not-a-uuid", bindBody, nil, http.StatusBadRequest, ""},
+		{"malformed provision", http.MethodPut, instancePath, "{", nil, http.StatusBadRequest, ""},
+		{"empty provision", http.MethodPut, instancePath, "", nil, http.StatusBadRequest, ""},
+		{"malformed update", http.MethodPatch, instancePath, "{", nil, http.StatusBadRequest, ""},
+		{"malformed bind", http.MethodPut, bindingPath, "{", nil, http.StatusBadRequest, ""},
+		{"deprovision without service_id", http.MethodDelete, instancePath + "?plan_id=p", "", nil, http.StatusBadRequest, ""},
+		{"deprovision without plan_id", http.MethodDelete, instancePath + "?service_id=s", "", nil, http.StatusBadRequest, ""},
+		{"provision conflict", http.MethodPut, instancePath, provisionBody, errors.NewServiceInstanceAlreadyExists(instanceID), http.StatusConflict, ""},
+		{"provision concurrency", http.MethodPut, instancePath, provisionBody, errors.NewConcurrencyError(instanceID), http.StatusUnprocessableEntity, errors.ConcurrencyError},
+		{"deprovision gone", http.MethodDelete, instancePath + "?service_id=s&plan_id=p", "", errors.NewServiceInstanceGone(instanceID), http.StatusGone, ""},
+		{"get instance not found", http.MethodGet, instancePath, "", errors.NewServiceInstanceNotFound(instanceID), http.StatusNotFound, ""},
+		{"last operation gone", http.MethodGet, instancePath + "/last_operation", "", errors.NewServiceInstanceGone(instanceID), http.StatusGone, ""},
+		{"bind conflict", http.MethodPut, bindingPath, bindBody, errors.NewServiceBindingAlreadyExists(bindingID), http.StatusConflict, ""},
+		{"bind forbidden", http.MethodPut, bindingPath, bindBody, errors.NewForbidden("other namespace"), http.StatusForbidden, ""},
+		{"unbind gone", http.MethodDelete, bindingPath + "?service_id=s&plan_id=p", "", errors.NewServiceBindingGone(bindingID), http.StatusGone, ""},
+		{"get binding not found", http.MethodGet, bindingPath, "", errors.NewServiceBindingNotFound(bindingID), http.StatusNotFound, ""},
+		{"binding last operation gone", http.MethodGet, bindingPath + "/last_operation", "", errors.NewServiceBindingGone(bindingID), http.StatusGone, ""},
+		{"internal error", http.MethodGet, "/v2/catalog", "", goerrors.New("connection refused"), http.StatusInternalServerError, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &fakeBroker{err: test.err}
+			rec := serve(NewHandler(logging.MustGetLogger("test"), b, nil), test.method, test.path, test.body, nil)
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body.String())
+			}
+			checkError(t, rec, test.code)
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		expect string
+	}{
+		{"supplied", http.Header{reqctx.RequestIDHeader: {"req-1"}}, "req-1"},
+		{"broker api header", http.Header{reqctx.BrokerRequestIDHeader: {"req-2"}}, "req-2"},
+		{"malformed", http.Header{reqctx.RequestIDHeader: {"bad id\n"}}, ""},
+		{"generated", nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &fakeBroker{}
+			rec := serve(NewHandler(logging.MustGetLogger("test"), b, nil), http.MethodGet, "/v2/catalog", "", test.header)
+			requestID := rec.Header().Get(reqctx.RequestIDHeader)
+			if test.expect != "" && requestID != test.expect {
+				t.Errorf("expected request ID %q, got %q", test.expect, requestID)
+			}
+			if test.expect == "" && uuid.Parse(requestID) == nil {
+				t.Errorf("expected generated request ID, got %q", requestID)
+			}
+			if reqctx.RequestID(b.ctx) != requestID {
+				t.Errorf("request ID %q not passed to the broker", reqctx.RequestID(b.ctx))
+			}
+		})
+	}
+}
+
+func TestOriginatingIdentity(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte(`{"username": "alice", "groups": ["admin"]}`))
+
+	b := &fakeBroker{}
+	rec := serve(NewHandler(logging.MustGetLogger("test"), b, nil), http.MethodGet, "/v2/catalog", "",
+		http.Header{originatingIdentityHeader: {"kubernetes " + value}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	identity := broker.GetOriginatingIdentity(b.ctx)
+	if identity == nil || identity.Platform != "kubernetes" || identity.User() != "alice" {
+		t.Errorf("unexpected originating identity %+v", identity)
+	}
+
+	for _, header := range []string{"kubernetes", "kubernetes not-base64!", "kubernetes " + base64.StdEncoding.EncodeToString([]byte("not json"))} {
+		rec := serve(NewHandler(logging.MustGetLogger("test"), &fakeBroker{}, nil), http.MethodGet, "/v2/catalog", "",
+			http.Header{originatingIdentityHeader: {header}})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for header %q, got %d", header, rec.Code)
+		}
+		checkError(t, rec, "")
+	}
+}
@@ -2,16 +2,19 @@ package handler
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/EnMasseProject/maas-service-broker/pkg/broker"
 	"github.com/EnMasseProject/maas-service-broker/pkg/errors"
-	"github.com/op/go-logging"
-	"strconv"
+	"github.com/EnMasseProject/maas-service-broker/pkg/redact"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/pborman/uuid"
 )
 
-func readRequest(log *logging.Logger, r *http.Request, obj interface{}) error {
+func readRequest(log reqctx.Log, tracer *redact.Tracer, r *http.Request, obj interface{}) error {
 	// TODO: uncomment this when the service catalog controller starts setting the content-type properly
 	//contentType := r.Header.Get("Content-Type")
 	//if contentType != "application/json" {
@@ -22,17 +25,56 @@ func readRequest(log *logging.Logger, r *http.Request, obj interface{}) error {
 	buf.ReadFrom(r.Body)
 
 	reader := bytes.NewReader(buf.Bytes())
-	log.Infof("Request body: ", buf.String())
+	tracer.Body(log, "Request body", buf.Bytes())
 
 	err := json.NewDecoder(reader).Decode(&obj)
 	if err != nil {
-		log.Info("Could not parse request body: " + err.Error())
+		log.Info("Could not parse request body: %s", err.Error())
 		return errors.NewBadRequest("could not parse request body : " + err.Error())
 	}
 
 	return nil
 }
 
+const originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// readOriginatingIdentity parses the originating identity header, which holds the platform name followed
+// by the base64 encoded JSON identity of the user. Requests without the header have no identity.
+func readOriginatingIdentity(r *http.Request) (*broker.OriginatingIdentity, error) {
+	header := r.Header.Get(originatingIdentityHeader)
+	if header == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return nil, errors.NewBadRequest("invalid " + originatingIdentityHeader + " header")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.NewBadRequest("invalid " + originatingIdentityHeader + " header: " + err.Error())
+	}
+
+	identity := &broker.OriginatingIdentity{Platform: parts[0]}
+	if err = json.Unmarshal(decoded, &identity.Value); err != nil {
+		return nil, errors.NewBadRequest("invalid " + originatingIdentityHeader + " header: " + err.Error())
+	}
+	return identity, nil
+}
+
+func acceptsIncomplete(r *http.Request) bool {
+	return r.FormValue("accepts_incomplete") == "true"
+}
+
+func readLastOperationRequest(r *http.Request) *broker.LastOperationRequest {
+	return &broker.LastOperationRequest{
+		ServiceID: uuid.Parse(r.FormValue("service_id")),
+		PlanID:    uuid.Parse(r.FormValue("plan_id")),
+		Operation: r.FormValue("operation"),
+	}
+}
+
 func writeResponse(w http.ResponseWriter, code int, obj interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -50,7 +92,7 @@ func writeResponse(w http.ResponseWriter, code int, obj interface{}) error {
 	return err
 }
 
-func writeDefaultResponse(w http.ResponseWriter, code int, resp interface{}, err error, log *logging.Logger) error {
+func writeDefaultResponse(w http.ResponseWriter, code int, resp interface{}, err error, log reqctx.Log) error {
 	if err == nil {
 		return writeResponse(w, code, resp)
 	} else {
@@ -58,12 +100,12 @@ func writeDefaultResponse(w http.ResponseWriter, code int, resp interface{}, err
 	}
 }
 
-func writeErrorResponse(w http.ResponseWriter, err error, log *logging.Logger) error {
+func writeErrorResponse(w http.ResponseWriter, err error, log reqctx.Log) error {
 	if brokerError, ok := err.(errors.BrokerError); ok {
-		log.Warning("Sending broker error response: " + strconv.Itoa(brokerError.Status) + ", " + brokerError.Description)
-		return writeResponse(w, brokerError.Status, broker.NewErrorResponse(brokerError.Description))
+		log.Warning("Sending broker error response: %d, %s", brokerError.Status, brokerError.Description)
+		return writeResponse(w, brokerError.Status, broker.NewErrorResponseWithCode(brokerError.ErrorCode, brokerError.Description))
 	} else {
-		log.Warning("Sending internal error response: " + err.Error())
+		log.Warning("Sending internal error response: %s", err.Error())
 		return writeResponse(w, http.StatusInternalServerError, broker.NewErrorResponse("Internal error: "+err.Error()))
 	}
 }
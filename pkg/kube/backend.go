@@ -0,0 +1,408 @@
+// Package kube implements a maas.Backend that manages EnMasse address definitions directly as Kubernetes
+// resources, for clusters where the address controller REST API is not exposed to the broker.
+//
+// Every definition is stored as JSON under the config.json key of a labelled resource: flavors and
+// infrastructure instances are ConfigMaps in the configured namespace, addresses are ConfigMaps in the
+// namespace of their instance, and users, which carry passwords, are Secrets in that namespace.
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// TypeLabel distinguishes the kinds of definitions.
+	TypeLabel = "type"
+	// InstanceLabel is the infrastructure instance addresses and users belong to.
+	InstanceLabel = "instance"
+	// UUIDLabel is the service instance UUID of an address.
+	UUIDLabel = "uuid"
+
+	TypeFlavor   = "flavor"
+	TypeInstance = "instance-config"
+	TypeAddress  = "address-config"
+	TypeUser     = "user"
+
+	configKey = "config.json"
+)
+
+type Config struct {
+	// Namespace holds the flavor and instance definitions.
+	Namespace string
+	// Kubeconfig is the kubeconfig file used to connect to the cluster. The in-cluster configuration of
+	// the broker pod is used if empty.
+	Kubeconfig string
+}
+
+type Backend struct {
+	client    kubernetes.Interface
+	namespace string
+	log       *logging.Logger
+}
+
+// NewClient connects to the cluster configured in config.
+func NewClient(config Config) (kubernetes.Interface, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", config.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+func NewBackend(client kubernetes.Interface, config Config, log *logging.Logger) (*Backend, error) {
+	if config.Namespace == "" {
+		return nil, fmt.Errorf("the kubernetes backend requires a namespace")
+	}
+	log.Noticef("Managing EnMasse definitions in namespace %s", config.Namespace)
+	return &Backend{client: client, namespace: config.Namespace, log: log}, nil
+}
+
+func (b *Backend) GetFlavors(ctx context.Context) ([]maas.Flavor, error) {
+	configMaps, err := b.client.CoreV1().ConfigMaps(b.namespace).List(ctx, selector(TypeFlavor, nil))
+	if err != nil {
+		return nil, err
+	}
+	flavors := []maas.Flavor{}
+	for _, configMap := range configMaps.Items {
+		var flavor maas.Flavor
+		if err := decode(&configMap, &flavor); err != nil {
+			return nil, err
+		}
+		flavors = append(flavors, flavor)
+	}
+	return flavors, nil
+}
+
+func (b *Backend) GetInstances(ctx context.Context) ([]maas.Instance, error) {
+	configMaps, err := b.client.CoreV1().ConfigMaps(b.namespace).List(ctx, selector(TypeInstance, nil))
+	if err != nil {
+		return nil, err
+	}
+	instances := []maas.Instance{}
+	for _, configMap := range configMaps.Items {
+		var instance maas.Instance
+		if err := decode(&configMap, &instance); err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (b *Backend) GetInstance(ctx context.Context, id string) (*maas.Instance, error) {
+	configMap, err := b.client.CoreV1().ConfigMaps(b.namespace).Get(ctx, instanceName(id), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var instance maas.Instance
+	if err := decode(configMap, &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+func (b *Backend) ProvisionMaaSInfra(ctx context.Context, infraID string) error {
+	log := reqctx.Logger(ctx, b.log)
+	log.Infof("Creating MaaS infrastructure instance %s", infraID)
+
+	instance := maas.Instance{
+		Metadata: maas.Metadata{
+			Name: infraID,
+		},
+		Spec: maas.InstanceSpec{
+			Namespace: "enmasse-" + infraID,
+		},
+	}
+	configMap, err := encode(instanceName(infraID), map[string]string{TypeLabel: TypeInstance, InstanceLabel: infraID}, instance)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.CoreV1().ConfigMaps(b.namespace).Create(ctx, configMap, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) GetAddresses(ctx context.Context, infraID string) ([]maas.Address, error) {
+	namespace, err := b.instanceNamespace(ctx, infraID)
+	if err != nil {
+		return nil, err
+	}
+	configMaps, err := b.client.CoreV1().ConfigMaps(namespace).List(ctx, selector(TypeAddress, map[string]string{InstanceLabel: infraID}))
+	if err != nil {
+		return nil, err
+	}
+	addresses := []maas.Address{}
+	for _, configMap := range configMaps.Items {
+		var address maas.Address
+		if err := decode(&configMap, &address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+func (b *Backend) ProvisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID, name string, storeAndForward bool, multicast bool, flavor string, options maas.AddressOptions) error {
+	log := reqctx.Logger(ctx, b.log)
+	log.Infof("Creating address %s of flavor %s in group %s (instance UUID: %s)", name, flavor, options.Group, instanceUUID)
+
+	namespace, err := b.instanceNamespace(ctx, infraID)
+	if err != nil {
+		return err
+	}
+
+	address := maas.Address{
+		Metadata: maas.Metadata{
+			Name:   name,
+			Uuid:   instanceUUID.String(),
+			Labels: options.Labels,
+		},
+		Spec: maas.AddressSpec{
+			StoreAndForward:    storeAndForward,
+			Multicast:          multicast,
+			Flavor:             flavor,
+			Group:              options.Group,
+			TemplateParameters: options.TemplateParameters,
+		},
+	}
+	configMap, err := encode(addressName(instanceUUID), map[string]string{
+		TypeLabel:     TypeAddress,
+		InstanceLabel: infraID,
+		UUIDLabel:     instanceUUID.String(),
+	}, address)
+	if err != nil {
+		return err
+	}
+
+	configMaps := b.client.CoreV1().ConfigMaps(namespace)
+	_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+func (b *Backend) DeprovisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID) error {
+	log := reqctx.Logger(ctx, b.log)
+	log.Infof("Deleting address %s", instanceUUID)
+
+	namespace, err := b.instanceNamespace(ctx, infraID)
+	if err != nil {
+		return err
+	}
+	err = b.client.CoreV1().ConfigMaps(namespace).Delete(ctx, addressName(instanceUUID), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return fmt.Errorf("address %s does not exist in instance %s", instanceUUID, infraID)
+	}
+	return err
+}
+
+func (b *Backend) GetUsers(ctx context.Context, infraID string) ([]maas.User, error) {
+	namespace, err := b.instanceNamespace(ctx, infraID)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := b.client.CoreV1().Secrets(namespace).List(ctx, selector(TypeUser, map[string]string{InstanceLabel: infraID}))
+	if err != nil {
+		return nil, err
+	}
+	users := []maas.User{}
+	for _, secret := range secrets.Items {
+		var user maas.User
+		if err := json.Unmarshal(secret.Data[configKey], &user); err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", secret.Namespace, secret.Name, err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (b *Backend) CreateUser(ctx context.Context, infraID string, user maas.User) error {
+	log := reqctx.Logger(ctx, b.log)
+	log.Infof("Creating user %s in instance %s", user.Metadata.Name, infraID)
+
+	namespace, err := b.instanceNamespace(ctx, infraID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   userName(user.Metadata.Name),
+			Labels: map[string]string{TypeLabel: TypeUser, InstanceLabel: infraID},
+		},
+		Data: map[string][]byte{configKey: data},
+	}
+
+	secrets := b.client.CoreV1().Secrets(namespace)
+	_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// DeleteUser ignores users that do not exist, like MaasClient.
+func (b *Backend) DeleteUser(ctx context.Context, infraID string, name string) error {
+	log := reqctx.Logger(ctx, b.log)
+	log.Infof("Deleting user %s in instance %s", name, infraID)
+
+	namespace, err := b.instanceNamespace(ctx, infraID)
+	if err != nil {
+		return err
+	}
+	err = b.client.CoreV1().Secrets(namespace).Delete(ctx, userName(name), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		log.Infof("User %s does not exist in instance %s", name, infraID)
+		return nil
+	}
+	return err
+}
+
+// AddressEvent is a change to an address definition observed by WatchAddresses.
+type AddressEvent struct {
+	Type    watch.EventType
+	InfraID string
+	Address maas.Address
+}
+
+// The delay before re-establishing a watch doubles from minWatchBackoff up to maxWatchBackoff while watches
+// fail or are closed early, and is reset once a watch lasted maxWatchBackoff.
+var (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = time.Minute
+)
+
+// WatchAddresses calls handle with the changes to the address definitions in all namespaces until ctx is
+// done, re-establishing the watch whenever it fails or the API server closes it.
+func (b *Backend) WatchAddresses(ctx context.Context, handle func(AddressEvent)) error {
+	log := reqctx.Logger(ctx, b.log)
+	backoff := minWatchBackoff
+	for {
+		started := time.Now()
+		watcher, err := b.client.CoreV1().ConfigMaps(v1.NamespaceAll).Watch(ctx, selector(TypeAddress, nil))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warningf("Could not watch address definitions, retrying in %s: %v", backoff, err)
+		} else if done := b.dispatch(ctx, watcher, handle); done {
+			return ctx.Err()
+		}
+
+		if time.Since(started) >= maxWatchBackoff {
+			backoff = minWatchBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// dispatch handles the events of a watch until it is closed, or ctx is done, in which case it returns true.
+func (b *Backend) dispatch(ctx context.Context, watcher watch.Interface, handle func(AddressEvent)) bool {
+	log := reqctx.Logger(ctx, b.log)
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false
+			}
+			configMap, ok := event.Object.(*v1.ConfigMap)
+			if !ok || configMap.Labels[TypeLabel] != TypeAddress {
+				continue
+			}
+			var address maas.Address
+			if err := decode(configMap, &address); err != nil {
+				log.Warningf("Ignoring address definition %s/%s: %v", configMap.Namespace, configMap.Name, err)
+				continue
+			}
+			handle(AddressEvent{Type: event.Type, InfraID: configMap.Labels[InstanceLabel], Address: address})
+		}
+	}
+}
+
+func (b *Backend) instanceNamespace(ctx context.Context, infraID string) (string, error) {
+	instance, err := b.GetInstance(ctx, infraID)
+	if err != nil {
+		return "", err
+	}
+	if instance == nil {
+		return "", fmt.Errorf("instance %s does not exist", infraID)
+	}
+	return instance.Spec.Namespace, nil
+}
+
+func instanceName(infraID string) string {
+	return "instance-config-" + infraID
+}
+
+// addressName names address definitions after the service instance, as address names need not be valid
+// Kubernetes names.
+func addressName(instanceUUID uuid.UUID) string {
+	return "address-config-" + instanceUUID.String()
+}
+
+func userName(name string) string {
+	return "user-" + name
+}
+
+func selector(kind string, extra map[string]string) metav1.ListOptions {
+	set := labels.Set{TypeLabel: kind}
+	for key, value := range extra {
+		set[key] = value
+	}
+	return metav1.ListOptions{LabelSelector: set.String()}
+}
+
+func encode(name string, labels map[string]string, definition interface{}) (*v1.ConfigMap, error) {
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Data:       map[string]string{configKey: string(data)},
+	}, nil
+}
+
+func decode(configMap *v1.ConfigMap, definition interface{}) error {
+	data, ok := configMap.Data[configKey]
+	if !ok {
+		return fmt.Errorf("%s/%s has no %s", configMap.Namespace, configMap.Name, configKey)
+	}
+	if err := json.Unmarshal([]byte(data), definition); err != nil {
+		return fmt.Errorf("%s/%s: %v", configMap.Namespace, configMap.Name, err)
+	}
+	return nil
+}
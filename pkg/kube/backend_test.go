@@ -0,0 +1,235 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	namespace = "enmasse"
+	infraID   = "org1"
+)
+
+func newBackend(t *testing.T, flavors ...maas.Flavor) (*Backend, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	for _, flavor := range flavors {
+		configMap, err := encode(flavor.Metadata.Name, map[string]string{TypeLabel: TypeFlavor}, flavor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.CoreV1().ConfigMaps(namespace).Create(context.Background(), configMap, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend, err := NewBackend(client, Config{Namespace: namespace}, logging.MustGetLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, client
+}
+
+func TestFlavorsAndInstances(t *testing.T) {
+	ctx := context.Background()
+	flavor := maas.Flavor{Metadata: maas.Metadata{Name: "vanilla-queue", Uuid: uuid.New()}, Spec: maas.FlavorSpec{Type: maas.Queue}}
+	backend, _ := newBackend(t, flavor)
+
+	flavors, err := backend.GetFlavors(ctx)
+	if err != nil || len(flavors) != 1 || flavors[0].Metadata.Uuid != flavor.Metadata.Uuid {
+		t.Errorf("expected flavor %v, got %v, %v", flavor, flavors, err)
+	}
+
+	if instance, err := backend.GetInstance(ctx, infraID); err != nil || instance != nil {
+		t.Errorf("expected no instance, got %v, %v", instance, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := backend.ProvisionMaaSInfra(ctx, infraID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	instance, err := backend.GetInstance(ctx, infraID)
+	if err != nil || instance == nil || instance.Spec.Namespace != "enmasse-"+infraID {
+		t.Errorf("expected instance in namespace enmasse-%s, got %v, %v", infraID, instance, err)
+	}
+	if instances, err := backend.GetInstances(ctx); err != nil || len(instances) != 1 {
+		t.Errorf("expected one instance, got %v, %v", instances, err)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	ctx := context.Background()
+	backend, client := newBackend(t)
+	instanceUUID := uuid.NewRandom()
+
+	if err := backend.ProvisionAddress(ctx, infraID, instanceUUID, "my-queue", true, false, "vanilla-queue", maas.AddressOptions{}); err == nil {
+		t.Error("expected provisioning in an unknown instance to fail")
+	}
+	if err := backend.ProvisionMaaSInfra(ctx, infraID); err != nil {
+		t.Fatal(err)
+	}
+
+	options := maas.AddressOptions{Group: "group", Labels: map[string]string{"app": "test"}}
+	if err := backend.ProvisionAddress(ctx, infraID, instanceUUID, "my-queue", true, false, "vanilla-queue", options); err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := client.CoreV1().ConfigMaps("enmasse-"+infraID).Get(ctx, addressName(instanceUUID), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Labels[UUIDLabel] != instanceUUID.String() || configMap.Labels[InstanceLabel] != infraID {
+		t.Errorf("unexpected labels %v", configMap.Labels)
+	}
+
+	address, err := maas.GetAddress(ctx, backend, infraID, instanceUUID)
+	if err != nil || address == nil {
+		t.Fatalf("expected address, got %v, %v", address, err)
+	}
+	if address.Metadata.Name != "my-queue" || !address.Spec.StoreAndForward || address.Spec.Flavor != "vanilla-queue" || address.Spec.Group != "group" {
+		t.Errorf("unexpected address %v", address)
+	}
+
+	if err := backend.DeprovisionAddress(ctx, infraID, instanceUUID); err != nil {
+		t.Fatal(err)
+	}
+	if addresses, err := backend.GetAddresses(ctx, infraID); err != nil || len(addresses) != 0 {
+		t.Errorf("expected no addresses, got %v, %v", addresses, err)
+	}
+	if err := backend.DeprovisionAddress(ctx, infraID, instanceUUID); err == nil {
+		t.Error("expected deprovisioning a deleted address to fail")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	ctx := context.Background()
+	backend, client := newBackend(t)
+	if err := backend.ProvisionMaaSInfra(ctx, infraID); err != nil {
+		t.Fatal(err)
+	}
+
+	user := maas.User{Metadata: maas.Metadata{Name: "alice"}, Spec: maas.UserSpec{Password: "secret"}}
+	for i := 0; i < 2; i++ {
+		if err := backend.CreateUser(ctx, infraID, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secrets, err := client.CoreV1().Secrets("enmasse-"+infraID).List(ctx, metav1.ListOptions{})
+	if err != nil || len(secrets.Items) != 1 {
+		t.Fatalf("expected one secret, got %v, %v", secrets, err)
+	}
+	users, err := backend.GetUsers(ctx, infraID)
+	if err != nil || len(users) != 1 || users[0].Spec.Password != "secret" {
+		t.Fatalf("expected user alice, got %v, %v", users, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := backend.DeleteUser(ctx, infraID, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchAddresses(t *testing.T) {
+	backend, client := newBackend(t)
+	watcher := watch.NewFake()
+	client.PrependWatchReactor("configmaps", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, watcher, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan AddressEvent)
+	done := make(chan error)
+	go func() {
+		done <- backend.WatchAddresses(ctx, func(event AddressEvent) {
+			events <- event
+		})
+	}()
+
+	address := maas.Address{Metadata: maas.Metadata{Name: "my-queue", Uuid: uuid.New()}}
+	configMap, err := encode("address-config-"+address.Metadata.Uuid, map[string]string{TypeLabel: TypeAddress, InstanceLabel: infraID}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.Add(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "unrelated"}})
+	watcher.Add(configMap)
+
+	select {
+	case event := <-events:
+		if event.Type != watch.Added || event.InfraID != infraID || event.Address.Metadata.Name != "my-queue" {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the address event")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected the watch to be cancelled, got %v", err)
+	}
+}
+
+func TestWatchAddressesBackoff(t *testing.T) {
+	minWatchBackoff, maxWatchBackoff = 10*time.Millisecond, 40*time.Millisecond
+	defer func() { minWatchBackoff, maxWatchBackoff = time.Second, time.Minute }()
+
+	backend, client := newBackend(t)
+	watcher := watch.NewFake()
+	calls := 0
+	client.PrependWatchReactor("configmaps", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		calls++
+		switch calls {
+		case 1:
+			return true, nil, fmt.Errorf("connection refused")
+		case 2, 3:
+			closed := watch.NewFake()
+			closed.Stop()
+			return true, closed, nil
+		default:
+			return true, watcher, nil
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan AddressEvent)
+	done := make(chan error)
+	started := time.Now()
+	go func() {
+		done <- backend.WatchAddresses(ctx, func(event AddressEvent) {
+			events <- event
+		})
+	}()
+
+	address := maas.Address{Metadata: maas.Metadata{Name: "my-queue", Uuid: uuid.New()}}
+	configMap, err := encode("address-config-"+address.Metadata.Uuid, map[string]string{TypeLabel: TypeAddress, InstanceLabel: infraID}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.Add(configMap)
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the address event")
+	}
+	// The watch is retried after 10ms, 20ms and 40ms.
+	if elapsed := time.Since(started); elapsed < 70*time.Millisecond {
+		t.Errorf("expected the watch to back off, re-established after %s", elapsed)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected the watch to be cancelled, got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("expected 4 watches, got %d", calls)
+	}
+}
@@ -0,0 +1,234 @@
+// Package logfile implements a log file that rotates itself once it grows too large or too old, keeping
+// a bounded number of optionally compressed backups, and that can be reopened after external rotation.
+package logfile
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is appended to the name of the file when it is rotated. It sorts chronologically.
+const backupTimeFormat = "20060102T150405.000"
+
+const compressedSuffix = ".gz"
+
+type Options struct {
+	// MaxSize is the size in bytes after which the file is rotated, or 0 for no limit.
+	MaxSize int64
+	// MaxAge is the age after which the file is rotated, or 0 for no limit. The age of a file is kept
+	// across restarts and Reopen.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, or 0 to keep all of them.
+	MaxBackups int
+	// Compress gzips the rotated files.
+	Compress bool
+}
+
+type File struct {
+	path    string
+	options Options
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// started is when the current file was started, from which MaxAge is counted.
+	started time.Time
+	regular bool
+
+	// housekeeping serializes the compression and removal of backups, which run in the background.
+	housekeeping sync.Mutex
+}
+
+// Open opens the file at path for appending, creating it if it does not exist.
+func Open(path string, options Options) (*File, error) {
+	f := &File{path: path, options: options}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// A failed rotation is reported, but the current file is still written to rather than losing p.
+	var rotateErr error
+	if f.shouldRotate(len(p)) {
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Reopen closes and reopens the file, so that writes go to a new file after the current one was moved
+// away, for example by logrotate.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.started = f.startTime(info)
+	f.regular = info.Mode().IsRegular()
+	return nil
+}
+
+// startTime returns when the file was started, so that its age survives restarts and Reopen. An empty file
+// starts now. Otherwise the newest backup records when rotation last started a file, and a file that was
+// never rotated is at least as old as its last write.
+func (f *File) startTime(info os.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Now()
+	}
+	if backups := f.backups(); len(backups) > 0 {
+		if rotated, err := f.backupTime(backups[len(backups)-1]); err == nil && rotated.Before(info.ModTime()) {
+			return rotated
+		}
+	}
+	return info.ModTime()
+}
+
+// shouldRotate reports whether the file must be rotated before writing n bytes to it. Only regular files
+// are rotated, never devices such as /dev/null.
+func (f *File) shouldRotate(n int) bool {
+	if !f.regular || f.size == 0 {
+		return false
+	}
+	if f.options.MaxSize > 0 && f.size+int64(n) > f.options.MaxSize {
+		return true
+	}
+	return f.options.MaxAge > 0 && time.Since(f.started) >= f.options.MaxAge
+}
+
+// rotate renames the file before closing it, so that it stays open for writing if either the rename or
+// opening the new file fails.
+func (f *File) rotate() error {
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	previous := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	previous.Close()
+
+	go f.cleanUp(backup)
+	return nil
+}
+
+// cleanUp compresses the backup just rotated, if configured, and removes the backups in excess of MaxBackups.
+// Failures only leave extra files behind, so they are ignored.
+func (f *File) cleanUp(backup string) {
+	f.housekeeping.Lock()
+	defer f.housekeeping.Unlock()
+
+	if f.options.Compress {
+		compress(backup)
+	}
+
+	if f.options.MaxBackups <= 0 {
+		return
+	}
+	backups := f.backups()
+	for len(backups) > f.options.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups returns the rotated files, oldest first.
+func (f *File) backups() []string {
+	dir := filepath.Dir(f.path)
+	prefix := f.backupPrefix()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := f.backupTime(name); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+func (f *File) backupPrefix() string {
+	return filepath.Base(f.path) + "."
+}
+
+// backupTime returns the time of the rotation recorded in the name of a backup.
+func (f *File) backupTime(backup string) (time.Time, error) {
+	timestamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(backup), f.backupPrefix()), compressedSuffix)
+	return time.ParseInLocation(backupTimeFormat, timestamp, time.Local)
+}
+
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+compressedSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	if _, err = io.Copy(writer, in); err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + compressedSuffix)
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,208 @@
+package logfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForBackups polls the backups of f until they number count and are compressed as configured, as they
+// are cleaned up in the background.
+func waitForBackups(f *File, count int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f.housekeeping.Lock()
+		backups := f.backups()
+		f.housekeeping.Unlock()
+		done := len(backups) == count
+		for _, backup := range backups {
+			done = done && f.options.Compress == strings.HasSuffix(backup, compressedSuffix)
+		}
+		if done || time.Now().After(deadline) {
+			return backups
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		writes  int
+		backups int
+	}{
+		{name: "no limits", writes: 5, backups: 0},
+		{name: "max size", options: Options{MaxSize: 10}, writes: 5, backups: 4},
+		{name: "max age", options: Options{MaxAge: time.Millisecond}, writes: 3, backups: 2},
+		{name: "max backups", options: Options{MaxSize: 10, MaxBackups: 2}, writes: 5, backups: 2},
+		{name: "compressed", options: Options{MaxSize: 10, Compress: true}, writes: 3, backups: 2},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "broker.log")
+		f, err := Open(path, test.options)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for i := 0; i < test.writes; i++ {
+			// backups are named after the time of the rotation, to the millisecond
+			time.Sleep(2 * time.Millisecond)
+			if _, err := f.Write([]byte("8 bytes\n")); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		backups := waitForBackups(f, test.backups)
+		if len(backups) != test.backups {
+			t.Errorf("%s: expected %d backups, got %v", test.name, test.backups, backups)
+		}
+		for _, backup := range backups {
+			if test.options.Compress != strings.HasSuffix(backup, compressedSuffix) {
+				t.Errorf("%s: unexpected backup %s", test.name, backup)
+			}
+		}
+		f.Close()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if expected := strings.Repeat("8 bytes\n", test.writes-len(backups)); test.options.MaxBackups == 0 && string(data) != expected {
+			t.Errorf("%s: expected %q in the current file, got %q", test.name, expected, data)
+		}
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Open(filepath.Join(dir, "broker.log"), Options{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("8 bytes\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file cannot be renamed once its directory is gone.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.Write([]byte("8 bytes\n"))
+	if err == nil {
+		t.Error("expected the rotation to fail")
+	}
+	if n != 8 {
+		t.Errorf("expected the write to go to the current file, wrote %d bytes", n)
+	}
+	if _, err := f.Write([]byte("8 bytes\n")); err == nil {
+		t.Error("expected the rotation to be retried and fail")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "broker.log")
+	f, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("before\n"))
+
+	// as logrotate would
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+
+	for file, expected := range map[string]string{path + ".1": "before\n", path: "after\n"} {
+		if data, err := ioutil.ReadFile(file); err != nil || string(data) != expected {
+			t.Errorf("expected %q in %s, got %q (%v)", expected, file, data, err)
+		}
+	}
+}
+
+func TestDevicesAreNotRotated(t *testing.T) {
+	f, err := Open(os.DevNull, Options{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := f.Write([]byte("8 bytes\n")); err != nil {
+			t.Fatalf("expected %s not to be rotated, got %v", os.DevNull, err)
+		}
+	}
+}
+
+func TestMaxAgeAcrossRestarts(t *testing.T) {
+	tests := []struct {
+		name     string
+		rotated  time.Duration
+		modified time.Duration
+		reopen   bool
+		empty    bool
+		rotate   bool
+	}{
+		{name: "rotated before the restart", rotated: 2 * time.Hour, rotate: true},
+		{name: "rotated recently", rotated: 10 * time.Minute},
+		{name: "never rotated and written long ago", modified: 2 * time.Hour, rotate: true},
+		{name: "never rotated and written recently", modified: 10 * time.Minute},
+		{name: "reopened", rotated: 2 * time.Hour, reopen: true, rotate: true},
+		{name: "empty", rotated: 2 * time.Hour, empty: true},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "broker.log")
+		content := "written by the previous broker\n"
+		if test.empty {
+			content = ""
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		backups := 0
+		if test.rotated > 0 {
+			backup := path + "." + time.Now().Add(-test.rotated).Format(backupTimeFormat)
+			if err := ioutil.WriteFile(backup, []byte("rotated\n"), 0666); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			backups++
+		}
+		if test.modified > 0 {
+			modified := time.Now().Add(-test.modified)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		f, err := Open(path, Options{MaxAge: time.Hour})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.reopen {
+			if err := f.Reopen(); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if _, err := f.Write([]byte("8 bytes\n")); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.rotate {
+			backups++
+		}
+		if found := waitForBackups(f, backups); len(found) != backups {
+			t.Errorf("%s: expected %d backups, got %v", test.name, backups, found)
+		}
+		f.Close()
+	}
+}
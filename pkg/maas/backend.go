@@ -0,0 +1,87 @@
+package maas
+
+import (
+	"context"
+
+	"github.com/pborman/uuid"
+)
+
+// Backend manages the messaging infrastructure the broker provisions addresses and users in. MaasClient
+// talks to the EnMasse address controller; decorators add caching and metrics to any Backend.
+type Backend interface {
+	GetFlavors(ctx context.Context) ([]Flavor, error)
+	GetInstances(ctx context.Context) ([]Instance, error)
+	// GetInstance returns nil if the instance does not exist.
+	GetInstance(ctx context.Context, id string) (*Instance, error)
+	ProvisionMaaSInfra(ctx context.Context, infraID string) error
+	GetAddresses(ctx context.Context, infraID string) ([]Address, error)
+	ProvisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID, name string, storeAndForward bool, multicast bool, flavor string, options AddressOptions) error
+	DeprovisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID) error
+	GetUsers(ctx context.Context, infraID string) ([]User, error)
+	CreateUser(ctx context.Context, infraID string, user User) error
+	DeleteUser(ctx context.Context, infraID string, name string) error
+}
+
+func ProvisionAnycast(ctx context.Context, backend Backend, infraID string, instanceID uuid.UUID, name string, options AddressOptions) error {
+	return backend.ProvisionAddress(ctx, infraID, instanceID, name, false, false, "", options)
+}
+
+func ProvisionMulticast(ctx context.Context, backend Backend, infraID string, instanceID uuid.UUID, name string, options AddressOptions) error {
+	return backend.ProvisionAddress(ctx, infraID, instanceID, name, false, true, "", options)
+}
+
+func ProvisionQueue(ctx context.Context, backend Backend, infraID string, instanceID uuid.UUID, name string, flavor *Flavor, options AddressOptions) error {
+	return backend.ProvisionAddress(ctx, infraID, instanceID, name, true, false, flavor.Metadata.Name, options)
+}
+
+func ProvisionTopic(ctx context.Context, backend Backend, infraID string, instanceID uuid.UUID, name string, flavor *Flavor, options AddressOptions) error {
+	return backend.ProvisionAddress(ctx, infraID, instanceID, name, true, true, flavor.Metadata.Name, options)
+}
+
+// GetFlavor returns the flavor of a plan, or nil if there is none.
+func GetFlavor(ctx context.Context, backend Backend, planUUID uuid.UUID) (*Flavor, error) {
+	flavors, err := backend.GetFlavors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, flavor := range flavors {
+		if flavor.Metadata.Uuid == planUUID.String() {
+			return &flavor, nil
+		}
+	}
+	return nil, nil
+}
+
+// TODO: replace this with more efficient mechanism for looking up addresses across instances
+func FindAddress(ctx context.Context, backend Backend, instanceUUID uuid.UUID) (*Instance, *Address, error) {
+	instances, err := backend.GetInstances(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, instance := range instances {
+		infraID := instance.Metadata.Name
+		address, err := GetAddress(ctx, backend, infraID, instanceUUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if address != nil {
+			return &instance, address, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// GetAddress returns the address of a service instance in an infrastructure instance, or nil if there is none.
+func GetAddress(ctx context.Context, backend Backend, infraID string, instanceUUID uuid.UUID) (*Address, error) {
+	addresses, err := backend.GetAddresses(ctx, infraID)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		if address.Metadata.Uuid == instanceUUID.String() {
+			return &address, nil
+		}
+	}
+	return nil, nil
+}
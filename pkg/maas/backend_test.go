@@ -0,0 +1,66 @@
+package maas_test
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/fakemaas"
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/pborman/uuid"
+)
+
+func TestCachingBackend(t *testing.T) {
+	ctx := context.Background()
+	server := fakemaas.NewServer(fakemaas.Options{})
+	server.AddInstance(maas.Instance{Metadata: maas.Metadata{Name: "infra"}})
+	backend := maas.NewCachingBackend(server, time.Minute)
+
+	if _, err := backend.GetFlavors(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.GetInstances(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Fail(fakemaas.Failure{Method: http.MethodGet, Status: http.StatusServiceUnavailable, Count: -1})
+
+	flavor, err := maas.GetFlavor(ctx, backend, uuid.Parse(fakemaas.DefaultFlavors()[0].Metadata.Uuid))
+	if err != nil || flavor == nil {
+		t.Errorf("expected flavor from the cache, got %v, %v", flavor, err)
+	}
+	if instance, err := backend.GetInstance(ctx, "infra"); err != nil || instance == nil {
+		t.Errorf("expected instance from the cache, got %v, %v", instance, err)
+	}
+	if _, err := backend.GetAddresses(ctx, "infra"); err == nil {
+		t.Error("expected addresses not to be cached")
+	}
+
+	backend.Invalidate()
+	if _, err := backend.GetFlavors(ctx); err == nil {
+		t.Error("expected invalidated flavors to be fetched again")
+	}
+}
+
+func TestMetricsBackend(t *testing.T) {
+	ctx := context.Background()
+	server := fakemaas.NewServer(fakemaas.Options{})
+	backend := maas.NewMetricsBackend(server)
+
+	metrics := expvar.Get("backend").(*expvar.Map)
+	calls := func(key string) int64 {
+		if value, ok := metrics.Get(key).(*expvar.Int); ok {
+			return value.Value()
+		}
+		return 0
+	}
+	before, errorsBefore := calls("GetAddresses.calls"), calls("GetAddresses.errors")
+
+	backend.GetAddresses(ctx, "unknown")
+
+	if calls("GetAddresses.calls") != before+1 || calls("GetAddresses.errors") != errorsBefore+1 {
+		t.Errorf("expected one failed call to be recorded, got %s", metrics.String())
+	}
+}
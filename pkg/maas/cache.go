@@ -0,0 +1,137 @@
+package maas
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CachingBackend caches the flavors and infrastructure instances of a Backend, which rarely change but are
+// looked up by most broker operations. Addresses and users are never cached.
+type CachingBackend struct {
+	Backend
+	ttl time.Duration
+
+	mu              sync.Mutex
+	flavors         []Flavor
+	flavorsExpire   time.Time
+	instances       []Instance
+	instancesExpire time.Time
+}
+
+func NewCachingBackend(backend Backend, ttl time.Duration) *CachingBackend {
+	return &CachingBackend{Backend: backend, ttl: ttl}
+}
+
+func (c *CachingBackend) GetFlavors(ctx context.Context) ([]Flavor, error) {
+	c.mu.Lock()
+	if c.flavors != nil && time.Now().Before(c.flavorsExpire) {
+		defer c.mu.Unlock()
+		return append([]Flavor{}, c.flavors...), nil
+	}
+	c.mu.Unlock()
+
+	flavors, err := c.Backend.GetFlavors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flavors = append([]Flavor{}, flavors...)
+	c.flavorsExpire = time.Now().Add(c.ttl)
+	return flavors, nil
+}
+
+func (c *CachingBackend) GetInstances(ctx context.Context) ([]Instance, error) {
+	c.mu.Lock()
+	if c.instances != nil && time.Now().Before(c.instancesExpire) {
+		defer c.mu.Unlock()
+		return append([]Instance{}, c.instances...), nil
+	}
+	c.mu.Unlock()
+
+	instances, err := c.Backend.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances = append([]Instance{}, instances...)
+	c.instancesExpire = time.Now().Add(c.ttl)
+	return instances, nil
+}
+
+// GetInstance answers from the cached instances, if they are fresh, and asks the backend otherwise.
+func (c *CachingBackend) GetInstance(ctx context.Context, id string) (*Instance, error) {
+	c.mu.Lock()
+	if c.instances != nil && time.Now().Before(c.instancesExpire) {
+		for _, instance := range c.instances {
+			if instance.Metadata.Name == id {
+				c.mu.Unlock()
+				return &instance, nil
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	return c.Backend.GetInstance(ctx, id)
+}
+
+func (c *CachingBackend) ProvisionMaaSInfra(ctx context.Context, infraID string) error {
+	err := c.Backend.ProvisionMaaSInfra(ctx, infraID)
+	c.mu.Lock()
+	c.instances = nil
+	c.mu.Unlock()
+	return err
+}
+
+// Invalidate discards the cached flavors and instances.
+func (c *CachingBackend) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flavors = nil
+	c.instances = nil
+}
+
+// CacheState describes what a CachingBackend holds.
+type CacheState struct {
+	TTL       string     `json:"ttl"`
+	Flavors   CacheEntry `json:"flavors"`
+	Instances CacheEntry `json:"instances"`
+}
+
+// CacheEntry describes a cached list. Expires is nil if nothing is cached.
+type CacheEntry struct {
+	Names   []string   `json:"names"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Fresh   bool       `json:"fresh"`
+}
+
+// State returns what is cached.
+func (c *CachingBackend) State() CacheState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := CacheState{TTL: c.ttl.String()}
+	state.Flavors.Names = []string{}
+	if c.flavors != nil {
+		for _, flavor := range c.flavors {
+			state.Flavors.Names = append(state.Flavors.Names, flavor.Metadata.Name)
+		}
+		expires := c.flavorsExpire
+		state.Flavors.Expires = &expires
+		state.Flavors.Fresh = time.Now().Before(expires)
+	}
+	state.Instances.Names = []string{}
+	if c.instances != nil {
+		for _, instance := range c.instances {
+			state.Instances.Names = append(state.Instances.Names, instance.Metadata.Name)
+		}
+		expires := c.instancesExpire
+		state.Instances.Expires = &expires
+		state.Instances.Fresh = time.Now().Before(expires)
+	}
+	return state
+}
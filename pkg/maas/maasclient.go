@@ -2,12 +2,16 @@ package maas
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/EnMasseProject/maas-service-broker/pkg/redact"
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
 	"github.com/op/go-logging"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 )
 
@@ -15,15 +19,18 @@ type MaasClientConfig struct {
 	Url string
 }
 
+// MaasClient is the Backend talking to the REST API of the EnMasse address controller.
 type MaasClient struct {
 	config MaasClientConfig
 	log    *logging.Logger
+	tracer *redact.Tracer
 }
 
-func NewMaasClient(config MaasClientConfig, log *logging.Logger) (*MaasClient, error) {
+func NewMaasClient(config MaasClientConfig, log *logging.Logger, tracer *redact.Tracer) (*MaasClient, error) {
 	client := &MaasClient{
 		config: config,
 		log:    log,
+		tracer: tracer,
 	}
 
 	log.Notice("MaaS API Server is at %s", config.Url)
@@ -31,10 +38,11 @@ func NewMaasClient(config MaasClientConfig, log *logging.Logger) (*MaasClient, e
 	return client, nil
 }
 
-func (c *MaasClient) GetFlavors() ([]Flavor, error) {
-	c.log.Infof("Getting flavors")
+func (c *MaasClient) GetFlavors(ctx context.Context) ([]Flavor, error) {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Getting flavors")
 
-	resp, err := http.Get(fmt.Sprintf("%s/v3/flavor", c.config.Url))
+	resp, err := c.get(ctx, fmt.Sprintf("%s/v3/flavor", c.config.Url))
 	if err != nil {
 		return []Flavor{}, err
 	}
@@ -45,17 +53,18 @@ func (c *MaasClient) GetFlavors() ([]Flavor, error) {
 	}
 
 	var flavorList FlavorList
-	err = decodeJSON(resp, &flavorList)
+	err = c.decodeJSON(ctx, resp, &flavorList)
 	if err != nil {
 		return nil, err
 	}
 	return flavorList.Items, nil
 }
 
-func (c *MaasClient) GetAddresses(infraID string) ([]Address, error) {
-	c.log.Infof("Getting addresses")
+func (c *MaasClient) GetAddresses(ctx context.Context, infraID string) ([]Address, error) {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Getting addresses")
 
-	resp, err := http.Get(fmt.Sprintf("%s/v3/instance/%s/address", c.config.Url, infraID))
+	resp, err := c.get(ctx, fmt.Sprintf("%s/v3/instance/%s/address", c.config.Url, infraID))
 	if err != nil {
 		return nil, err
 	}
@@ -66,20 +75,19 @@ func (c *MaasClient) GetAddresses(infraID string) ([]Address, error) {
 	}
 
 	var addressList AddressList
-	err = decodeJSON(resp, &addressList)
+	err = c.decodeJSON(ctx, resp, &addressList)
 	if err != nil {
 		return nil, err
 	}
 
-	c.log.Infof("Received addresses: %+v", addressList)
-
 	return addressList.Items, nil
 }
 
-func (c *MaasClient) GetInstances() ([]Instance, error) {
-	c.log.Infof("Getting instances")
+func (c *MaasClient) GetInstances(ctx context.Context) ([]Instance, error) {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Getting instances")
 
-	resp, err := http.Get(fmt.Sprintf("%s/v3/instance", c.config.Url))
+	resp, err := c.get(ctx, fmt.Sprintf("%s/v3/instance", c.config.Url))
 	if err != nil {
 		return nil, err
 	}
@@ -90,20 +98,19 @@ func (c *MaasClient) GetInstances() ([]Instance, error) {
 	}
 
 	var instanceList InstanceList
-	err = decodeJSON(resp, &instanceList)
+	err = c.decodeJSON(ctx, resp, &instanceList)
 	if err != nil {
 		return nil, err
 	}
 
-	c.log.Infof("Received instances: %+v", instanceList)
-
 	return instanceList.Items, nil
 }
 
-func (c *MaasClient) GetInstance(id string) (*Instance, error) {
-	c.log.Infof("Getting instance with id %s", id)
+func (c *MaasClient) GetInstance(ctx context.Context, id string) (*Instance, error) {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Getting instance with id %s", id)
 
-	resp, err := http.Get(fmt.Sprintf("%s/v3/instance/%s", c.config.Url, id))
+	resp, err := c.get(ctx, fmt.Sprintf("%s/v3/instance/%s", c.config.Url, id))
 	if err != nil {
 		return nil, err
 	}
@@ -116,18 +123,17 @@ func (c *MaasClient) GetInstance(id string) (*Instance, error) {
 	}
 
 	var instance Instance
-	err = decodeJSON(resp, &instance)
+	err = c.decodeJSON(ctx, resp, &instance)
 	if err != nil {
 		return nil, err
 	}
 
-	c.log.Infof("Got instance: %+v", instance)
-
 	return &instance, nil
 }
 
-func (c *MaasClient) ProvisionMaaSInfra(infraID string) error {
-	c.log.Infof("Provisioning MaaS infrastructure instance %s", infraID)
+func (c *MaasClient) ProvisionMaaSInfra(ctx context.Context, infraID string) error {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Provisioning MaaS infrastructure instance %s", infraID)
 
 	instance := Instance{
 		Metadata: Metadata{
@@ -138,11 +144,7 @@ func (c *MaasClient) ProvisionMaaSInfra(infraID string) error {
 		},
 	}
 
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(instance)
-
-	c.log.Infof("Sending request: %+v", b)
-	resp, err := http.Post(fmt.Sprintf("%s/v3/instance", c.config.Url), "application/json", b)
+	resp, err := c.post(ctx, fmt.Sprintf("%s/v3/instance", c.config.Url), instance)
 	if err != nil {
 		return err
 	}
@@ -152,58 +154,34 @@ func (c *MaasClient) ProvisionMaaSInfra(infraID string) error {
 		return errors.New(fmt.Sprintf("Received error from MaaS API server: %d", resp.StatusCode))
 	}
 
-	//buf := new(bytes.Buffer)
-	//buf.ReadFrom(resp.Body)
-	//s := buf.String()
-	//
-	//c.log.Infof("Received response: %s", s)
-
-	err = decodeJSON(resp, &instance)
+	err = c.decodeJSON(ctx, resp, &instance)
 	if err != nil {
 		return err
 	}
 
-	c.log.Infof("Received instance: %+v", instance)
-
 	return nil
 }
 
-func (c *MaasClient) ProvisionAnycast(infraID string, instanceID uuid.UUID, name string) error {
-	return c.ProvisionAddress(infraID, instanceID, name, false, false, "")
-}
-
-func (c *MaasClient) ProvisionMulticast(infraID string, instanceID uuid.UUID, name string) error {
-	return c.ProvisionAddress(infraID, instanceID, name, false, true, "")
-}
-
-func (c *MaasClient) ProvisionQueue(infraID string, instanceID uuid.UUID, name string, flavor *Flavor) error {
-	return c.ProvisionAddress(infraID, instanceID, name, true, false, flavor.Metadata.Name)
-}
-
-func (c *MaasClient) ProvisionTopic(infraID string, instanceID uuid.UUID, name string, flavor *Flavor) error {
-	return c.ProvisionAddress(infraID, instanceID, name, true, true, flavor.Metadata.Name)
-}
-
-func (c *MaasClient) ProvisionAddress(infraID string, instanceUUID uuid.UUID, name string, storeAndForward bool, multicast bool, flavor string) error {
-	c.log.Infof("Provisioning address %s of flavor %s (instance UUID: %s)", name, flavor, instanceUUID)
+func (c *MaasClient) ProvisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID, name string, storeAndForward bool, multicast bool, flavor string, options AddressOptions) error {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Provisioning address %s of flavor %s in group %s (instance UUID: %s)", name, flavor, options.Group, instanceUUID)
 
 	queue := Address{
 		Metadata: Metadata{
-			Name: name,
-			Uuid: instanceUUID.String(),
+			Name:   name,
+			Uuid:   instanceUUID.String(),
+			Labels: options.Labels,
 		},
 		Spec: AddressSpec{
-			StoreAndForward: storeAndForward,
-			Multicast:       multicast,
-			Flavor:          flavor,
+			StoreAndForward:    storeAndForward,
+			Multicast:          multicast,
+			Flavor:             flavor,
+			Group:              options.Group,
+			TemplateParameters: options.TemplateParameters,
 		},
 	}
 
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(queue)
-
-	c.log.Infof("Sending request: %+v", b)
-	resp, err := http.Post(fmt.Sprintf("%s/v3/instance/%s/address", c.config.Url, infraID), "application/json", b)
+	resp, err := c.post(ctx, fmt.Sprintf("%s/v3/instance/%s/address", c.config.Url, infraID), queue)
 	if err != nil {
 		return err
 	}
@@ -214,7 +192,7 @@ func (c *MaasClient) ProvisionAddress(infraID string, instanceUUID uuid.UUID, na
 	}
 
 	var addresses AddressList
-	err = decodeJSON(resp, &addresses)
+	err = c.decodeJSON(ctx, resp, &addresses)
 	if err != nil {
 		return err
 	}
@@ -222,20 +200,16 @@ func (c *MaasClient) ProvisionAddress(infraID string, instanceUUID uuid.UUID, na
 	return nil
 }
 
-func (c *MaasClient) DeprovisionAddress(infraID string, instanceUUID uuid.UUID) error {
-	c.log.Infof("Deprovisioning address %s", instanceUUID)
-	address, err := c.GetAddress(infraID, instanceUUID)
-	if err != nil {
-		return err
-	}
-	c.log.Infof("Address name is %s (UUID is %s)", address.Metadata.Name, address.Metadata.Uuid)
-
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/v3/instance/%s/address/%s", c.config.Url, infraID, address.Metadata.Name), nil)
+func (c *MaasClient) DeprovisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID) error {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Deprovisioning address %s", instanceUUID)
+	address, err := GetAddress(ctx, c, infraID, instanceUUID)
 	if err != nil {
 		return err
 	}
+	log.Infof("Address name is %s (UUID is %s)", address.Metadata.Name, address.Metadata.Uuid)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.delete(ctx, fmt.Sprintf("%s/v3/instance/%s/address/%s", c.config.Url, infraID, address.Metadata.Name))
 	if err != nil {
 		return err
 	}
@@ -244,63 +218,119 @@ func (c *MaasClient) DeprovisionAddress(infraID string, instanceUUID uuid.UUID)
 		return errors.New(fmt.Sprintf("Received error from MaaS API server: %d", resp.StatusCode))
 	}
 
-	c.log.Infof("Received response: %+v", resp)
+	log.Infof("Deprovisioned address %s", address.Metadata.Name)
 
 	return nil
 }
 
-func (c *MaasClient) GetFlavor(planUUID uuid.UUID) (*Flavor, error) {
-	flavors, err := c.GetFlavors()
+func (c *MaasClient) GetUsers(ctx context.Context, infraID string) ([]User, error) {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Getting users of instance %s", infraID)
+
+	resp, err := c.get(ctx, fmt.Sprintf("%s/v3/instance/%s/user", c.config.Url, infraID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Received error from MaaS API server: %d", resp.StatusCode))
+	}
+
+	var userList UserList
+	err = c.decodeJSON(ctx, resp, &userList)
 	if err != nil {
 		return nil, err
 	}
-	for _, flavor := range flavors {
-		if flavor.Metadata.Uuid == planUUID.String() {
-			return &flavor, nil
-		}
+
+	return userList.Items, nil
+}
+
+func (c *MaasClient) CreateUser(ctx context.Context, infraID string, user User) error {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Creating user %s in instance %s", user.Metadata.Name, infraID)
+
+	resp, err := c.post(ctx, fmt.Sprintf("%s/v3/instance/%s/user", c.config.Url, infraID), user)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.New(fmt.Sprintf("Received error from MaaS API server: %d", resp.StatusCode))
 	}
-	return nil, nil
+
+	return nil
 }
 
-// TODO: replace this with more efficient mechanism for looking up addresses across instances
-func (c *MaasClient) FindAddress(instanceUUID uuid.UUID) (*Instance, *Address, error) {
-	instances, err := c.GetInstances()
+func (c *MaasClient) DeleteUser(ctx context.Context, infraID string, name string) error {
+	log := reqctx.Logger(ctx, c.log)
+	log.Infof("Deleting user %s in instance %s", name, infraID)
+
+	resp, err := c.delete(ctx, fmt.Sprintf("%s/v3/instance/%s/user/%s", c.config.Url, infraID, name))
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		log.Infof("User %s does not exist in instance %s", name, infraID)
+		return nil
+	} else if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Received error from MaaS API server: %d", resp.StatusCode))
 	}
 
-	for _, instance := range instances {
-		infraID := instance.Metadata.Name
-		address, err := c.GetAddress(infraID, instanceUUID)
-		if err != nil {
-			return nil, nil, err
-		}
-		if address != nil {
-			return &instance, address, nil
-		}
+	return nil
+}
+
+func (c *MaasClient) get(ctx context.Context, url string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, url, nil)
+}
+
+func (c *MaasClient) post(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil, nil
+	return c.do(ctx, http.MethodPost, url, body)
 }
 
-func (c *MaasClient) GetAddress(infraID string, instanceUUID uuid.UUID) (*Address, error) {
-	addresses, err := c.GetAddresses(infraID)
+func (c *MaasClient) delete(ctx context.Context, url string) (*http.Response, error) {
+	return c.do(ctx, http.MethodDelete, url, nil)
+}
+
+// do sends a request to the MaaS API server, forwarding the request ID of ctx. The request is abandoned
+// once ctx is done.
+func (c *MaasClient) do(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		c.tracer.Body(reqctx.Logger(ctx, c.log), "Sending "+method+" "+url, body)
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
 		return nil, err
 	}
-	for _, address := range addresses {
-		if address.Metadata.Uuid == instanceUUID.String() {
-			return &address, nil
-		}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	return nil, nil
-
+	if requestID := reqctx.RequestID(ctx); requestID != "" {
+		req.Header.Set(reqctx.RequestIDHeader, requestID)
+	}
+	return http.DefaultClient.Do(req)
 }
 
-func decodeJSON(resp *http.Response, out interface{}) error {
+func (c *MaasClient) decodeJSON(ctx context.Context, resp *http.Response, out interface{}) error {
 	defer resp.Body.Close()
-	decoder := json.NewDecoder(resp.Body)
-	err := decoder.Decode(&out)
-	if err != nil && err != io.EOF {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("Could not read response from MaaS: " + err.Error())
+	}
+	c.tracer.Body(reqctx.Logger(ctx, c.log), "Received response", body)
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(body, &out); err != nil {
 		return errors.New("Could not parse JSON response from MaaS: " + err.Error())
 	}
 	return nil
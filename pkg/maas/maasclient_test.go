@@ -0,0 +1,47 @@
+package maas_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/maas"
+	"github.com/op/go-logging"
+)
+
+func TestMaasClientContext(t *testing.T) {
+	// The server never responds, until the client gives up on the request or the test ends.
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	client, err := maas.NewMaasClient(maas.MaasClientConfig{Url: ts.URL}, logging.MustGetLogger("test"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := client.GetInstances(ctx)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the request to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to be abandoned when its context is done")
+	}
+}
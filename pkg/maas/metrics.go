@@ -0,0 +1,80 @@
+package maas
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// backendMetrics collects, for each Backend operation, the number of calls, the number of failed calls and
+// the total time spent in the operation, as <operation>.calls, <operation>.errors and <operation>.seconds.
+var backendMetrics = expvar.NewMap("backend")
+
+// MetricsBackend records metrics of the operations of a Backend.
+type MetricsBackend struct {
+	backend Backend
+}
+
+func NewMetricsBackend(backend Backend) *MetricsBackend {
+	return &MetricsBackend{backend: backend}
+}
+
+func observe(operation string, start time.Time, err *error) {
+	backendMetrics.Add(operation+".calls", 1)
+	if *err != nil {
+		backendMetrics.Add(operation+".errors", 1)
+	}
+	backendMetrics.AddFloat(operation+".seconds", time.Since(start).Seconds())
+}
+
+func (m *MetricsBackend) GetFlavors(ctx context.Context) (flavors []Flavor, err error) {
+	defer observe("GetFlavors", time.Now(), &err)
+	return m.backend.GetFlavors(ctx)
+}
+
+func (m *MetricsBackend) GetInstances(ctx context.Context) (instances []Instance, err error) {
+	defer observe("GetInstances", time.Now(), &err)
+	return m.backend.GetInstances(ctx)
+}
+
+func (m *MetricsBackend) GetInstance(ctx context.Context, id string) (instance *Instance, err error) {
+	defer observe("GetInstance", time.Now(), &err)
+	return m.backend.GetInstance(ctx, id)
+}
+
+func (m *MetricsBackend) ProvisionMaaSInfra(ctx context.Context, infraID string) (err error) {
+	defer observe("ProvisionMaaSInfra", time.Now(), &err)
+	return m.backend.ProvisionMaaSInfra(ctx, infraID)
+}
+
+func (m *MetricsBackend) GetAddresses(ctx context.Context, infraID string) (addresses []Address, err error) {
+	defer observe("GetAddresses", time.Now(), &err)
+	return m.backend.GetAddresses(ctx, infraID)
+}
+
+func (m *MetricsBackend) ProvisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID, name string, storeAndForward bool, multicast bool, flavor string, options AddressOptions) (err error) {
+	defer observe("ProvisionAddress", time.Now(), &err)
+	return m.backend.ProvisionAddress(ctx, infraID, instanceUUID, name, storeAndForward, multicast, flavor, options)
+}
+
+func (m *MetricsBackend) DeprovisionAddress(ctx context.Context, infraID string, instanceUUID uuid.UUID) (err error) {
+	defer observe("DeprovisionAddress", time.Now(), &err)
+	return m.backend.DeprovisionAddress(ctx, infraID, instanceUUID)
+}
+
+func (m *MetricsBackend) GetUsers(ctx context.Context, infraID string) (users []User, err error) {
+	defer observe("GetUsers", time.Now(), &err)
+	return m.backend.GetUsers(ctx, infraID)
+}
+
+func (m *MetricsBackend) CreateUser(ctx context.Context, infraID string, user User) (err error) {
+	defer observe("CreateUser", time.Now(), &err)
+	return m.backend.CreateUser(ctx, infraID, user)
+}
+
+func (m *MetricsBackend) DeleteUser(ctx context.Context, infraID string, name string) (err error) {
+	defer observe("DeleteUser", time.Now(), &err)
+	return m.backend.DeleteUser(ctx, infraID, name)
+}
@@ -27,6 +27,7 @@ type FlavorList struct {
 type Metadata struct {
 	Name string `json:"name"`
 	Uuid string `json:"uuid"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type AddressSpec struct {
@@ -34,11 +35,34 @@ type AddressSpec struct {
 	Multicast bool `json:"multicast"`
 	Flavor string `json:"flavor,omitempty"`
 	Group string `json:"group,omitempty"`
+	TemplateParameters map[string]string `json:"templateParameters,omitempty"`
+}
+
+// AddressOptions holds the optional settings of addresses. Groups and template parameters only apply
+// to store-and-forward addresses.
+type AddressOptions struct {
+	Group string
+	TemplateParameters map[string]string
+	Labels map[string]string
 }
 
 type Address struct {
 	Metadata Metadata `json:"metadata"`
 	Spec AddressSpec `json:"spec"`
+	Status *AddressStatus `json:"status,omitempty"`
+}
+
+// AddressStatus is reported by the address controller once it has started deploying an address. The
+// messages explain why an address is not ready yet.
+type AddressStatus struct {
+	IsReady bool `json:"isReady"`
+	Messages []string `json:"messages,omitempty"`
+}
+
+// IsReady tells whether the routers and brokers of an address are ready. Addresses without a status,
+// created by address controllers that do not report one, are assumed to be ready.
+func (a *Address) IsReady() bool {
+	return a.Status == nil || a.Status.IsReady
 }
 
 type AddressList struct {
@@ -56,8 +80,29 @@ type InstanceSpec struct {
 	MessagingHost string `json:"messagingHost"`
 	MQTTHost string `json:"mqttHost"`
 	ConsoleHost string `json:"consoleHost"`
+	CACert string `json:"caCert,omitempty"`
 }
 
 type InstanceList struct {
 	Items []Instance `json:"items"`
 }
+
+type User struct {
+	Metadata Metadata `json:"metadata"`
+	Spec UserSpec `json:"spec"`
+}
+
+type UserList struct {
+	Items []User `json:"items"`
+}
+
+type UserSpec struct {
+	Password string `json:"password"`
+	Authorization []Authorization `json:"authorization"`
+}
+
+// Authorization grants operations (send, recv, manage) on a set of addresses.
+type Authorization struct {
+	Addresses []string `json:"addresses"`
+	Operations []string `json:"operations"`
+}
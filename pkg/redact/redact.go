@@ -0,0 +1,112 @@
+// Package redact masks sensitive fields, such as passwords and credentials, in JSON documents before they
+// are logged.
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/EnMasseProject/maas-service-broker/pkg/reqctx"
+)
+
+const Mask = "*****"
+
+// DefaultFields are the fields redacted when none are configured.
+var DefaultFields = []string{"password", "token", "credentials.*"}
+
+// Redactor masks the values of JSON fields that match one of its patterns. A pattern is a dot separated
+// path of field names, in which "*" matches any name, and matches the fields whose path ends with it, so
+// "password" masks every field named password and "credentials.*" masks everything inside a credentials
+// object. Field names are compared case-insensitively.
+type Redactor struct {
+	patterns [][]string
+}
+
+func New(fields []string) *Redactor {
+	if len(fields) == 0 {
+		fields = DefaultFields
+	}
+	r := &Redactor{}
+	for _, field := range fields {
+		r.patterns = append(r.patterns, strings.Split(field, "."))
+	}
+	return r
+}
+
+// JSON returns a copy of the JSON document data with the sensitive fields masked. Since a document that
+// cannot be parsed cannot be redacted either, only its length is returned in that case.
+func (r *Redactor) JSON(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Sprintf("<%d bytes of unparseable JSON>", len(data))
+	}
+	redacted, err := json.Marshal(r.redact(nil, doc))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes of JSON>", len(data))
+	}
+	return string(redacted)
+}
+
+func (r *Redactor) redact(path []string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			fieldPath := append(path[:len(path):len(path)], key)
+			if r.matches(fieldPath) {
+				v[key] = Mask
+			} else {
+				v[key] = r.redact(fieldPath, field)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = r.redact(path, element)
+		}
+	}
+	return value
+}
+
+func (r *Redactor) matches(path []string) bool {
+	for _, pattern := range r.patterns {
+		if len(pattern) > len(path) {
+			continue
+		}
+		suffix := path[len(path)-len(pattern):]
+		matched := true
+		for i, name := range pattern {
+			if name != "*" && !strings.EqualFold(name, suffix[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracer logs the redacted bodies of the requests and responses the broker handles and sends, when
+// tracing is enabled. A nil Tracer logs nothing.
+type Tracer struct {
+	redactor *Redactor
+}
+
+func NewTracer(enabled bool, fields []string) *Tracer {
+	if !enabled {
+		return nil
+	}
+	return &Tracer{redactor: New(fields)}
+}
+
+// Body logs the JSON body data at debug level, prefixed by what it is.
+func (t *Tracer) Body(log reqctx.Log, what string, data []byte) {
+	if t == nil {
+		return
+	}
+	log.Debug("%s: %s", what, t.redactor.JSON(data))
+}
@@ -0,0 +1,57 @@
+package redact
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []string
+		data     string
+		expected string
+	}{
+		{name: "empty", data: "", expected: ""},
+		{name: "unparseable", data: `{"password": `, expected: "<13 bytes of unparseable JSON>"},
+		{name: "nothing sensitive", data: `{"name": "my-queue"}`, expected: `{"name": "my-queue"}`},
+		{name: "default fields", data: `{"password": "secret", "token": "abc", "name": "my-queue"}`, expected: `{"password": "*****", "token": "*****", "name": "my-queue"}`},
+		{name: "case-insensitive", data: `{"Password": "secret"}`, expected: `{"Password": "*****"}`},
+		{name: "nested", data: `{"spec": {"password": "secret", "name": "admin"}}`, expected: `{"spec": {"password": "*****", "name": "admin"}}`},
+		{name: "in arrays", data: `{"items": [{"password": "a"}, {"password": "b"}]}`, expected: `{"items": [{"password": "*****"}, {"password": "*****"}]}`},
+		{name: "wildcard", data: `{"credentials": {"username": "u", "amqpUri": "amqp://u:p@host"}, "username": "u"}`, expected: `{"credentials": {"username": "*****", "amqpUri": "*****"}, "username": "u"}`},
+		{name: "wildcard requires parent", data: `{"username": "u", "spec": {"username": "v"}}`, expected: `{"username": "u", "spec": {"username": "v"}}`},
+		{name: "configured fields", fields: []string{"spec.username"}, data: `{"username": "u", "spec": {"username": "v"}, "password": "p"}`, expected: `{"username": "u", "spec": {"username": "*****"}, "password": "p"}`},
+		{name: "whole object", fields: []string{"credentials"}, data: `{"credentials": {"username": "u"}}`, expected: `{"credentials": "*****"}`},
+	}
+
+	for _, test := range tests {
+		redacted := New(test.fields).JSON([]byte(test.data))
+		if test.expected == "" || test.expected[0] != '{' {
+			if redacted != test.expected {
+				t.Errorf("%s: expected %q, got %q", test.name, test.expected, redacted)
+			}
+			continue
+		}
+		var got, expected interface{}
+		if err := json.Unmarshal([]byte(redacted), &got); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := json.Unmarshal([]byte(test.expected), &expected); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, redacted)
+		}
+	}
+}
+
+func TestNewTracer(t *testing.T) {
+	if NewTracer(false, nil) != nil {
+		t.Error("expected no tracer when tracing is disabled")
+	}
+	if NewTracer(true, nil) == nil {
+		t.Error("expected a tracer when tracing is enabled")
+	}
+}
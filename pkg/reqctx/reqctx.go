@@ -0,0 +1,139 @@
+// Package reqctx carries request-scoped values, such as the request ID, through a context.Context and
+// decorates log lines with them so that the lines logged for one request can be correlated.
+package reqctx
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+const (
+	RequestIDHeader       = "X-Request-Id"
+	BrokerRequestIDHeader = "X-Broker-API-Request-Identity"
+)
+
+var requestIDPattern = regexp.MustCompile("^[A-Za-z0-9._-]{1,128}$")
+
+type requestIDKey struct{}
+type instanceIDKey struct{}
+type operationKey struct{}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func WithInstanceID(ctx context.Context, instanceID string) context.Context {
+	return context.WithValue(ctx, instanceIDKey{}, instanceID)
+}
+
+func InstanceID(ctx context.Context) string {
+	instanceID, _ := ctx.Value(instanceIDKey{}).(string)
+	return instanceID
+}
+
+// WithOperation records the broker operation, such as "provision" or "bind", the request performs.
+func WithOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+func Operation(ctx context.Context) string {
+	operation, _ := ctx.Value(operationKey{}).(string)
+	return operation
+}
+
+// NewRequestID returns the request ID supplied by the client, if it is well-formed, or generates a new one.
+func NewRequestID(supplied string) string {
+	if requestIDPattern.MatchString(supplied) {
+		return supplied
+	}
+	return uuid.New()
+}
+
+// Detach returns a context carrying the request-scoped values of ctx, for work that outlives the request.
+func Detach(ctx context.Context) context.Context {
+	detached := WithRequestID(context.Background(), RequestID(ctx))
+	detached = WithInstanceID(detached, InstanceID(ctx))
+	return WithOperation(detached, Operation(ctx))
+}
+
+// Fields are the request-scoped values attached to a log line. They are passed to go-logging as the first
+// argument of every record logged through Log, so that backends such as the JSON formatter can emit them as
+// separate fields; formatted as text they render as the "[request id] " message prefix.
+type Fields struct {
+	RequestID  string
+	InstanceID string
+	Operation  string
+}
+
+func FieldsFrom(ctx context.Context) Fields {
+	return Fields{RequestID: RequestID(ctx), InstanceID: InstanceID(ctx), Operation: Operation(ctx)}
+}
+
+func (f Fields) String() string {
+	if f.RequestID == "" {
+		return ""
+	}
+	return "[" + f.RequestID + "] "
+}
+
+// Log attaches the request-scoped Fields to the lines logged through a go-logging logger.
+type Log struct {
+	logger *logging.Logger
+	fields Fields
+}
+
+func Logger(ctx context.Context, logger *logging.Logger) Log {
+	return Log{logger: logger, fields: FieldsFrom(ctx)}
+}
+
+func (l Log) args(args []interface{}) []interface{} {
+	return append([]interface{}{l.fields}, args...)
+}
+
+func (l Log) Debug(format string, args ...interface{}) {
+	l.logger.Debugf("%s"+format, l.args(args)...)
+}
+
+func (l Log) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf("%s"+format, l.args(args)...)
+}
+
+func (l Log) Info(format string, args ...interface{}) {
+	l.logger.Infof("%s"+format, l.args(args)...)
+}
+
+func (l Log) Infof(format string, args ...interface{}) {
+	l.logger.Infof("%s"+format, l.args(args)...)
+}
+
+func (l Log) Notice(format string, args ...interface{}) {
+	l.logger.Noticef("%s"+format, l.args(args)...)
+}
+
+func (l Log) Noticef(format string, args ...interface{}) {
+	l.logger.Noticef("%s"+format, l.args(args)...)
+}
+
+func (l Log) Warning(format string, args ...interface{}) {
+	l.logger.Warningf("%s"+format, l.args(args)...)
+}
+
+func (l Log) Warningf(format string, args ...interface{}) {
+	l.logger.Warningf("%s"+format, l.args(args)...)
+}
+
+func (l Log) Error(format string, args ...interface{}) {
+	l.logger.Errorf("%s"+format, l.args(args)...)
+}
+
+func (l Log) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf("%s"+format, l.args(args)...)
+}
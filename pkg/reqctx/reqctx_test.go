@@ -0,0 +1,67 @@
+package reqctx
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestNewRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		supplied string
+		kept     bool
+	}{
+		{name: "well-formed", supplied: "req-1.a_B", kept: true},
+		{name: "empty", supplied: ""},
+		{name: "invalid characters", supplied: "req 1\n"},
+		{name: "too long", supplied: strings.Repeat("a", 129)},
+	}
+
+	for _, test := range tests {
+		requestID := NewRequestID(test.supplied)
+		if test.kept && requestID != test.supplied {
+			t.Errorf("%s: expected request ID %q, got %q", test.name, test.supplied, requestID)
+		} else if !test.kept && (requestID == test.supplied || !requestIDPattern.MatchString(requestID)) {
+			t.Errorf("%s: expected a generated request ID, got %q", test.name, requestID)
+		}
+	}
+}
+
+func TestDetach(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := WithOperation(WithInstanceID(WithRequestID(parent, "req-1"), "i1"), "bind")
+	detached := Detach(ctx)
+	cancel()
+
+	if detached.Err() != nil {
+		t.Error("expected the detached context to outlive its parent")
+	}
+	if fields := FieldsFrom(detached); fields != (Fields{RequestID: "req-1", InstanceID: "i1", Operation: "bind"}) {
+		t.Errorf("expected the request-scoped values to be kept, got %v", fields)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		expected string
+	}{
+		{name: "request ID", ctx: WithRequestID(context.Background(), "req-1"), expected: "[req-1] Bound b1\n"},
+		{name: "no request ID", ctx: context.Background(), expected: "Bound b1\n"},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		logger := logging.MustGetLogger("test")
+		logger.SetBackend(logging.AddModuleLevel(logging.NewLogBackend(&buffer, "", 0)))
+		Logger(test.ctx, logger).Infof("Bound %s", "b1")
+		if buffer.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, buffer.String())
+		}
+	}
+}